@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/gokit/jsonfile"
+	"github.com/function61/gokit/osutil"
+	"github.com/scylladb/termtables"
+	"github.com/spf13/cobra"
+)
+
+type auditLogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor"` // "" = system
+	Summary   string    `json:"summary"`
+}
+
+// collects audit entries from the stream. summaries are built here so that secrets
+// (private key ciphertexts, config ciphertext, challenge key authorizations) never leave
+type auditLog struct {
+	entries []auditLogEntry
+	since   time.Time
+	types   map[string]bool // empty = all
+	version ehclient.Cursor
+}
+
+func newAuditLog(tenant ehreader.Tenant, since time.Time, types []string) *auditLog {
+	typesMap := map[string]bool{}
+	for _, typ := range types {
+		typesMap[typ] = true
+	}
+
+	return &auditLog{
+		entries: []auditLogEntry{},
+		since:   since,
+		types:   typesMap,
+		version: ehclient.Beginning(tenant.Stream(certificatestore.Stream)),
+	}
+}
+
+func (a *auditLog) GetEventTypes() ehevent.Allocators {
+	return cbdomain.Types
+}
+
+func (a *auditLog) ProcessEvents(_ context.Context, processAndCommit ehreader.EventProcessorHandler) error {
+	return processAndCommit(
+		a.version,
+		func(ev ehevent.Event) error {
+			a.processEvent(ev)
+			return nil
+		},
+		func(version ehclient.Cursor) error {
+			a.version = version
+			return nil
+		})
+}
+
+func (a *auditLog) processEvent(ev ehevent.Event) {
+	meta := ev.Meta()
+
+	if meta.Timestamp.Before(a.since) {
+		return
+	}
+
+	if len(a.types) > 0 && !a.types[ev.MetaType()] {
+		return
+	}
+
+	a.entries = append(a.entries, auditLogEntry{
+		Timestamp: meta.Timestamp,
+		Type:      ev.MetaType(),
+		Actor:     meta.ActingUserOrDefaultToTarget(),
+		Summary:   auditSummary(ev),
+	})
+}
+
+// NOTE: must never include secrets
+func auditSummary(ev ehevent.Event) string {
+	switch e := ev.(type) {
+	case *cbdomain.CertificateObtained:
+		summary := fmt.Sprintf(
+			"id=%s reason=%s challenge=%s expires=%s domains=%s",
+			e.Id,
+			e.Reason,
+			e.ChallengeType,
+			e.Expires.Format(time.RFC3339),
+			strings.Join(e.Domains, ","))
+		if e.Staged {
+			summary += " staged"
+		}
+		return summary
+	case *cbdomain.CertificateRemoved:
+		return "id=" + e.Id
+	case *cbdomain.CertificateActivated:
+		return "id=" + e.Id
+	case *cbdomain.CertificateRolledBack:
+		return fmt.Sprintf("id=%s expires=%s", e.Id, e.Expires.Format(time.RFC3339))
+	case *cbdomain.ConfigUpdated:
+		return "encrypted for key " + e.ConfigEncryptionKeyFingerprint
+	case *cbdomain.CertificateRequested:
+		return "hostname=" + e.Hostname
+	case *cbdomain.CertificateRequestFailed:
+		return fmt.Sprintf("hostname=%s error=%s", e.Hostname, e.Error)
+	case *cbdomain.ChallengePresented:
+		return fmt.Sprintf("type=%s domain=%s", e.ChallengeType, e.Domain)
+	case *cbdomain.ChallengeCleanedUp:
+		return ""
+	case *cbdomain.RenewalLeaseAcquired:
+		return fmt.Sprintf("id=%s holder=%s expires=%s", e.Id, e.Holder, e.Expires.Format(time.RFC3339))
+	case *cbdomain.RenewalLeaseReleased:
+		return fmt.Sprintf("id=%s holder=%s error=%s", e.Id, e.Holder, e.Error)
+	default:
+		return "(unknown event)"
+	}
+}
+
+func audit(ctx context.Context, since time.Time, types []string, asJson bool) error {
+	tenantCtx := readTenantCtx()
+
+	auditLog := newAuditLog(tenantCtx.Tenant, since, types)
+
+	if err := ehreader.New(auditLog, tenantCtx.Client, nil).LoadUntilRealtime(ctx); err != nil {
+		return err
+	}
+
+	if asJson {
+		return jsonfile.Marshal(os.Stdout, auditLog.entries)
+	}
+
+	tbl := termtables.CreateTable()
+	tbl.AddHeaders("Timestamp", "Type", "Actor", "Summary")
+
+	for _, entry := range auditLog.entries {
+		actor := entry.Actor
+		if actor == "" {
+			actor = "(system)"
+		}
+
+		tbl.AddRow(
+			entry.Timestamp.Format(time.RFC3339),
+			entry.Type,
+			actor,
+			entry.Summary)
+	}
+
+	fmt.Println(tbl.Render())
+
+	return nil
+}
+
+func auditEntry() *cobra.Command {
+	since := ""
+	types := []string{}
+	asJson := false
+
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Show who changed what (never shows secrets)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			sinceTime, err := parseSince(since, time.Now())
+			osutil.ExitIfError(err)
+
+			osutil.ExitIfError(audit(
+				osutil.CancelOnInterruptOrTerminate(nil),
+				sinceTime,
+				types,
+				asJson))
+		},
+	}
+
+	cmd.Flags().StringVarP(&since, "since", "", since, "Only events after this. Duration (24h) or date (2020-01-31 or RFC3339)")
+	cmd.Flags().StringSliceVarP(&types, "type", "", types, "Only events of these types (e.g. CertificateObtained)")
+	cmd.Flags().BoolVarP(&asJson, "json", "", asJson, "Output as JSON")
+
+	return cmd
+}
+
+// "" => zero time, "24h" => now-24h, "2020-01-31" or RFC3339 => that time
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(since); err == nil {
+		return now.Add(-duration), nil
+	}
+
+	if ts, err := time.Parse("2006-01-02", since); err == nil {
+		return ts, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since: %s", since)
+	}
+
+	return ts, nil
+}
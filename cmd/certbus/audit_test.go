@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/gokit/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	t0 := time.Date(2020, 5, 15, 12, 0, 0, 0, time.UTC)
+
+	events := []ehevent.Event{
+		cbdomain.NewConfigUpdated(
+			"SHA256:dummy",
+			[]byte("SECRET-config"),
+			ehevent.MetaSystemUser(t0)),
+		cbdomain.NewCertificateObtained(
+			"dummyCertId",
+			"new",
+			[]string{"example.com"},
+			t0.AddDate(0, 0, 90),
+			"SECRET-pem",
+			"SHA256:dummy",
+			[]byte("SECRET-key"),
+			"http-01",
+			"",
+			"",
+			"",
+			false,
+			time.Time{},
+			ehevent.Meta(t0.Add(time.Hour), "cli:joonas@laptop")),
+		cbdomain.NewChallengePresented(
+			"http-01",
+			"example.com",
+			"SECRET-token",
+			"SECRET-keyauth",
+			ehevent.Meta(t0.Add(2*time.Hour), "lambda:certbus")),
+		cbdomain.NewCertificateRemoved(
+			"dummyCertId",
+			ehevent.Meta(t0.Add(3*time.Hour), "cli:joonas@laptop")),
+	}
+
+	all := auditLogOf(time.Time{}, nil, events...)
+
+	assert.Assert(t, len(all.entries) == 4)
+	assert.EqualString(t, all.entries[0].Actor, "")
+	assert.EqualString(t, all.entries[1].Actor, "cli:joonas@laptop")
+	assert.EqualString(t, all.entries[1].Summary, "id=dummyCertId reason=new challenge=http-01 expires=2020-08-13T12:00:00Z domains=example.com")
+	assert.EqualString(t, all.entries[2].Summary, "type=http-01 domain=example.com")
+
+	asJson, err := json.Marshal(all.entries)
+	assert.Ok(t, err)
+	assert.Assert(t, !strings.Contains(string(asJson), "SECRET"))
+
+	filtered := auditLogOf(t0.Add(90*time.Minute), []string{"CertificateObtained", "CertificateRemoved"}, events...)
+
+	assert.Assert(t, len(filtered.entries) == 1)
+	assert.EqualString(t, filtered.entries[0].Type, "CertificateRemoved")
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2020, 5, 15, 12, 0, 0, 0, time.UTC)
+
+	since := func(input string) string {
+		ts, err := parseSince(input, now)
+		if err != nil {
+			return err.Error()
+		}
+
+		return ts.Format(time.RFC3339)
+	}
+
+	assert.EqualString(t, since(""), "0001-01-01T00:00:00Z")
+	assert.EqualString(t, since("24h"), "2020-05-14T12:00:00Z")
+	assert.EqualString(t, since("2020-01-31"), "2020-01-31T00:00:00Z")
+	assert.EqualString(t, since("2020-01-31T10:00:00Z"), "2020-01-31T10:00:00Z")
+	assert.EqualString(t, since("yesterday"), "invalid --since: yesterday")
+}
+
+func auditLogOf(since time.Time, types []string, events ...ehevent.Event) *auditLog {
+	auditLog := newAuditLog(ehreader.TenantId("1"), since, types)
+
+	for _, event := range events {
+		auditLog.processEvent(event)
+	}
+
+	return auditLog
+}
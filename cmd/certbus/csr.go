@@ -0,0 +1,22 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"github.com/function61/certbus/pkg/certbusmanager"
+)
+
+// returns CSR's PEM and the domains it asks for
+func readCSR(path string) (string, []string, error) {
+	csrPem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	domains, err := certbusmanager.CSRDomains(csrPem)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(csrPem), domains, nil
+}
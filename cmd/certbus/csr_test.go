@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/assert"
+)
+
+func TestReadCSR(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "example.com"},
+		DNSNames: []string{"example.com", "www.example.com"},
+	}, key)
+	assert.Ok(t, err)
+
+	csrPath := filepath.Join(t.TempDir(), "example.csr")
+	assert.Ok(t, ioutil.WriteFile(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDer}), 0600))
+
+	csrPem, domains, err := readCSR(csrPath)
+	assert.Ok(t, err)
+
+	assert.Assert(t, strings.HasPrefix(csrPem, "-----BEGIN CERTIFICATE REQUEST-----"))
+	assert.EqualString(t, strings.Join(domains, ", "), "example.com, www.example.com")
+}
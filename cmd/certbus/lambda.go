@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/function61/certbus/pkg/certbusmanager"
+	"github.com/function61/gokit/aws/lambdautils"
+	"github.com/function61/gokit/logex"
+)
+
+// HTTP requests (via Lambda function URL) are served by the API. anything else is assumed to be
+// a scheduled event => process first on-demand request, activate due staged certs & renew first
+// renewable
+type lambdaHandler struct{}
+
+func (l *lambdaHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	req := &functionUrlRequest{}
+	if err := json.Unmarshal(payload, req); err == nil && req.RequestContext.Http.Method != "" {
+		return l.serveHTTP(ctx, req)
+	}
+
+	return lambdautils.NoPayloadAdapter(func(ctx context.Context) error {
+		return runScheduled(ctx, newManager("lambda"), logex.Levels(logex.StandardLogger()))
+	}).Invoke(ctx, payload)
+}
+
+// subset of *certbusmanager.Manager
+type scheduledManager interface {
+	ProcessRequests(ctx context.Context, max int) error
+	ActivateDue(ctx context.Context) error
+	RenewDue(ctx context.Context, at time.Time) error
+}
+
+// like the daemon, carries on after errors. one bad on-demand hostname must not stop renewals
+func runScheduled(ctx context.Context, manager scheduledManager, logl *logex.Leveled) error {
+	errs := []string{}
+
+	if err := manager.ProcessRequests(ctx, 1); err != nil {
+		logl.Error.Printf("ProcessRequests: %v", err)
+		errs = append(errs, "ProcessRequests: "+err.Error())
+	}
+
+	if err := manager.ActivateDue(ctx); err != nil {
+		logl.Error.Printf("ActivateDue: %v", err)
+		errs = append(errs, "ActivateDue: "+err.Error())
+	}
+
+	if err := manager.RenewDue(ctx, time.Now()); err != nil {
+		errs = append(errs, "RenewDue: "+err.Error())
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (l *lambdaHandler) serveHTTP(ctx context.Context, req *functionUrlRequest) ([]byte, error) {
+	authenticate, err := apiAuthenticatorFromEnv(false)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := req.toHttpRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// function URLs don't do mTLS, so bearer tokens only. Lambda freezes us after we respond,
+	// so jobs can't run in the background
+	api := certbusmanager.NewApi(ctx, newManager("lambda"), authenticate, true)
+
+	resp := &functionUrlResponseWriter{header: http.Header{}, status: http.StatusOK}
+
+	api.ServeHTTP(resp, httpReq)
+
+	return json.Marshal(resp.toResponse())
+}
+
+// payload format version 2.0 (aws-lambda-go we use predates function URLs)
+type functionUrlRequest struct {
+	RawPath         string            `json:"rawPath"`
+	RawQueryString  string            `json:"rawQueryString"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		Http struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+func (f *functionUrlRequest) toHttpRequest(ctx context.Context) (*http.Request, error) {
+	body := []byte(f.Body)
+	if f.IsBase64Encoded {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(f.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reqUrl := &url.URL{Path: f.RawPath, RawQuery: f.RawQueryString}
+
+	req, err := http.NewRequestWithContext(ctx, f.RequestContext.Http.Method, reqUrl.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range f.Headers {
+		req.Header.Set(key, value)
+	}
+
+	return req, nil
+}
+
+type functionUrlResponse struct {
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+type functionUrlResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (f *functionUrlResponseWriter) Header() http.Header {
+	return f.header
+}
+
+func (f *functionUrlResponseWriter) Write(data []byte) (int, error) {
+	return f.body.Write(data)
+}
+
+func (f *functionUrlResponseWriter) WriteHeader(status int) {
+	f.status = status
+}
+
+func (f *functionUrlResponseWriter) toResponse() functionUrlResponse {
+	headers := map[string]string{}
+	for key, values := range f.header {
+		headers[key] = strings.Join(values, ", ")
+	}
+
+	return functionUrlResponse{
+		StatusCode: f.status,
+		Headers:    headers,
+		Body:       f.body.String(),
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/assert"
+	"github.com/function61/gokit/logex"
+)
+
+func TestFunctionUrlRequest(t *testing.T) {
+	req := &functionUrlRequest{}
+	assert.Ok(t, json.Unmarshal([]byte(`{
+	"version": "2.0",
+	"rawPath": "/renewable",
+	"rawQueryString": "at=2020-05-01T00:00:00Z",
+	"headers": {"authorization": "Bearer s3cret"},
+	"body": "eyJ4IjogMX0=",
+	"isBase64Encoded": true,
+	"requestContext": {"http": {"method": "POST"}}
+}`), req))
+
+	httpReq, err := req.toHttpRequest(context.Background())
+	assert.Ok(t, err)
+
+	assert.EqualString(t, httpReq.Method, "POST")
+	assert.EqualString(t, httpReq.URL.Path, "/renewable")
+	assert.EqualString(t, httpReq.URL.Query().Get("at"), "2020-05-01T00:00:00Z")
+	assert.EqualString(t, httpReq.Header.Get("Authorization"), "Bearer s3cret")
+
+	body, err := ioutil.ReadAll(httpReq.Body)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(body), `{"x": 1}`)
+}
+
+func TestApiAuthenticatorFromEnv(t *testing.T) {
+	defer os.Unsetenv("CERTBUS_API_TOKENS")
+
+	_, err := apiAuthenticatorFromEnv(false)
+	assert.EqualString(t, err.Error(), "API enabled but no credentials: set CERTBUS_API_TOKENS")
+
+	os.Setenv("CERTBUS_API_TOKENS", "portal")
+	_, err = apiAuthenticatorFromEnv(false)
+	assert.EqualString(t, err.Error(), "CERTBUS_API_TOKENS: expecting identity:token pairs")
+
+	os.Setenv("CERTBUS_API_TOKENS", "portal:s3cret,ci:t0ken")
+	_, err = apiAuthenticatorFromEnv(false)
+	assert.Ok(t, err)
+
+	// mTLS alone is enough
+	os.Unsetenv("CERTBUS_API_TOKENS")
+	_, err = apiAuthenticatorFromEnv(true)
+	assert.Ok(t, err)
+}
+
+func TestRunScheduledCarriesOnAfterErrors(t *testing.T) {
+	logs := &bytes.Buffer{}
+
+	manager := &fakeScheduledManager{
+		processRequestsErr: errors.New("bad.example.com does not resolve"),
+		activateDueErr:     errors.New("config unavailable"),
+	}
+
+	err := runScheduled(context.Background(), manager, logex.Levels(log.New(logs, "", 0)))
+	assert.EqualString(t, err.Error(), "ProcessRequests: bad.example.com does not resolve; ActivateDue: config unavailable")
+
+	// renewals were still attempted
+	assert.Assert(t, manager.renewDueCalled)
+	assert.EqualString(t, logs.String(), "[ERROR] ProcessRequests: bad.example.com does not resolve\n[ERROR] ActivateDue: config unavailable\n")
+
+	assert.Ok(t, runScheduled(context.Background(), &fakeScheduledManager{}, logex.Levels(log.New(ioutil.Discard, "", 0))))
+}
+
+type fakeScheduledManager struct {
+	processRequestsErr error
+	activateDueErr     error
+	renewDueCalled     bool
+}
+
+func (f *fakeScheduledManager) ProcessRequests(context.Context, int) error {
+	return f.processRequestsErr
+}
+
+func (f *fakeScheduledManager) ActivateDue(context.Context) error {
+	return f.activateDueErr
+}
+
+func (f *fakeScheduledManager) RenewDue(context.Context, time.Time) error {
+	f.renewDueCalled = true
+	return nil
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/function61/certbus/pkg/cbexampleserver"
+	"github.com/function61/certbus/pkg/certbusmanager"
 	"github.com/function61/eventhorizon/pkg/ehcli"
 	"github.com/function61/gokit/aws/lambdautils"
 	"github.com/function61/gokit/dynversion"
+	"github.com/function61/gokit/logex"
 	"github.com/function61/gokit/osutil"
 	"github.com/go-acme/lego/v4/challenge"
 	"github.com/spf13/cobra"
@@ -17,13 +19,7 @@ import (
 
 func main() {
 	if lambdautils.InLambda() {
-		// assume scheduled events => renew first renewable
-		lambda.StartHandler(lambdautils.NoPayloadAdapter(func(ctx context.Context) error {
-			return listRenewable(
-				ctx,
-				time.Now(),
-				true)
-		}))
+		lambda.StartHandler(&lambdaHandler{})
 		return
 	}
 
@@ -37,6 +33,10 @@ func main() {
 
 	app.AddCommand(configSubcommandsEntry())
 
+	app.AddCommand(managerSubcommandsEntry())
+
+	app.AddCommand(auditEntry())
+
 	// Event Horizon administration
 	app.AddCommand(ehcli.Entrypoint())
 
@@ -56,7 +56,7 @@ func configSubcommandsEntry() *cobra.Command {
 		Short: "Update configuration on the event bus",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			osutil.ExitIfError(updateConfig(
+			osutil.ExitIfError(newManager("cli").UpdateConfig(
 				osutil.CancelOnInterruptOrTerminate(nil),
 				os.Stdin))
 		},
@@ -76,48 +76,117 @@ func configSubcommandsEntry() *cobra.Command {
 	return cmd
 }
 
+func managerSubcommandsEntry() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "manager",
+		Short: "Manager subcommands",
+	}
+
+	healthAddr := ":8080"
+	apiAddr := ""
+	apiTlsCert := ""
+	apiTlsKey := ""
+	apiClientCa := ""
+
+	runCmd := &cobra.Command{
+		Use:   "run",
+		Short: "Run manager as a daemon (renews certs when they're due, serves on-demand requests)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			rootLogger := logex.StandardLogger()
+
+			osutil.ExitIfError(runManagerDaemon(
+				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				healthAddr,
+				apiOptions{
+					addr:     apiAddr,
+					tlsCert:  apiTlsCert,
+					tlsKey:   apiTlsKey,
+					clientCa: apiClientCa,
+				},
+				rootLogger))
+		},
+	}
+
+	runCmd.Flags().StringVarP(&healthAddr, "health-addr", "", healthAddr, "Address to serve health endpoint (/health) and metrics (/metrics) at")
+	runCmd.Flags().StringVarP(&apiAddr, "api-addr", "", apiAddr, "Address to serve the management API at (\"\" = disabled). Bearer tokens from $CERTBUS_API_TOKENS")
+	runCmd.Flags().StringVarP(&apiTlsCert, "api-tls-cert", "", apiTlsCert, "Serve API over TLS with this cert (PEM)")
+	runCmd.Flags().StringVarP(&apiTlsKey, "api-tls-key", "", apiTlsKey, "Private key (PEM) for --api-tls-cert")
+	runCmd.Flags().StringVarP(&apiClientCa, "api-client-ca", "", apiClientCa, "(with --api-tls-cert) Accept client certs signed by this CA (mTLS). Client cert's CN is its identity")
+
+	cmd.AddCommand(runCmd)
+
+	return cmd
+}
+
 func certSubcommandsEntry() *cobra.Command {
+	output := ""
+
 	cmd := &cobra.Command{
 		Use:   "cert",
 		Short: "Certificate management subcommands",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return validateOutputFormat(output)
+		},
 	}
 
-	cmd.AddCommand(listEntry())
-	cmd.AddCommand(mkEntry())
-	cmd.AddCommand(inspectEntry())
-	cmd.AddCommand(renewableEntry())
+	cmd.PersistentFlags().StringVarP(&output, "output", "o", output, "Output format: json|yaml|table (default: table, except json for cat)")
+
+	cmd.AddCommand(listEntry(&output))
+	cmd.AddCommand(mkEntry(&output))
+	cmd.AddCommand(importEntry(&output))
+	cmd.AddCommand(inspectEntry(&output))
+	cmd.AddCommand(historyEntry(&output))
+	cmd.AddCommand(chainEntry(&output))
+	cmd.AddCommand(renewableEntry(&output))
 	cmd.AddCommand(renewEntry())
+	cmd.AddCommand(activateEntry())
+	cmd.AddCommand(rollbackEntry())
 	cmd.AddCommand(removeEntry())
+	cmd.AddCommand(processRequestsEntry())
 
 	return cmd
 }
 
-func listEntry() *cobra.Command {
+func listEntry(output *string) *cobra.Command {
 	return &cobra.Command{
 		Use:   "ls",
 		Short: "List certificates",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			osutil.ExitIfError(list(osutil.CancelOnInterruptOrTerminate(nil)))
+			osutil.ExitIfError(list(osutil.CancelOnInterruptOrTerminate(nil), *output))
 		},
 	}
 }
 
-func mkEntry() *cobra.Command {
+func mkEntry(output *string) *cobra.Command {
 	wildcard := false
 	subdomain := false
 	dns := true
+	tlsAlpn := false
+	dnsDelegateTo := ""
+	preferredChain := ""
+	csrPath := ""
+	preflightOnly := false
 
 	cmd := &cobra.Command{
 		Use:   "mk [domain]",
 		Short: "Issue new certificate",
-		Args:  cobra.ExactArgs(1),
+		Args:  cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			if wildcard && subdomain {
 				panic("cannot apply both wildcard and subdomain certificate at the same time")
 			}
 
+			if (csrPath != "") == (len(args) == 1) {
+				panic("specify either domain or --csr")
+			}
+
 			challengeType := func() challenge.Type {
+				if tlsAlpn {
+					return challenge.TLSALPN01
+				}
+
 				if dns {
 					return challenge.DNS01
 				} else {
@@ -125,40 +194,139 @@ func mkEntry() *cobra.Command {
 				}
 			}()
 
-			createCert := newBasicCertificate
-			if subdomain {
-				createCert = newSubdomainCertificate
-			}
-			if wildcard {
-				createCert = newWildcardCertificate
+			csrPem, domains, err := func() (string, []string, error) {
+				if csrPath != "" { // domains come from CSR
+					return readCSR(csrPath)
+				}
+
+				certDomains := basicCertificateDomains
+				if subdomain {
+					certDomains = subdomainCertificateDomains
+				}
+				if wildcard {
+					certDomains = wildcardCertificateDomains
+				}
+
+				return "", certDomains(args[0]), nil
+			}()
+			osutil.ExitIfError(err)
+
+			ctx := osutil.CancelOnInterruptOrTerminate(nil)
+
+			if preflightOnly {
+				osutil.ExitIfError(newManager("cli").Preflight(ctx, domains, challengeType, dnsDelegateTo))
+
+				fmt.Println("pre-flight checks passed")
+				return
 			}
 
-			osutil.ExitIfError(createCert(
-				osutil.CancelOnInterruptOrTerminate(nil),
-				args[0],
-				challengeType))
+			certId, err := newManager("cli").Issue(
+				ctx,
+				domains,
+				challengeType,
+				dnsDelegateTo,
+				preferredChain,
+				csrPem)
+			osutil.ExitIfError(err)
+
+			if *output != "" && *output != outputTable {
+				osutil.ExitIfError(printStructured(os.Stdout, *output, certIdOutput{certId}))
+			}
 		},
 	}
 
 	cmd.Flags().BoolVarP(&wildcard, "wildcard", "", wildcard, "Create wildcard certificate, please take care you don't have wildcard CNAME (mutually exclusive with --subdomain)")
 	cmd.Flags().BoolVarP(&subdomain, "subdomain", "", subdomain, "Create subdomain certificate (no 'www.' prefix)")
 	cmd.Flags().BoolVarP(&dns, "dns", "", dns, "Use DNS-01 challenge")
+	cmd.Flags().StringVarP(&dnsDelegateTo, "dns-delegate-to", "", dnsDelegateTo, "Answer DNS-01 in this zone (_acme-challenge.<domain> must CNAME to _acme-challenge.<domain>.<zone>)")
+	cmd.Flags().BoolVarP(&tlsAlpn, "tls-alpn", "", tlsAlpn, "Use TLS-ALPN-01 challenge (answered by loadbalancers via the bus, overrides --dns)")
+	cmd.Flags().StringVarP(&preferredChain, "preferred-chain", "", preferredChain, "Issuer CN of chain's top cert, if CA offers alternate chains (overrides config, also used for renewals)")
+	cmd.Flags().StringVarP(&csrPath, "csr", "", csrPath, "Issue for this CSR (domains come from it). Private key stays with you - consumers need a KeyLocator")
+	cmd.Flags().BoolVarP(&preflightOnly, "preflight-only", "", preflightOnly, "Only run pre-flight checks (CAA, DNS, challenge self-test), don't order the cert")
 
 	return cmd
 }
 
-func inspectEntry() *cobra.Command {
-	return &cobra.Command{
+func importEntry(output *string) *cobra.Command {
+	certPath := ""
+	keyPath := ""
+	replaceId := ""
+	skipChainVerification := false
+
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import cert not obtainable via ACME (EV, internal PKI). You'll be alerted for renewal",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(importCertificate(
+				osutil.CancelOnInterruptOrTerminate(nil),
+				certPath,
+				keyPath,
+				replaceId,
+				!skipChainVerification,
+				*output))
+		},
+	}
+
+	cmd.Flags().StringVarP(&certPath, "cert", "", certPath, "Cert + intermediates (fullchain.pem)")
+	cmd.Flags().StringVarP(&keyPath, "key", "", keyPath, "Private key (PEM)")
+	cmd.Flags().StringVarP(&replaceId, "id", "", replaceId, "Replace previously imported cert (e.g. after manual renewal)")
+	cmd.Flags().BoolVarP(&skipChainVerification, "skip-chain-verification", "", skipChainVerification, "Don't require chaining to system roots (internal PKI)")
+	_ = cmd.MarkFlagRequired("cert")
+	_ = cmd.MarkFlagRequired("key")
+
+	return cmd
+}
+
+func inspectEntry(output *string) *cobra.Command {
+	includeCiphertext := false
+
+	cmd := &cobra.Command{
 		Use:   "cat [id]",
 		Short: "Inspect a certificate",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			osutil.ExitIfError(inspect(osutil.CancelOnInterruptOrTerminate(nil), args[0]))
+			osutil.ExitIfError(inspect(
+				osutil.CancelOnInterruptOrTerminate(nil),
+				args[0],
+				*output,
+				includeCiphertext))
 		},
 	}
+
+	cmd.Flags().BoolVarP(&includeCiphertext, "include-ciphertext", "", includeCiphertext, "Include the encrypted private key")
+
+	return cmd
 }
 
-func renewableEntry() *cobra.Command {
+func historyEntry(output *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "history [id]",
+		Short: "List all certs ever obtained for a managed cert (also works for removed certs)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(history(osutil.CancelOnInterruptOrTerminate(nil), args[0], *output))
+		},
+	}
+}
+
+func chainEntry(output *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "chain [id]",
+		Short: "Show which intermediates & root each cert (or given cert) chains to",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			id := ""
+			if len(args) >= 1 {
+				id = args[0]
+			}
+
+			osutil.ExitIfError(chain(osutil.CancelOnInterruptOrTerminate(nil), id, *output))
+		},
+	}
+}
+
+func renewableEntry(output *string) *cobra.Command {
 	renewFirst := false
 
 	cmd := &cobra.Command{
@@ -178,7 +346,8 @@ func renewableEntry() *cobra.Command {
 			osutil.ExitIfError(listRenewable(
 				osutil.CancelOnInterruptOrTerminate(nil),
 				after,
-				renewFirst))
+				renewFirst,
+				*output))
 		},
 	}
 
@@ -188,27 +357,87 @@ func renewableEntry() *cobra.Command {
 }
 
 func renewEntry() *cobra.Command {
-	return &cobra.Command{
+	staged := false
+	activateAfter := time.Duration(0)
+
+	cmd := &cobra.Command{
 		Use:   "renew [id]",
 		Short: "Renew a cert",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			osutil.ExitIfError(renew(
+			var stagedOpts *certbusmanager.Staging // nil = config decides
+			if staged {
+				stagedOpts = &certbusmanager.Staging{ActivateAfter: activateAfter}
+			}
+
+			osutil.ExitIfError(newManager("cli").Renew(
+				osutil.CancelOnInterruptOrTerminate(nil),
+				args[0],
+				stagedOpts))
+		},
+	}
+
+	cmd.Flags().BoolVarP(&staged, "staged", "", staged, "Serve renewed cert only on canaries until activated")
+	cmd.Flags().DurationVarP(&activateAfter, "activate-after", "", activateAfter, "(with --staged) Activate automatically after this. 0 = activate manually")
+
+	return cmd
+}
+
+func activateEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "activate [id]",
+		Short: "Activate a staged cert (served by all loadbalancers)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(newManager("cli").Activate(
 				osutil.CancelOnInterruptOrTerminate(nil),
 				args[0]))
 		},
 	}
 }
 
+func rollbackEntry() *cobra.Command {
+	skipRevocationCheck := false
+
+	cmd := &cobra.Command{
+		Use:   "rollback [id]",
+		Short: "Put back the previous cert (refuses if it's expired or revoked)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(newManager("cli").Rollback(
+				osutil.CancelOnInterruptOrTerminate(nil),
+				args[0],
+				!skipRevocationCheck))
+		},
+	}
+
+	cmd.Flags().BoolVarP(&skipRevocationCheck, "skip-revocation-check", "", skipRevocationCheck, "Don't ask the CA (OCSP/CRL) whether previous cert is revoked")
+
+	return cmd
+}
+
 func removeEntry() *cobra.Command {
 	return &cobra.Command{
 		Use:   "rm [id]",
 		Short: "Remove a certificate (will also not get automatically renewed)",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			osutil.ExitIfError(remove(
+			osutil.ExitIfError(newManager("cli").Remove(
 				osutil.CancelOnInterruptOrTerminate(nil),
 				args[0]))
 		},
 	}
 }
+
+func processRequestsEntry() *cobra.Command {
+	return &cobra.Command{
+		Use:   "process-requests",
+		Short: "Issue certificates requested on-demand by loadbalancers (uses HTTP-01)",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			osutil.ExitIfError(newManager("cli").ProcessRequests(
+				osutil.CancelOnInterruptOrTerminate(nil),
+				-1))
+		},
+	}
+}
@@ -1,33 +1,30 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/function61/certbus/pkg/cbdomain"
-	"github.com/function61/certbus/pkg/certbus"
+	"github.com/function61/certbus/pkg/certbusmanager"
 	"github.com/function61/certbus/pkg/certificatestore"
 	"github.com/function61/certbus/pkg/encryptedbox"
-	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/eventhorizon/pkg/ehreader"
-	"github.com/function61/gokit/aws/s3facade"
-	"github.com/function61/gokit/cryptorandombytes"
 	"github.com/function61/gokit/cryptoutil"
+	"github.com/function61/gokit/httputils"
 	"github.com/function61/gokit/jsonfile"
 	"github.com/function61/gokit/logex"
-	"github.com/function61/lambda-alertmanager/pkg/alertmanagerclient"
-	"github.com/go-acme/lego/v4/certificate"
-	"github.com/go-acme/lego/v4/challenge"
-	"github.com/go-acme/lego/v4/lego"
+	"github.com/function61/gokit/taskrunner"
 	legolog "github.com/go-acme/lego/v4/log"
-	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
 	"github.com/scylladb/termtables"
 )
 
@@ -36,95 +33,255 @@ func init() {
 	legolog.Logger = logex.Prefix("lego", logex.StandardLogger())
 }
 
-func inspect(ctx context.Context, id string) error {
-	certs, err := certbus.ResolveRealtimeState(ctx, readTenantCtx(), nil)
-	if err != nil {
-		return err
+// process is recorded in the audit trail ("cli", "daemon" or "lambda")
+func newManager(process string) *certbusmanager.Manager {
+	return certbusmanager.New(
+		readTenantCtx(),
+		process,
+		time.Now,
+		certbusmanager.LegoClientFactory(),
+		certbusmanager.RsaConfigDecrypter(loadManagerPrivateKey),
+		logex.StandardLogger())
+}
+
+type apiOptions struct {
+	addr     string // "" = API disabled
+	tlsCert  string
+	tlsKey   string
+	clientCa string // "" = no mTLS
+}
+
+func runManagerDaemon(ctx context.Context, healthAddr string, api apiOptions, logger *log.Logger) error {
+	manager := newManager("daemon")
+
+	daemon := certbusmanager.NewDaemon(manager)
+
+	routes := http.NewServeMux()
+	routes.Handle("/health", daemon.HealthHandler())
+	routes.Handle("/metrics", manager.MetricsHandler())
+
+	srv := &http.Server{
+		Addr:    healthAddr,
+		Handler: routes,
 	}
 
-	cert := certs.ById(id)
-	if cert == nil {
-		return fmt.Errorf("cert not found: %s", id)
+	tasks := taskrunner.New(ctx, logger)
+
+	tasks.Start("manager", daemon.Run)
+
+	tasks.Start("health endpoint "+healthAddr, func(_ context.Context) error {
+		return httputils.RemoveGracefulServerClosedError(srv.ListenAndServe())
+	})
+
+	tasks.Start("health endpoint shutdowner", httputils.ServerShutdownTask(srv))
+
+	if api.addr != "" {
+		apiSrv, err := makeApiServer(ctx, manager, api)
+		if err != nil {
+			return err
+		}
+
+		tasks.Start("api "+api.addr, func(_ context.Context) error {
+			if api.tlsCert != "" {
+				return httputils.RemoveGracefulServerClosedError(apiSrv.ListenAndServeTLS(api.tlsCert, api.tlsKey))
+			}
+
+			return httputils.RemoveGracefulServerClosedError(apiSrv.ListenAndServe())
+		})
+
+		tasks.Start("api shutdowner", httputils.ServerShutdownTask(apiSrv))
 	}
 
-	return jsonfile.Marshal(os.Stdout, cert)
+	return tasks.Wait()
 }
 
-func renew(ctx context.Context, id string) error {
-	certs, err := certbus.ResolveRealtimeState(ctx, readTenantCtx(), nil)
+func makeApiServer(ctx context.Context, manager *certbusmanager.Manager, api apiOptions) (*http.Server, error) {
+	if api.clientCa != "" && api.tlsCert == "" {
+		return nil, errors.New("mTLS (--api-client-ca) requires --api-tls-cert")
+	}
+
+	authenticate, err := apiAuthenticatorFromEnv(api.clientCa != "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	cert := certs.ById(id)
-	if cert == nil {
-		return fmt.Errorf("cert not found: %s", id)
+	srv := &http.Server{
+		Addr:    api.addr,
+		Handler: certbusmanager.NewApi(ctx, manager, authenticate, false),
+	}
+
+	if api.clientCa != "" {
+		clientCaPem, err := ioutil.ReadFile(api.clientCa)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCas := x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(clientCaPem) {
+			return nil, fmt.Errorf("no certs found in %s", api.clientCa)
+		}
+
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  clientCas,
+			ClientAuth: tls.VerifyClientCertIfGiven, // bearer tokens work too
+		}
+	}
+
+	return srv, nil
+}
+
+// $CERTBUS_API_TOKENS looks like "portal:<token>,ci:<token>" (identity:token pairs)
+func apiAuthenticatorFromEnv(clientCerts bool) (certbusmanager.ApiAuthenticator, error) {
+	tokens := map[string]string{}
+
+	if serialized := os.Getenv("CERTBUS_API_TOKENS"); serialized != "" {
+		for _, pair := range strings.Split(serialized, ",") {
+			identity, token := func() (string, string) {
+				parts := strings.SplitN(pair, ":", 2)
+				if len(parts) != 2 {
+					return "", ""
+				}
+
+				return parts[0], parts[1]
+			}()
+			if identity == "" || token == "" {
+				return nil, errors.New("CERTBUS_API_TOKENS: expecting identity:token pairs")
+			}
+
+			tokens[token] = identity
+		}
 	}
 
-	return renewCertificate(ctx, *cert)
+	if !clientCerts {
+		if len(tokens) == 0 {
+			return nil, errors.New("API enabled but no credentials: set CERTBUS_API_TOKENS")
+		}
+
+		return certbusmanager.BearerTokenAuthenticator(tokens), nil
+	}
+
+	return certbusmanager.AnyAuthenticator(
+		certbusmanager.ClientCertAuthenticator(),
+		certbusmanager.BearerTokenAuthenticator(tokens)), nil
 }
 
-func listRenewable(ctx context.Context, after time.Time, renewFirst bool) error {
-	tenantCtx := readTenantCtx()
+// what "cert cat" shows. ciphertext of private key is opt-in, as it's just noise to humans
+type certDetails struct {
+	certificatestore.CertSummary
+	DNS01DelegatedTo    string            `json:"dns01_delegated_to,omitempty"`
+	PreferredChain      string            `json:"preferred_chain,omitempty"`
+	CSR                 string            `json:"csr,omitempty"`
+	CertPemBundle       string            `json:"cert_pem_bundle"`
+	PrivateKeyEncrypted *encryptedbox.Box `json:"private_key_encrypted,omitempty"`
+}
+
+// what "cert ls" shows
+type certListItem struct {
+	certificatestore.CertSummary
+	RateLimitRemaining certificatestore.RateLimitRemaining `json:"rate_limit_remaining"`
+}
 
-	certs, err := certbus.ResolveRealtimeState(ctx, tenantCtx, nil)
+// what "cert chain" shows
+type certChain struct {
+	Id             string                       `json:"id"`
+	Domains        []string                     `json:"domains"`
+	Chain          []certificatestore.ChainCert `json:"chain"` // leaf first
+	Root           string                       `json:"root"`
+	PreferredChain string                       `json:"preferred_chain"`
+}
+
+// output "" = JSON
+func inspect(ctx context.Context, id string, output string, includeCiphertext bool) error {
+	certs, err := newManager("cli").State(ctx)
 	if err != nil {
 		return err
 	}
 
-	tbl := termtables.CreateTable()
-	tbl.AddHeaders("Id", "RenewAt", "Domains")
+	cert := certs.ById(id)
+	if cert == nil {
+		return fmt.Errorf("cert not found: %s", id)
+	}
 
-	for idx, cert := range certificatestore.CertsDueForRenewal(certs, after) {
-		tbl.AddRow(
-			cert.Id,
-			cert.RenewAt.Format(time.RFC3339),
-			strings.Join(cert.Domains, ", "))
+	details := certDetails{
+		CertSummary:      certificatestore.Summarize(certs, *cert, time.Now()),
+		DNS01DelegatedTo: cert.DNS01DelegatedTo,
+		PreferredChain:   cert.PreferredChain,
+		CSR:              cert.CSR,
+		CertPemBundle:    cert.Certificate.CertPemBundle,
+	}
 
-		if renewFirst && idx == 0 {
-			if err := renewCertificate(ctx, cert); err != nil {
-				return err
-			}
-		}
+	if includeCiphertext {
+		details.PrivateKeyEncrypted = cert.Certificate.PrivateKeyEncrypted
 	}
 
-	if renewFirst {
-		conf, err := decryptConfig(certs)
-		if err != nil {
-			return fmt.Errorf("decryptConfig: %w", err)
+	if output != outputTable {
+		if output == "" {
+			output = outputJson
 		}
 
-		if conf.AlertManagerBaseurl != "" {
-			if err := alertmanagerclient.New(conf.AlertManagerBaseurl).DeadMansSwitchCheckin(
-				ctx,
-				"CertBus "+tenantCtx.Stream(certificatestore.Stream),
-				48*time.Hour,
-			); err != nil {
-				return err
-			}
-		}
+		return printStructured(os.Stdout, output, details)
 	}
 
+	summary := details.CertSummary
+
+	lastRenewalError := ""
+	if summary.LastRenewalError != nil {
+		lastRenewalError = fmt.Sprintf("%s (%s)", summary.LastRenewalError.Error, summary.LastRenewalError.Timestamp.Format(time.RFC3339))
+	}
+
+	tbl := termtables.CreateTable()
+	tbl.AddHeaders("Field", "Value")
+	tbl.AddRow("Id", summary.Id)
+	tbl.AddRow("Domains", strings.Join(summary.Domains, ", "))
+	tbl.AddRow("Challenge", summary.ChallengeType)
+	tbl.AddRow("Serial", summary.Serial)
+	tbl.AddRow("Issuer", summary.Issuer)
+	tbl.AddRow("Key type", summary.KeyType)
+	tbl.AddRow("NotBefore", summary.NotBefore.Format(time.RFC3339))
+	tbl.AddRow("NotAfter", summary.NotAfter.Format(time.RFC3339))
+	tbl.AddRow("Days left", summary.DaysLeft)
+	tbl.AddRow("RenewAt", summary.RenewAt.Format(time.RFC3339))
+	tbl.AddRow("Last renewal error", lastRenewalError)
+
 	fmt.Println(tbl.Render())
 
 	return nil
 }
 
-func list(ctx context.Context) error {
-	certs, err := certbus.ResolveRealtimeState(ctx, readTenantCtx(), nil)
+func history(ctx context.Context, id string, output string) error {
+	certs, err := newManager("cli").State(ctx)
 	if err != nil {
 		return err
 	}
 
+	issuances := certs.History(id)
+	if len(issuances) == 0 {
+		return fmt.Errorf("cert not found: %s", id)
+	}
+
+	if output != "" && output != outputTable {
+		return printStructured(os.Stdout, output, issuances)
+	}
+
 	tbl := termtables.CreateTable()
-	tbl.AddHeaders("Id", "Expires", "Challenge", "Domains")
+	tbl.AddHeaders("Obtained", "Reason", "Challenge", "Actor", "Serial", "Issuer", "NotBefore", "NotAfter", "Domains")
+
+	for _, issuance := range issuances {
+		actor := issuance.Actor
+		if actor == "" {
+			actor = "(system)"
+		}
 
-	for _, cert := range certs.All() {
 		tbl.AddRow(
-			cert.Id,
-			cert.Certificate.NotAfter.Format(time.RFC3339),
-			cert.ChallengeType,
-			strings.Join(cert.Domains, ", "))
+			issuance.Timestamp.Format(time.RFC3339),
+			issuance.Reason,
+			issuance.ChallengeType,
+			actor,
+			issuance.Serial,
+			issuance.Issuer,
+			issuance.NotBefore.Format(time.RFC3339),
+			issuance.NotAfter.Format(time.RFC3339),
+			strings.Join(issuance.Domains, ", "))
 	}
 
 	fmt.Println(tbl.Render())
@@ -132,238 +289,244 @@ func list(ctx context.Context) error {
 	return nil
 }
 
-func remove(ctx context.Context, id string) error {
-	tenantCtx := readTenantCtx()
-
-	certs, err := certbus.ResolveRealtimeState(ctx, tenantCtx, nil)
+// id "" = all certs
+func chain(ctx context.Context, id string, output string) error {
+	certs, err := newManager("cli").State(ctx)
 	if err != nil {
 		return err
 	}
 
-	if certs.ById(id) == nil {
-		return fmt.Errorf("cert to remove not found by id: %s", id)
+	toShow := certs.All()
+	if id != "" {
+		cert := certs.ById(id)
+		if cert == nil {
+			return fmt.Errorf("cert not found: %s", id)
+		}
+
+		toShow = []certificatestore.ManagedCertificate{*cert}
 	}
 
-	removed := cbdomain.NewCertificateRemoved(
-		id,
-		ehevent.MetaSystemUser(time.Now()))
+	chains := []certChain{}
+	for _, cert := range toShow {
+		chain, err := certificatestore.Chain(cert)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cert.Id, err)
+		}
 
-	// this uses optimistic locking
-	// TODO: retry logic
-	_, err = tenantCtx.Client.AppendAfter(
-		ctx,
-		certs.Version(),
-		[]string{ehevent.Serialize(removed)})
-	return err
-}
+		chains = append(chains, certChain{
+			Id:             cert.Id,
+			Domains:        cert.Domains,
+			Chain:          chain,
+			Root:           certificatestore.ChainRoot(chain),
+			PreferredChain: cert.PreferredChain,
+		})
+	}
 
-func readTenantCtx() ehreader.TenantCtx {
-	client, err := ehreader.TenantCtxFrom(ehreader.ConfigFromEnv)
-	if err != nil {
-		panic(err)
+	if output != "" && output != outputTable {
+		return printStructured(os.Stdout, output, chains)
 	}
 
-	return *client
-}
+	tbl := termtables.CreateTable()
+	tbl.AddHeaders("Id", "Domains", "Chain (leaf first)", "Root", "Preferred chain")
 
-func newBasicCertificate(ctx context.Context, domain string, challengeType challenge.Type) error {
-	return newCertificateInternal(
-		ctx,
-		[]string{"www." + domain, domain},
-		newCertId(),
-		"new",
-		challengeType)
-}
+	for _, chain := range chains {
+		links := []string{}
+		for _, link := range chain.Chain {
+			links = append(links, fmt.Sprintf("%s (expires %s)", link.Subject, link.NotAfter.Format("2006-01-02")))
+		}
 
-func newSubdomainCertificate(ctx context.Context, domain string, challengeType challenge.Type) error {
-	return newCertificateInternal(
-		ctx,
-		[]string{domain},
-		newCertId(),
-		"new",
-		challengeType)
-}
+		tbl.AddRow(
+			chain.Id,
+			strings.Join(chain.Domains, ", "),
+			strings.Join(links, " -> "),
+			chain.Root,
+			chain.PreferredChain)
+	}
+
+	fmt.Println(tbl.Render())
 
-func newWildcardCertificate(ctx context.Context, domain string, challengeType challenge.Type) error {
-	return newCertificateInternal(
-		ctx,
-		[]string{"*." + domain, domain},
-		newCertId(),
-		"new",
-		challengeType)
+	return nil
 }
 
-func renewCertificate(ctx context.Context, expiringCert certificatestore.ManagedCertificate) error {
-	// we need to renew the cert using the same challenge type that we used before with this certificate
-	challengeType, err := func() (challenge.Type, error) {
-		switch expiringCert.ChallengeType {
-		case challenge.DNS01.String(), "": // old events didn't record challenge type
-			return challenge.DNS01, nil
-		case challenge.HTTP01.String():
-			return challenge.HTTP01, nil
-		default:
-			return "", fmt.Errorf("unknown challengeType: %s", expiringCert.ChallengeType)
-		}
-	}()
+func listRenewable(ctx context.Context, after time.Time, renewFirst bool, output string) error {
+	manager := newManager("cli")
+
+	certs, err := manager.State(ctx)
 	if err != nil {
 		return err
 	}
 
-	return newCertificateInternal(
-		ctx,
-		expiringCert.Domains,
-		expiringCert.Id,
-		"renewal",
-		challengeType)
-}
+	if renewFirst {
+		if err := manager.RenewDue(ctx, after); err != nil {
+			return err
+		}
+	}
 
-func newCertificateInternal(
-	ctx context.Context,
-	domains []string,
-	certId string,
-	reason string,
-	challengeType challenge.Type,
-) error {
-	tenantCtx := readTenantCtx()
+	now := time.Now()
 
-	certs, err := certbus.ResolveRealtimeState(ctx, tenantCtx, nil)
-	if err != nil {
-		return err
+	renewable := []certificatestore.CertSummary{}
+	for _, cert := range certificatestore.CertsDueForRenewal(certs, after) {
+		renewable = append(renewable, certificatestore.Summarize(certs, cert, now))
 	}
 
-	conf, err := decryptConfig(certs)
-	if err != nil {
-		return fmt.Errorf("decryptConfig: %w", err)
+	if output != "" && output != outputTable {
+		return printStructured(os.Stdout, output, renewable)
 	}
 
-	legoClient, err := makeLegoClient(*conf, challengeType)
-	if err != nil {
-		return err
-	}
+	tbl := termtables.CreateTable()
+	tbl.AddHeaders("Id", "RenewAt", "Domains")
 
-	request := certificate.ObtainRequest{
-		Domains: domains,
-		Bundle:  true,
+	for _, cert := range renewable {
+		tbl.AddRow(
+			cert.Id,
+			cert.RenewAt.Format(time.RFC3339),
+			strings.Join(cert.Domains, ", "))
 	}
 
-	resp, err := legoClient.Certificate.Obtain(request)
+	fmt.Println(tbl.Render())
+
+	return nil
+}
+
+func list(ctx context.Context, output string) error {
+	manager := newManager("cli")
+
+	certs, err := manager.State(ctx)
 	if err != nil {
 		return err
 	}
 
-	obtained, err := makeCertificateObtainedEvent(
-		certId,
-		*resp,
-		domains,
-		[]byte(conf.KekPublicKey),
-		reason,
-		challengeType,
-	)
-	if err != nil {
-		return err
+	// listing shouldn't require being able to decrypt the config, so fall back to defaults
+	budget := certificatestore.LetsEncryptRateLimits()
+	if conf, err := manager.Config(ctx); err == nil {
+		budget = conf.RateLimits()
 	}
 
-	_, err = tenantCtx.Client.Append(
-		ctx,
-		tenantCtx.Stream(certificatestore.Stream),
-		[]string{ehevent.Serialize(obtained)})
-	return err
-}
+	now := time.Now()
 
-func makeLegoClient(conf config, challengeType challenge.Type) (*lego.Client, error) {
-	adapter, err := conf.LetsEncrypt.ToLegoInterface()
-	if err != nil {
-		return nil, err
+	items := []certListItem{}
+	for _, cert := range certs.All() {
+		items = append(items, certListItem{
+			CertSummary:        certificatestore.Summarize(certs, cert, now),
+			RateLimitRemaining: certificatestore.RemainingRateLimitBudget(certs.Issuances(), cert.Domains, budget, now),
+		})
 	}
 
-	legoClient, err := lego.NewClient(lego.NewConfig(adapter))
-	if err != nil {
-		return nil, err
+	if output != "" && output != outputTable {
+		return printStructured(os.Stdout, output, items)
 	}
 
-	if adapter.GetRegistration() == nil {
-		// one could be obtained with:
-		//     legoClient.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
-		return nil, errors.New("LetsEncrypt registration empty")
-	}
+	tbl := termtables.CreateTable()
+	tbl.AddHeaders("Id", "Expires", "Days left", "Challenge", "Domains", "Duplicates left", "Registered domain left")
 
-	switch challengeType {
-	case challenge.DNS01:
-		cfConf := cloudflare.NewDefaultConfig() // sets important fields (like TTL)
-		cfConf.AuthEmail = conf.CloudflareCredentials.Email
-		cfConf.AuthKey = conf.CloudflareCredentials.ApiKey
+	for _, item := range items {
+		remaining := item.RateLimitRemaining
 
-		cloudflareProvider, err := cloudflare.NewDNSProviderConfig(cfConf)
-		if err != nil {
-			return nil, err
+		registeredDomainLeft := fmt.Sprintf("%d/%d", remaining.RegisteredDomain, budget.CertsPerRegisteredDomain)
+		if remaining.ExemptAsRenewal {
+			registeredDomainLeft += " (renewal)"
 		}
 
-		if err := legoClient.Challenge.SetDNS01Provider(cloudflareProvider); err != nil {
-			return nil, err
-		}
+		tbl.AddRow(
+			item.Id,
+			item.NotAfter.Format(time.RFC3339),
+			item.DaysLeft,
+			item.ChallengeType,
+			strings.Join(item.Domains, ", "),
+			fmt.Sprintf("%d/%d", remaining.DuplicateCerts, budget.DuplicateCerts),
+			registeredDomainLeft)
+	}
 
-		return legoClient, nil
-	case challenge.HTTP01:
-		if conf.AcmeHTTP01Challenges == nil {
-			return nil, errors.New("cannot use HTTP-01 due to missing configuration")
-		}
+	fmt.Println(tbl.Render())
 
-		validationsBucket, err := s3facade.Bucket(
-			conf.AcmeHTTP01Challenges.Bucket,
-			nil, // use AWS-SDK built-in credentials resolving so this works with Lambda roles
-			conf.AcmeHTTP01Challenges.Region)
-		if err != nil {
-			return nil, err
-		}
+	if staged := certs.Staged(); len(staged) > 0 {
+		stagedTbl := termtables.CreateTable()
+		stagedTbl.AddHeaders("Staged id", "Expires", "ActivateAt", "Domains")
 
-		if err := legoClient.Challenge.SetHTTP01Provider(&bucketChallengeUploader{validationsBucket}); err != nil {
-			return nil, err
+		for _, cert := range staged {
+			activateAt := "(manual)"
+			if !cert.ActivateAt.IsZero() {
+				activateAt = cert.ActivateAt.Format(time.RFC3339)
+			}
+
+			stagedTbl.AddRow(
+				cert.Id,
+				cert.Certificate.NotAfter.Format(time.RFC3339),
+				activateAt,
+				strings.Join(cert.Domains, ", "))
 		}
 
-		return legoClient, nil
-	default:
-		return nil, fmt.Errorf("unimplemented challenge: %s", challengeType)
+		fmt.Println(stagedTbl.Render())
 	}
+
+	return nil
 }
 
-func makeCertificateObtainedEvent(
-	certId string,
-	certAndPrivateKey certificate.Resource,
-	domains []string,
-	publicKey []byte,
-	reason string,
-	challengeType challenge.Type,
-) (*cbdomain.CertificateObtained, error) {
-	certParsed, err := cryptoutil.ParsePemX509Certificate(certAndPrivateKey.Certificate)
+func importCertificate(
+	ctx context.Context,
+	certPath string,
+	keyPath string,
+	replaceId string,
+	verifyChain bool,
+	output string,
+) error {
+	certPem, err := ioutil.ReadFile(certPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	pubKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPublicKey(publicKey)
+	keyPem, err := ioutil.ReadFile(keyPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	privateKeyEncrypted, err := encryptedbox.Encrypt(certAndPrivateKey.PrivateKey, pubKey)
+	certId, err := newManager("cli").Import(ctx, certPem, keyPem, replaceId, verifyChain)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if output != "" && output != outputTable {
+		return printStructured(os.Stdout, output, certIdOutput{certId})
+	}
+
+	fmt.Printf("imported as %s\n", certId)
+
+	return nil
+}
+
+// for commands that create a cert
+type certIdOutput struct {
+	Id string `json:"id"`
+}
+
+func displayConfig(ctx context.Context, out io.Writer) error {
+	conf, err := newManager("cli").Config(ctx)
+	if err != nil {
+		return err
 	}
 
-	return cbdomain.NewCertificateObtained(
-		certId,
-		reason,
-		domains,
-		certParsed.NotAfter,
-		string(certAndPrivateKey.Certificate),
-		privateKeyEncrypted.KeyFingerprint,
-		privateKeyEncrypted.Ciphertext,
-		challengeType.String(),
-		ehevent.MetaSystemUser(time.Now()),
-	), nil
+	return jsonfile.Marshal(out, conf)
 }
 
-func newCertId() string {
-	return cryptorandombytes.Base64UrlWithoutLeadingDash(8)
+func basicCertificateDomains(domain string) []string {
+	return []string{"www." + domain, domain}
+}
+
+func subdomainCertificateDomains(domain string) []string {
+	return []string{domain}
+}
+
+func wildcardCertificateDomains(domain string) []string {
+	return []string{"*." + domain, domain}
+}
+
+func readTenantCtx() ehreader.TenantCtx {
+	client, err := ehreader.TenantCtxFrom(ehreader.ConfigFromEnv)
+	if err != nil {
+		panic(err)
+	}
+
+	return *client
 }
 
 func loadManagerPrivateKey() (*rsa.PrivateKey, error) {
@@ -381,25 +544,3 @@ func loadManagerPrivateKey() (*rsa.PrivateKey, error) {
 		return cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey(privKeyPem)
 	}
 }
-
-func decryptConfig(certs *certificatestore.Store) (*config, error) {
-	privKey, err := loadManagerPrivateKey()
-	if err != nil {
-		return nil, err
-	}
-
-	encryptedConf := certs.GetLatestEncryptedConfig()
-	if encryptedConf == nil {
-		return nil, errors.New("no config found")
-	}
-
-	plaintextJson, err := encryptedbox.New(
-		encryptedConf.ConfigEncryptionKeyFingerprint,
-		encryptedConf.ConfigCiphertext).DecryptNoFingerprint(privKey)
-	if err != nil {
-		return nil, err
-	}
-
-	conf := &config{}
-	return conf, jsonfile.Unmarshal(bytes.NewReader(plaintextJson), conf, true)
-}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/function61/gokit/jsonfile"
+	"gopkg.in/yaml.v2"
+)
+
+// --output. "" = command's default
+const (
+	outputTable = "table"
+	outputJson  = "json"
+	outputYaml  = "yaml"
+)
+
+// table is rendered by the caller (tables don't have a generic representation)
+func printStructured(out io.Writer, format string, data interface{}) error {
+	switch format {
+	case outputJson:
+		return jsonfile.Marshal(out, data)
+	case outputYaml:
+		return marshalYaml(out, data)
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+func validateOutputFormat(format string) error {
+	switch format {
+	case "", outputTable, outputJson, outputYaml:
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format: %s (expecting json|yaml|table)", format)
+	}
+}
+
+// goes through JSON so YAML has the same schema (field names from JSON tags) and field order
+func marshalYaml(out io.Writer, data interface{}) error {
+	asJson, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	// JSON is YAML. MapSlice keeps the field order
+	var doc interface{} = &yaml.MapSlice{}
+	if bytes.HasPrefix(asJson, []byte("[")) {
+		doc = &[]yaml.MapSlice{}
+	}
+
+	if err := yaml.Unmarshal(asJson, doc); err != nil {
+		return err
+	}
+
+	asYaml, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(asYaml)
+	return err
+}
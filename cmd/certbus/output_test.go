@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/function61/gokit/assert"
+)
+
+func TestPrintStructuredYaml(t *testing.T) {
+	out := &bytes.Buffer{}
+	assert.Ok(t, printStructured(out, outputYaml, []certIdOutput{{"abc"}}))
+	assert.EqualString(t, out.String(), "- id: abc\n")
+
+	// same schema as JSON, in the same field order
+	out.Reset()
+	assert.Ok(t, printStructured(out, outputYaml, certChain{Id: "abc", Domains: []string{"example.com"}}))
+	assert.EqualString(t, out.String(), `id: abc
+domains:
+- example.com
+chain: null
+root: ""
+preferred_chain: ""
+`)
+}
+
+func TestValidateOutputFormat(t *testing.T) {
+	assert.Ok(t, validateOutputFormat(""))
+	assert.Ok(t, validateOutputFormat("yaml"))
+	assert.EqualString(t, validateOutputFormat("xml").Error(), "unsupported output format: xml (expecting json|yaml|table)")
+}
@@ -9,6 +9,13 @@ require (
 	github.com/function61/gokit v0.0.0-20200608105953-12235c68c38b
 	github.com/function61/lambda-alertmanager v1.0.2-0.20200608093215-f2ba13863946
 	github.com/go-acme/lego/v4 v4.2.0
+	github.com/miekg/dns v1.1.31
+	github.com/prometheus/client_golang v1.7.1
 	github.com/scylladb/termtables v1.0.0
 	github.com/spf13/cobra v0.0.6
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	gopkg.in/square/go-jose.v2 v2.5.1
+	gopkg.in/yaml.v2 v2.4.0
 )
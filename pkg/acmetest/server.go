@@ -0,0 +1,790 @@
+// In-process ACME server (the subset of RFC 8555 that lego uses), so issuance and renewal can be
+// tested end-to-end without network access. think of it as a tiny Pebble
+package acmetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	errNS       = "urn:ietf:params:acme:error:"
+	statusReady = "ready" // lego doesn't define this one
+)
+
+// how the server validates challenges. nil = challenge type not offered
+type Validators struct {
+	// returns what "http://<domain>/.well-known/acme-challenge/<token>" answers
+	HTTP01 func(domain string, token string) (string, error)
+	// returns TXT records of the FQDN (e.g. "_acme-challenge.example.com.")
+	DNS01 func(fqdn string) ([]string, error)
+}
+
+type Server struct {
+	URL        string        // directory URL. give this to your ACME client
+	Validity   time.Duration // of issued certs
+	validators Validators
+	ca         *x509.Certificate
+	caKey      crypto.Signer
+	httpServer *httptest.Server
+	accounts   map[string]*account // keyed by account key's thumbprint
+	orders     map[string]*order
+	authzs     map[string]*authz
+	challenges map[string]*chal
+	certs      map[string][]byte
+	nonces     map[string]bool
+	issued     int
+	nextId     int
+	mu         sync.Mutex
+}
+
+type account struct {
+	url        string
+	key        *jose.JSONWebKey
+	thumbprint string
+	contact    []string
+}
+
+type order struct {
+	id      string
+	account *account
+	acme.Order
+}
+
+type authz struct {
+	id      string
+	account *account
+	acme.Authorization
+}
+
+type chal struct {
+	authz *authz
+	acme.Challenge
+}
+
+// remember to Close()
+func NewServer(validators Validators) (*Server, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acmetest root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Validity:   90 * 24 * time.Hour, // same as LetsEncrypt
+		validators: validators,
+		ca:         ca,
+		caKey:      caKey,
+		accounts:   map[string]*account{},
+		orders:     map[string]*order{},
+		authzs:     map[string]*authz{},
+		challenges: map[string]*chal{},
+		certs:      map[string][]byte{},
+		nonces:     map[string]bool{},
+	}
+
+	s.httpServer = httptest.NewServer(s.routes())
+	s.URL = s.httpServer.URL + "/directory"
+
+	return s, nil
+}
+
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// trust this to verify the issued certs
+func (s *Server) Roots() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.ca)
+	return roots
+}
+
+// how many certs the server has issued
+func (s *Server) Issued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.issued
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, acme.Directory{
+			NewNonceURL:   s.url("/new-nonce"),
+			NewAccountURL: s.url("/new-account"),
+			NewOrderURL:   s.url("/new-order"),
+			RevokeCertURL: s.url("/revoke-cert"),
+			KeyChangeURL:  s.url("/key-change"),
+		})
+	})
+
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		s.addNonce(w)
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	mux.HandleFunc("/new-account", s.signed(true, s.newAccount))
+	mux.HandleFunc("/account/", s.signed(false, s.getAccount))
+	mux.HandleFunc("/new-order", s.signed(false, s.newOrder))
+	mux.HandleFunc("/order/", s.signed(false, s.getOrder))
+	mux.HandleFunc("/authz/", s.signed(false, s.getAuthz))
+	mux.HandleFunc("/chall/", s.signed(false, s.challenge))
+	mux.HandleFunc("/finalize/", s.signed(false, s.finalize))
+	mux.HandleFunc("/cert/", s.signed(false, s.getCert))
+
+	return mux
+}
+
+type signedHandler func(w http.ResponseWriter, r *http.Request, acct *account, payload []byte) *acme.ProblemDetails
+
+// verifies JWS (signature, nonce, URL) and resolves the account. newAccount = request carries
+// the public key (JWK) instead of the account URL (KID)
+func (s *Server) signed(newAccount bool, handler signedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.addNonce(w)
+
+		if problem := func() *acme.ProblemDetails {
+			if r.Method != http.MethodPost {
+				return malformed("expecting POST")
+			}
+
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return malformed(err.Error())
+			}
+
+			jws, err := jose.ParseSigned(string(body))
+			if err != nil {
+				return malformed(err.Error())
+			}
+
+			if len(jws.Signatures) != 1 {
+				return malformed("expecting exactly one signature")
+			}
+
+			header := jws.Signatures[0].Protected
+
+			if !s.consumeNonce(header.Nonce) {
+				return &acme.ProblemDetails{
+					Type:       errNS + "badNonce",
+					Detail:     "unknown nonce: " + header.Nonce,
+					HTTPStatus: http.StatusBadRequest,
+				}
+			}
+
+			if url, _ := header.ExtraHeaders["url"].(string); url != s.url(r.URL.Path) {
+				return unauthorized(fmt.Sprintf("JWS url %s does not match request's", url))
+			}
+
+			var acct *account
+			var key *jose.JSONWebKey
+			if newAccount {
+				if header.JSONWebKey == nil {
+					return malformed("expecting JWK")
+				}
+
+				key = header.JSONWebKey
+			} else {
+				acct = s.accountByUrl(header.KeyID)
+				if acct == nil {
+					return &acme.ProblemDetails{
+						Type:       errNS + "accountDoesNotExist",
+						Detail:     "unknown account: " + header.KeyID,
+						HTTPStatus: http.StatusBadRequest,
+					}
+				}
+
+				key = acct.key
+			}
+
+			payload, err := jws.Verify(key)
+			if err != nil {
+				return unauthorized(err.Error())
+			}
+
+			if newAccount {
+				acct = &account{key: key}
+			}
+
+			return handler(w, r, acct, payload)
+		}(); problem != nil {
+			writeJSON(w, problem.HTTPStatus, problem)
+		}
+	}
+}
+
+func (s *Server) newAccount(w http.ResponseWriter, r *http.Request, candidate *account, payload []byte) *acme.ProblemDetails {
+	req := acme.Account{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return malformed(err.Error())
+	}
+
+	thumbprint, err := keyThumbprint(candidate.key)
+	if err != nil {
+		return malformed(err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := http.StatusOK
+
+	acct, found := s.accounts[thumbprint]
+	if !found {
+		if req.OnlyReturnExisting {
+			return &acme.ProblemDetails{
+				Type:       errNS + "accountDoesNotExist",
+				Detail:     "no account for the key",
+				HTTPStatus: http.StatusBadRequest,
+			}
+		}
+
+		acct = candidate
+		acct.url = s.url("/account/" + s.newId())
+		acct.thumbprint = thumbprint
+		acct.contact = req.Contact
+
+		s.accounts[thumbprint] = acct
+
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Location", acct.url)
+	writeJSON(w, status, accountJSON(acct))
+	return nil
+}
+
+func (s *Server) getAccount(w http.ResponseWriter, r *http.Request, acct *account, _ []byte) *acme.ProblemDetails {
+	if s.url(r.URL.Path) != acct.url {
+		return unauthorized("not your account")
+	}
+
+	writeJSON(w, http.StatusOK, accountJSON(acct))
+	return nil
+}
+
+func (s *Server) newOrder(w http.ResponseWriter, r *http.Request, acct *account, payload []byte) *acme.ProblemDetails {
+	req := acme.Order{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return malformed(err.Error())
+	}
+
+	if len(req.Identifiers) == 0 {
+		return malformed("no identifiers")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := &order{
+		id:      s.newId(),
+		account: acct,
+		Order: acme.Order{
+			Status:      acme.StatusPending,
+			Expires:     time.Now().Add(time.Hour).Format(time.RFC3339),
+			Identifiers: req.Identifiers,
+		},
+	}
+	o.Finalize = s.url("/finalize/" + o.id)
+
+	for _, identifier := range req.Identifiers {
+		if identifier.Type != "dns" {
+			return &acme.ProblemDetails{
+				Type:       errNS + "unsupportedIdentifier",
+				Detail:     identifier.Type,
+				HTTPStatus: http.StatusBadRequest,
+			}
+		}
+
+		o.Authorizations = append(o.Authorizations, s.newAuthz(acct, identifier.Value))
+	}
+
+	s.orders[o.id] = o
+
+	w.Header().Set("Location", s.url("/order/"+o.id))
+	writeJSON(w, http.StatusCreated, o.Order)
+	return nil
+}
+
+// returns authz URL
+func (s *Server) newAuthz(acct *account, domain string) string {
+	a := &authz{
+		id:      s.newId(),
+		account: acct,
+		Authorization: acme.Authorization{
+			Status:     acme.StatusPending,
+			Expires:    time.Now().Add(time.Hour),
+			Identifier: acme.Identifier{Type: "dns", Value: strings.TrimPrefix(domain, "*.")},
+			Wildcard:   strings.HasPrefix(domain, "*."),
+		},
+	}
+
+	offer := func(challengeType challenge.Type) {
+		id := s.newId()
+
+		c := &chal{
+			authz: a,
+			Challenge: acme.Challenge{
+				Type:   challengeType.String(),
+				URL:    s.url("/chall/" + id),
+				Status: acme.StatusPending,
+				Token:  s.newToken(),
+			},
+		}
+
+		s.challenges[id] = c
+	}
+
+	// wildcards can only be validated via DNS
+	if s.validators.HTTP01 != nil && !a.Wildcard {
+		offer(challenge.HTTP01)
+	}
+
+	if s.validators.DNS01 != nil {
+		offer(challenge.DNS01)
+	}
+
+	s.authzs[a.id] = a
+
+	return s.url("/authz/" + a.id)
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request, acct *account, _ []byte) *acme.ProblemDetails {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, found := s.orders[strings.TrimPrefix(r.URL.Path, "/order/")]
+	if !found || o.account != acct {
+		return notFound()
+	}
+
+	writeJSON(w, http.StatusOK, o.Order)
+	return nil
+}
+
+func (s *Server) getAuthz(w http.ResponseWriter, r *http.Request, acct *account, _ []byte) *acme.ProblemDetails {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, found := s.authzs[strings.TrimPrefix(r.URL.Path, "/authz/")]
+	if !found || a.account != acct {
+		return notFound()
+	}
+
+	writeJSON(w, http.StatusOK, s.authzJSON(a))
+	return nil
+}
+
+// POST-as-GET (empty payload) reads the challenge, "{}" asks us to validate it
+func (s *Server) challenge(w http.ResponseWriter, r *http.Request, acct *account, payload []byte) *acme.ProblemDetails {
+	s.mu.Lock()
+	c, found := s.challenges[strings.TrimPrefix(r.URL.Path, "/chall/")]
+	if !found || c.authz.account != acct {
+		s.mu.Unlock()
+		return notFound()
+	}
+
+	validate := len(payload) > 0 && c.Status == acme.StatusPending
+	domain := c.authz.Identifier.Value
+	challengeType := c.Type
+	keyAuth := c.Token + "." + acct.thumbprint
+	s.mu.Unlock()
+
+	// validating doesn't hold the lock, since validator can take its time
+	var validationErr error
+	if validate {
+		validationErr = s.validate(challenge.Type(challengeType), domain, c.Token, keyAuth)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if validate {
+		if validationErr != nil {
+			c.Status = acme.StatusInvalid
+			c.Error = &acme.ProblemDetails{
+				Type:       errNS + "unauthorized",
+				Detail:     validationErr.Error(),
+				HTTPStatus: http.StatusForbidden,
+			}
+			c.authz.Status = acme.StatusInvalid
+		} else {
+			c.Status = acme.StatusValid
+			c.Validated = time.Now()
+			c.authz.Status = acme.StatusValid
+		}
+
+		s.updateOrderStatuses()
+	}
+
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="up"`, s.url("/authz/"+c.authz.id)))
+	writeJSON(w, http.StatusOK, c.Challenge)
+	return nil
+}
+
+func (s *Server) validate(challengeType challenge.Type, domain string, token string, keyAuth string) error {
+	switch challengeType {
+	case challenge.HTTP01:
+		served, err := s.validators.HTTP01(domain, token)
+		if err != nil {
+			return fmt.Errorf("HTTP-01: %w", err)
+		}
+
+		if strings.TrimSpace(served) != keyAuth {
+			return fmt.Errorf("HTTP-01: %s served wrong key authorization: %s", domain, served)
+		}
+
+		return nil
+	case challenge.DNS01:
+		fqdn := dns01.ToFqdn("_acme-challenge." + domain)
+
+		txts, err := s.validators.DNS01(fqdn)
+		if err != nil {
+			return fmt.Errorf("DNS-01: %w", err)
+		}
+
+		expected := dns01Value(keyAuth)
+		for _, txt := range txts {
+			if txt == expected {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("DNS-01: no matching TXT record at %s (found %v)", fqdn, txts)
+	default:
+		return fmt.Errorf("unsupported challenge: %s", challengeType)
+	}
+}
+
+func (s *Server) finalize(w http.ResponseWriter, r *http.Request, acct *account, payload []byte) *acme.ProblemDetails {
+	req := acme.CSRMessage{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return malformed(err.Error())
+	}
+
+	csrDer, err := base64.RawURLEncoding.DecodeString(req.Csr)
+	if err != nil {
+		return malformed(err.Error())
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return badCSR(err.Error())
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return badCSR(err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, found := s.orders[strings.TrimPrefix(r.URL.Path, "/finalize/")]
+	if !found || o.account != acct {
+		return notFound()
+	}
+
+	if o.Status != statusReady {
+		return &acme.ProblemDetails{
+			Type:       errNS + "orderNotReady",
+			Detail:     "order status: " + o.Status,
+			HTTPStatus: http.StatusForbidden,
+		}
+	}
+
+	orderDomains := []string{}
+	for _, identifier := range o.Identifiers {
+		orderDomains = append(orderDomains, identifier.Value)
+	}
+
+	csrDomains := append([]string{}, csr.DNSNames...)
+	if csr.Subject.CommonName != "" && !contains(csrDomains, csr.Subject.CommonName) {
+		csrDomains = append(csrDomains, csr.Subject.CommonName)
+	}
+
+	if !sameDomains(orderDomains, csrDomains) {
+		return badCSR(fmt.Sprintf("CSR names %v don't match order's %v", csrDomains, orderDomains))
+	}
+
+	certPem, err := s.issue(csr)
+	if err != nil {
+		return &acme.ProblemDetails{
+			Type:       errNS + "serverInternal",
+			Detail:     err.Error(),
+			HTTPStatus: http.StatusInternalServerError,
+		}
+	}
+
+	certId := s.newId()
+	s.certs[certId] = certPem
+
+	o.Status = acme.StatusValid
+	o.Certificate = s.url("/cert/" + certId)
+
+	w.Header().Set("Location", s.url("/order/"+o.id))
+	writeJSON(w, http.StatusOK, o.Order)
+	return nil
+}
+
+func (s *Server) getCert(w http.ResponseWriter, r *http.Request, acct *account, _ []byte) *acme.ProblemDetails {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	certPem, found := s.certs[strings.TrimPrefix(r.URL.Path, "/cert/")]
+	if !found {
+		return notFound()
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	_, _ = w.Write(certPem)
+	return nil
+}
+
+// returns PEM bundle (leaf + our CA)
+func (s *Server) issue(csr *x509.CertificateRequest) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames := append([]string{}, csr.DNSNames...)
+	if len(dnsNames) == 0 {
+		dnsNames = []string{csr.Subject.CommonName}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour), // accommodate clock skew
+		NotAfter:     time.Now().Add(s.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, s.ca, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.issued++
+
+	return append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})...), nil
+}
+
+// order becomes "ready" (for finalization) once all its authorizations are valid
+func (s *Server) updateOrderStatuses() {
+	for _, o := range s.orders {
+		if o.Status != acme.StatusPending {
+			continue
+		}
+
+		allValid := true
+		for _, authzUrl := range o.Authorizations {
+			switch s.authzs[strings.TrimPrefix(authzUrl, s.url("/authz/"))].Status {
+			case acme.StatusValid:
+			case acme.StatusInvalid:
+				o.Status = acme.StatusInvalid
+				allValid = false
+			default:
+				allValid = false
+			}
+		}
+
+		if allValid {
+			o.Status = statusReady
+		}
+	}
+}
+
+func (s *Server) authzJSON(a *authz) acme.Authorization {
+	rendered := a.Authorization
+	rendered.Challenges = []acme.Challenge{}
+
+	for _, c := range s.challenges {
+		if c.authz == a {
+			rendered.Challenges = append(rendered.Challenges, c.Challenge)
+		}
+	}
+
+	// map iteration order is random
+	sort.Slice(rendered.Challenges, func(i, j int) bool {
+		return rendered.Challenges[i].Type < rendered.Challenges[j].Type
+	})
+
+	return rendered
+}
+
+func (s *Server) accountByUrl(url string) *account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, acct := range s.accounts {
+		if acct.url == url {
+			return acct
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) addNonce(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nonce := s.newToken()
+	s.nonces[nonce] = true
+
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (s *Server) consumeNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	valid := s.nonces[nonce]
+	delete(s.nonces, nonce)
+	return valid
+}
+
+func (s *Server) url(path string) string {
+	return s.httpServer.URL + path
+}
+
+func (s *Server) newId() string {
+	s.nextId++
+	return fmt.Sprintf("%d", s.nextId)
+}
+
+func (s *Server) newToken() string {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random)
+}
+
+func accountJSON(acct *account) acme.Account {
+	return acme.Account{
+		Status:  acme.StatusValid,
+		Contact: acct.contact,
+	}
+}
+
+func keyThumbprint(key *jose.JSONWebKey) (string, error) {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// https://tools.ietf.org/html/rfc8555#section-8.4
+func dns01Value(keyAuth string) string {
+	digest := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+func sameDomains(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, domain := range a {
+		if !contains(b, domain) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, item := range haystack {
+		if strings.EqualFold(item, needle) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	contentType := "application/json"
+	if _, isProblem := body.(*acme.ProblemDetails); isProblem {
+		contentType = "application/problem+json"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		panic(err)
+	}
+}
+
+func malformed(detail string) *acme.ProblemDetails {
+	return &acme.ProblemDetails{Type: errNS + "malformed", Detail: detail, HTTPStatus: http.StatusBadRequest}
+}
+
+func unauthorized(detail string) *acme.ProblemDetails {
+	return &acme.ProblemDetails{Type: errNS + "unauthorized", Detail: detail, HTTPStatus: http.StatusForbidden}
+}
+
+func badCSR(detail string) *acme.ProblemDetails {
+	return &acme.ProblemDetails{Type: errNS + "badCSR", Detail: detail, HTTPStatus: http.StatusBadRequest}
+}
+
+func notFound() *acme.ProblemDetails {
+	return &acme.ProblemDetails{Type: errNS + "malformed", Detail: "not found", HTTPStatus: http.StatusNotFound}
+}
@@ -0,0 +1,34 @@
+package cbdomain
+
+import (
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/ehevent"
+)
+
+// who is making a change, recorded as user id in event meta so changes can be audited.
+// "lambda:<function name>" when running in Lambda, otherwise "<process>:<user>@<host>"
+func Actor(process string) string {
+	if functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); functionName != "" {
+		return "lambda:" + functionName
+	}
+
+	username := "unknown"
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return process + ":" + username + "@" + hostname
+}
+
+// event meta for current time, with actor (see Actor()) as user
+func MetaActor(process string) ehevent.EventMeta {
+	return ehevent.Meta(time.Now(), Actor(process))
+}
@@ -8,9 +8,17 @@ import (
 )
 
 var Types = ehevent.Allocators{
-	"CertificateObtained": func() ehevent.Event { return &CertificateObtained{} },
-	"CertificateRemoved":  func() ehevent.Event { return &CertificateRemoved{} },
-	"ConfigUpdated":       func() ehevent.Event { return &ConfigUpdated{} },
+	"CertificateObtained":      func() ehevent.Event { return &CertificateObtained{} },
+	"CertificateRemoved":       func() ehevent.Event { return &CertificateRemoved{} },
+	"CertificateActivated":     func() ehevent.Event { return &CertificateActivated{} },
+	"CertificateRolledBack":    func() ehevent.Event { return &CertificateRolledBack{} },
+	"ConfigUpdated":            func() ehevent.Event { return &ConfigUpdated{} },
+	"CertificateRequested":     func() ehevent.Event { return &CertificateRequested{} },
+	"CertificateRequestFailed": func() ehevent.Event { return &CertificateRequestFailed{} },
+	"ChallengePresented":       func() ehevent.Event { return &ChallengePresented{} },
+	"ChallengeCleanedUp":       func() ehevent.Event { return &ChallengeCleanedUp{} },
+	"RenewalLeaseAcquired":     func() ehevent.Event { return &RenewalLeaseAcquired{} },
+	"RenewalLeaseReleased":     func() ehevent.Event { return &RenewalLeaseReleased{} },
 }
 
 // ------
@@ -24,7 +32,12 @@ type CertificateObtained struct {
 	CertPemBundle            string
 	PrivateKeyDekFingerprint string // identity of the DEK that encrypted this private key
 	PrivateKeyCiphertext     []byte
-	ChallengeType            string // "http-01" | "dns-01" | ...
+	ChallengeType            string    // "http-01" | "dns-01" | ...
+	DNS01DelegatedTo         string    // zone that _acme-challenge is CNAME'd to (if DNS-01 is delegated)
+	PreferredChain           string    // per-cert override of config's preferred chain (issuer CN of chain's top cert)
+	CSR                      string    // PEM. if set, private key is not in CertBus (PrivateKey* are empty)
+	Staged                   bool      // served only by canaries until CertificateActivated
+	ActivateAt               time.Time // (staged only) manager activates automatically after this. zero = manual
 }
 
 func (e *CertificateObtained) MetaType() string         { return "CertificateObtained" }
@@ -39,6 +52,11 @@ func NewCertificateObtained(
 	privateKeyDekFingerprint string,
 	privateKeyCiphertext []byte,
 	challengeType string,
+	dns01DelegatedTo string,
+	preferredChain string,
+	csr string,
+	staged bool,
+	activateAt time.Time,
 	meta ehevent.EventMeta,
 ) *CertificateObtained {
 	return &CertificateObtained{
@@ -51,6 +69,11 @@ func NewCertificateObtained(
 		PrivateKeyDekFingerprint: privateKeyDekFingerprint,
 		PrivateKeyCiphertext:     privateKeyCiphertext,
 		ChallengeType:            challengeType,
+		DNS01DelegatedTo:         dns01DelegatedTo,
+		PreferredChain:           preferredChain,
+		CSR:                      csr,
+		Staged:                   staged,
+		ActivateAt:               activateAt,
 	}
 }
 
@@ -76,6 +99,69 @@ func NewCertificateRemoved(
 
 // ------
 
+// staged cert (see CertificateObtained.Staged) takes effect
+type CertificateActivated struct {
+	meta ehevent.EventMeta
+	Id   string
+}
+
+func (e *CertificateActivated) MetaType() string         { return "CertificateActivated" }
+func (e *CertificateActivated) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewCertificateActivated(
+	id string,
+	meta ehevent.EventMeta,
+) *CertificateActivated {
+	return &CertificateActivated{
+		meta: meta,
+		Id:   id,
+	}
+}
+
+// ------
+
+// previously obtained cert is put back in place of the current one (not a new issuance)
+type CertificateRolledBack struct {
+	meta                     ehevent.EventMeta
+	Id                       string
+	Domains                  []string
+	Expires                  time.Time
+	CertPemBundle            string
+	PrivateKeyDekFingerprint string
+	PrivateKeyCiphertext     []byte
+	ChallengeType            string
+	DNS01DelegatedTo         string
+}
+
+func (e *CertificateRolledBack) MetaType() string         { return "CertificateRolledBack" }
+func (e *CertificateRolledBack) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewCertificateRolledBack(
+	id string,
+	domains []string,
+	expires time.Time,
+	certPemBundle string,
+	privateKeyDekFingerprint string,
+	privateKeyCiphertext []byte,
+	challengeType string,
+	dns01DelegatedTo string,
+	meta ehevent.EventMeta,
+) *CertificateRolledBack {
+	return &CertificateRolledBack{
+		meta:                     meta,
+		Id:                       id,
+		Domains:                  domains,
+		Expires:                  expires,
+		CertPemBundle:            certPemBundle,
+		PrivateKeyDekFingerprint: privateKeyDekFingerprint,
+		PrivateKeyCiphertext:     privateKeyCiphertext,
+		ChallengeType:            challengeType,
+		DNS01DelegatedTo:         dns01DelegatedTo,
+	}
+}
+
+// ------
+
 type ConfigUpdated struct {
 	meta                           ehevent.EventMeta
 	ConfigEncryptionKeyFingerprint string
@@ -96,3 +182,153 @@ func NewConfigUpdated(
 		ConfigCiphertext:               configCiphertext,
 	}
 }
+
+// ------
+
+// loadbalancer saw a hostname it didn't have a cert for, and asks the manager to issue one
+type CertificateRequested struct {
+	meta     ehevent.EventMeta
+	Hostname string
+}
+
+func (e *CertificateRequested) MetaType() string         { return "CertificateRequested" }
+func (e *CertificateRequested) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewCertificateRequested(
+	hostname string,
+	meta ehevent.EventMeta,
+) *CertificateRequested {
+	return &CertificateRequested{
+		meta:     meta,
+		Hostname: hostname,
+	}
+}
+
+// ------
+
+// manager gave up on a CertificateRequested (success is signalled by CertificateObtained)
+type CertificateRequestFailed struct {
+	meta     ehevent.EventMeta
+	Hostname string
+	Error    string
+}
+
+func (e *CertificateRequestFailed) MetaType() string         { return "CertificateRequestFailed" }
+func (e *CertificateRequestFailed) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewCertificateRequestFailed(
+	hostname string,
+	errorMessage string,
+	meta ehevent.EventMeta,
+) *CertificateRequestFailed {
+	return &CertificateRequestFailed{
+		meta:     meta,
+		Hostname: hostname,
+		Error:    errorMessage,
+	}
+}
+
+// ------
+
+// ACME challenge that loadbalancers should answer (instead of e.g. an S3 bucket doing it)
+type ChallengePresented struct {
+	meta          ehevent.EventMeta
+	ChallengeType string // "http-01" | ...
+	Domain        string
+	Token         string
+	KeyAuth       string // not secret: the ACME server sends it to anyone asking for the token
+}
+
+func (e *ChallengePresented) MetaType() string         { return "ChallengePresented" }
+func (e *ChallengePresented) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewChallengePresented(
+	challengeType string,
+	domain string,
+	token string,
+	keyAuth string,
+	meta ehevent.EventMeta,
+) *ChallengePresented {
+	return &ChallengePresented{
+		meta:          meta,
+		ChallengeType: challengeType,
+		Domain:        domain,
+		Token:         token,
+		KeyAuth:       keyAuth,
+	}
+}
+
+// ------
+
+type ChallengeCleanedUp struct {
+	meta  ehevent.EventMeta
+	Token string
+}
+
+func (e *ChallengeCleanedUp) MetaType() string         { return "ChallengeCleanedUp" }
+func (e *ChallengeCleanedUp) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewChallengeCleanedUp(
+	token string,
+	meta ehevent.EventMeta,
+) *ChallengeCleanedUp {
+	return &ChallengeCleanedUp{
+		meta:  meta,
+		Token: token,
+	}
+}
+
+// ------
+
+// manager (Holder) is renewing the cert. other managers keep off until the lease expires, is
+// released or the cert gets obtained
+type RenewalLeaseAcquired struct {
+	meta    ehevent.EventMeta
+	Id      string
+	Holder  string // identifies the manager instance
+	Expires time.Time
+}
+
+func (e *RenewalLeaseAcquired) MetaType() string         { return "RenewalLeaseAcquired" }
+func (e *RenewalLeaseAcquired) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewRenewalLeaseAcquired(
+	id string,
+	holder string,
+	expires time.Time,
+	meta ehevent.EventMeta,
+) *RenewalLeaseAcquired {
+	return &RenewalLeaseAcquired{
+		meta:    meta,
+		Id:      id,
+		Holder:  holder,
+		Expires: expires,
+	}
+}
+
+// ------
+
+// renewal didn't result in a cert (success is signalled by CertificateObtained)
+type RenewalLeaseReleased struct {
+	meta   ehevent.EventMeta
+	Id     string
+	Holder string
+	Error  string // why the renewal failed
+}
+
+func (e *RenewalLeaseReleased) MetaType() string         { return "RenewalLeaseReleased" }
+func (e *RenewalLeaseReleased) Meta() *ehevent.EventMeta { return &e.meta }
+
+func NewRenewalLeaseReleased(
+	id string,
+	holder string,
+	renewalError string,
+	meta ehevent.EventMeta,
+) *RenewalLeaseReleased {
+	return &RenewalLeaseReleased{
+		meta:   meta,
+		Id:     id,
+		Holder: holder,
+		Error:  renewalError,
+	}
+}
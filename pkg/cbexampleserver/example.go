@@ -18,7 +18,9 @@ import (
 )
 
 func Entrypoint() *cobra.Command {
-	return &cobra.Command{
+	canary := false
+
+	cmd := &cobra.Command{
 		Use:   "example-server",
 		Short: "Start demo HTTPS server that demos CertBus integration",
 		Args:  cobra.NoArgs,
@@ -27,12 +29,17 @@ func Entrypoint() *cobra.Command {
 
 			osutil.ExitIfError(exampleServer(
 				osutil.CancelOnInterruptOrTerminate(rootLogger),
+				canary,
 				rootLogger))
 		},
 	}
+
+	cmd.Flags().BoolVarP(&canary, "canary", "", canary, "Serve staged certs (verify them before activation)")
+
+	return cmd
 }
 
-func exampleServer(ctx context.Context, logger *log.Logger) error {
+func exampleServer(ctx context.Context, canary bool, logger *log.Logger) error {
 	// loadbalancer's CertBus private key for which the certificate private keys are encrypted
 	privateKey, err := ioutil.ReadFile("certbus-client.key")
 	if err != nil {
@@ -44,7 +51,12 @@ func exampleServer(ctx context.Context, logger *log.Logger) error {
 		return err
 	}
 
-	certBus, err := certbus.New(
+	newCertBus := certbus.New
+	if canary {
+		newCertBus = certbus.NewCanary
+	}
+
+	certBus, err := newCertBus(
 		ctx,
 		*tenantCtx,
 		string(privateKey),
@@ -57,6 +69,8 @@ func exampleServer(ctx context.Context, logger *log.Logger) error {
 	routes.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "greetings from %s\n", req.URL.Path)
 	})
+	// (optional) Prometheus metrics. in real life you'd probably serve these on an internal port
+	routes.Handle("/metrics", certBus.MetricsHandler())
 
 	srv := &http.Server{
 		Addr:    ":443",
@@ -65,6 +79,8 @@ func exampleServer(ctx context.Context, logger *log.Logger) error {
 			// this integrates CertBus into your server - certificates are fetched
 			// dynamically from CertBus's dynamically managed state
 			GetCertificate: certBus.GetCertificateAdapter(),
+			// (optional) answers TLS-ALPN-01 challenges
+			GetConfigForClient: certBus.GetConfigForClientAdapter(),
 		},
 	}
 
@@ -4,7 +4,9 @@ package certbus
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/function61/certbus/pkg/certificatestore"
@@ -16,7 +18,13 @@ type App struct {
 	Certs          *certificatestore.DecryptedStore
 	certsEncrypted *certificatestore.Store
 	reader         *ehreader.Reader
+	tenantCtx      ehreader.TenantCtx
+	missHandler    MissHandler
+	tlsAlpn01Certs *tlsAlpn01Certs
 	logl           *logex.Leveled
+	sniMisses      uint64    // handshakes we didn't have a cert for (before MissHandler)
+	lastSynced     time.Time // last successful LoadUntilRealtime (New() doesn't succeed without one)
+	statsMu        sync.Mutex
 }
 
 // returns certbus App (meant to be used alongside HTTP server)
@@ -25,29 +33,86 @@ func New(
 	tenantCtx ehreader.TenantCtx,
 	privateKeyPem string,
 	logger *log.Logger,
+) (*App, error) {
+	return newApp(ctx, tenantCtx, privateKeyPem, false, logger)
+}
+
+// same as New(), but serves staged certs (which are not yet served by other loadbalancers),
+// so you can verify a renewed cert before activating it everywhere
+func NewCanary(
+	ctx context.Context,
+	tenantCtx ehreader.TenantCtx,
+	privateKeyPem string,
+	logger *log.Logger,
+) (*App, error) {
+	return newApp(ctx, tenantCtx, privateKeyPem, true, logger)
+}
+
+func newApp(
+	ctx context.Context,
+	tenantCtx ehreader.TenantCtx,
+	privateKeyPem string,
+	canary bool,
+	logger *log.Logger,
 ) (*App, error) {
 	certsEncrypted, err := ResolveRealtimeState(ctx, tenantCtx, logger)
 	if err != nil {
 		return nil, err
 	}
+	synced := time.Now() // initial sync
+
+	var certsFinder certificatestore.VersionedByHostnameFinder = certsEncrypted
+	if canary {
+		certsFinder = certificatestore.PreferStaged(certsEncrypted)
+	}
 
-	certsDecrypted, err := certificatestore.NewDecryptedStore(certsEncrypted, privateKeyPem)
+	certsDecrypted, err := certificatestore.NewDecryptedStore(certsFinder, privateKeyPem)
 	if err != nil {
 		return nil, err
 	}
 
 	// FIXME: a reader is also made inside resolveRealtimeState()
 	return &App{
-		certsDecrypted,
-		certsEncrypted,
-		ehreader.New(certsEncrypted, tenantCtx.Client, logger),
-		logex.Levels(logger),
+		Certs:          certsDecrypted,
+		certsEncrypted: certsEncrypted,
+		reader:         ehreader.New(certsEncrypted, tenantCtx.Client, logger),
+		tenantCtx:      tenantCtx,
+		tlsAlpn01Certs: &tlsAlpn01Certs{byToken: map[string]*tls.Certificate{}},
+		logl:           logex.Levels(logger),
+		lastSynced:     synced,
 	}, nil
 }
 
+// set before you start serving. see MissHandler for details
+func (c *App) SetMissHandler(missHandler MissHandler) {
+	c.missHandler = missHandler
+}
+
+// set before you start serving. needed only if you serve certs issued from your CSR
+// (= CertBus doesn't have their private key)
+func (c *App) SetKeyLocator(keyLocator certificatestore.KeyLocator) {
+	c.Certs.SetKeyLocator(keyLocator)
+}
+
+// set before you start serving. needed only if your CA is not in system roots (e.g. internal ACME CA)
+func (c *App) SetRoots(roots *x509.CertPool) {
+	c.Certs.SetRoots(roots)
+}
+
 func (c *App) GetCertificateAdapter() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		return certificatestore.DecryptedByHostnameSupportingWildcard(hello.ServerName, c.Certs)
+		cert, err := certificatestore.DecryptedByHostnameSupportingWildcard(hello.ServerName, c.Certs)
+		if cert == nil && err == nil {
+			c.statsMu.Lock()
+			c.sniMisses++
+			c.statsMu.Unlock()
+		}
+
+		if cert != nil || err != nil || c.missHandler == nil {
+			return cert, err
+		}
+
+		return c.missHandler(hello)
 	}
 }
 
@@ -64,6 +129,10 @@ func (c *App) Synchronizer(ctx context.Context) error {
 
 			if err := c.reader.LoadUntilRealtime(ctx); err != nil {
 				c.logl.Error.Printf("LoadUntilRealtime: %v", err)
+			} else {
+				c.statsMu.Lock()
+				c.lastSynced = time.Now()
+				c.statsMu.Unlock()
 			}
 		}
 	}
@@ -0,0 +1,40 @@
+package certbus
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/eventhorizon/pkg/ehreader/ehreadertest"
+	"github.com/function61/gokit/assert"
+)
+
+var (
+	testTenant = ehreader.TenantId("1")
+	testStream = testTenant.Stream(certificatestore.Stream)
+	t0         = time.Date(2020, 1, 31, 16, 54, 0, 0, time.UTC)
+)
+
+// App (without decrypted store) backed by in-memory event log that initially has given events
+func testApp(t *testing.T, events ...ehevent.Event) (*App, *ehreadertest.EventLog) {
+	t.Helper()
+
+	eventLog := ehreadertest.NewEventLog()
+	eventLog.AppendE(testStream, events...)
+
+	tenantCtx := *ehreader.NewTenantCtx(testTenant, eventLog)
+
+	certs, err := ResolveRealtimeState(context.Background(), tenantCtx, nil)
+	assert.Ok(t, err)
+
+	return &App{
+		certsEncrypted: certs,
+		reader:         ehreader.New(certs, eventLog, nil),
+		tenantCtx:      tenantCtx,
+		tlsAlpn01Certs: &tlsAlpn01Certs{byToken: map[string]*tls.Certificate{}},
+	}, eventLog
+}
@@ -0,0 +1,86 @@
+package certbus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// decides what to do when we don't have a cert for the requested hostname (or the client
+// didn't send SNI at all). return nil cert (and nil error) to fail the handshake.
+// good place for metrics or requesting the manager to issue a cert on-demand.
+type MissHandler func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// serves the given managed cert for all misses. useful if you have one "main" cert that most
+// clients without SNI are expected to want.
+func (c *App) FallbackToManagedCert(certId string) MissHandler {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		managedCert := c.certsEncrypted.ById(certId)
+		if managedCert == nil {
+			return nil, fmt.Errorf("fallback cert not found: %s", certId)
+		}
+
+		// lookup via the decrypted store so we get caching & validation
+		return c.Certs.ByHostname(managedCert.Domains[0])
+	}
+}
+
+// serves a self-signed cert (generated on first use) for all misses. clients will not trust
+// it, but at least they get a TLS-level error that is easier to debug than a handshake failure.
+func SelfSignedFallback() MissHandler {
+	var cert *tls.Certificate
+	var certErr error
+	var once sync.Once
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		once.Do(func() {
+			cert, certErr = makeSelfSignedCert("CertBus fallback", time.Now())
+		})
+
+		return cert, certErr
+	}
+}
+
+func makeSelfSignedCert(commonName string, now time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-1 * time.Hour), // some leeway for clocks out of sync
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(certDer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{certDer},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
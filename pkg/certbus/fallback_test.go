@@ -0,0 +1,126 @@
+package certbus
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/certbus/pkg/encryptedbox"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/assert"
+)
+
+func TestFallbackToManagedCert(t *testing.T) {
+	now := time.Now() // decrypted store validates against wall clock
+
+	kek, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+
+	app, _ := testApp(t,
+		importedCertObtained(t, "mainCertId", []string{"example.com", "www.example.com"}, now, &kek.PublicKey),
+		importedCertObtained(t, "wildcardCertId", []string{"*.example.net", "example.net"}, now, &kek.PublicKey),
+		importedCertObtained(t, "expiredCertId", []string{"example.org"}, now.AddDate(-20, 0, 0), &kek.PublicKey))
+
+	app.Certs, err = certificatestore.NewDecryptedStore(app.certsEncrypted, string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(kek),
+	})))
+	assert.Ok(t, err)
+
+	fallback := func(certId string, serverName string) string {
+		cert, err := app.FallbackToManagedCert(certId)(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			return err.Error()
+		}
+
+		return cert.Leaf.DNSNames[0]
+	}
+
+	for _, tc := range []struct {
+		certId     string
+		serverName string
+		expected   string
+	}{
+		{"mainCertId", "unknown.com", "example.com"},
+		{"mainCertId", "", "example.com"}, // no SNI
+		{"wildcardCertId", "unknown.com", "*.example.net"},
+		{"expiredCertId", "unknown.com", "certificate expiredCertId failed validation: expired at " + now.AddDate(-10, 0, 0).UTC().Format(time.RFC3339)},
+		{"nonexistentCertId", "unknown.com", "fallback cert not found: nonexistentCertId"},
+	} {
+		assert.EqualString(t, fallback(tc.certId, tc.serverName), tc.expected)
+	}
+}
+
+func TestSelfSignedFallback(t *testing.T) {
+	fallback := SelfSignedFallback()
+
+	var first *tls.Certificate
+
+	for _, serverName := range []string{"example.com", "", "other.com"} {
+		cert, err := fallback(&tls.ClientHelloInfo{ServerName: serverName})
+		assert.Ok(t, err)
+
+		if first == nil {
+			first = cert
+		}
+
+		// generated only once
+		assert.Assert(t, cert == first)
+	}
+
+	assert.EqualString(t, first.Leaf.Subject.CommonName, "CertBus fallback")
+	assert.EqualString(t, first.Leaf.Issuer.CommonName, "CertBus fallback")
+	assert.Assert(t, first.Leaf.NotBefore.Before(time.Now()))
+	assert.Assert(t, first.Leaf.NotAfter.After(time.Now().AddDate(9, 0, 0)))
+}
+
+// imported, so the decrypted store doesn't verify the chain of our self-signed cert
+func importedCertObtained(
+	t *testing.T,
+	id string,
+	domains []string,
+	issuedAt time.Time,
+	kek *rsa.PublicKey,
+) ehevent.Event {
+	t.Helper()
+
+	cert, err := makeSelfSignedCert(domains[0], issuedAt)
+	assert.Ok(t, err)
+
+	// makeSelfSignedCert() doesn't do SANs
+	template := cert.Leaf
+	template.DNSNames = domains
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, cert.Leaf.PublicKey, cert.PrivateKey)
+	assert.Ok(t, err)
+
+	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.Ok(t, err)
+
+	privateKeyEncrypted, err := encryptedbox.Encrypt(pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyDer,
+	}), kek)
+	assert.Ok(t, err)
+
+	return cbdomain.NewCertificateObtained(
+		id,
+		"import",
+		domains,
+		template.NotAfter,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})),
+		privateKeyEncrypted.KeyFingerprint,
+		privateKeyEncrypted.Ciphertext,
+		certificatestore.ChallengeTypeImported,
+		"",
+		"",
+		"",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0))
+}
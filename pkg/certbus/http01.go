@@ -0,0 +1,42 @@
+package certbus
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/http01"
+)
+
+// answers ACME HTTP-01 challenges that the manager presented via the bus. mount this on your
+// port 80 server:
+//
+//	routes.Handle("/.well-known/acme-challenge/", certBus.HTTP01ChallengeHandler())
+func (c *App) HTTP01ChallengeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, http01.ChallengePath(""))
+		if token == r.URL.Path || token == "" { // prefix not found, or no token
+			http.NotFound(w, r)
+			return
+		}
+
+		chal := c.certsEncrypted.ChallengeByToken(token)
+		if chal == nil || chal.Type != challenge.HTTP01.String() || !strings.EqualFold(chal.Domain, hostWithoutPort(r.Host)) {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(chal.KeyAuth))
+	})
+}
+
+// "example.com:80" => "example.com"
+func hostWithoutPort(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+
+	return host
+}
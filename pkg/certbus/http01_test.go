@@ -0,0 +1,50 @@
+package certbus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/assert"
+)
+
+func TestHTTP01ChallengeHandler(t *testing.T) {
+	app, eventLog := testApp(t, cbdomain.NewChallengePresented(
+		"http-01",
+		"customer.com",
+		"dummyToken",
+		"dummyToken.thumbprint",
+		ehevent.MetaSystemUser(t0)))
+
+	handler := app.HTTP01ChallengeHandler()
+
+	get := func(url string) string {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, url, nil))
+
+		if resp.Code != http.StatusOK {
+			return http.StatusText(resp.Code)
+		}
+
+		return resp.Body.String()
+	}
+
+	assert.EqualString(t, get("http://customer.com/.well-known/acme-challenge/dummyToken"), "dummyToken.thumbprint")
+	assert.EqualString(t, get("http://customer.com:80/.well-known/acme-challenge/dummyToken"), "dummyToken.thumbprint")
+
+	assert.EqualString(t, get("http://customer.com/.well-known/acme-challenge/wrongToken"), "Not Found")
+	assert.EqualString(t, get("http://customer.com/.well-known/acme-challenge/"), "Not Found")
+	// challenge is only answered for the domain it was presented for
+	assert.EqualString(t, get("http://other.com/.well-known/acme-challenge/dummyToken"), "Not Found")
+
+	eventLog.AppendE(testStream, cbdomain.NewChallengeCleanedUp(
+		"dummyToken",
+		ehevent.MetaSystemUser(t0)))
+
+	assert.Ok(t, app.reader.LoadUntilRealtime(context.Background()))
+
+	assert.EqualString(t, get("http://customer.com/.well-known/acme-challenge/dummyToken"), "Not Found")
+}
@@ -0,0 +1,125 @@
+package certbus
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	certDaysUntilExpiryDesc = prometheus.NewDesc(
+		"certbus_certificate_days_until_expiry",
+		"Days until the cert we'd serve expires",
+		[]string{"id", "domains"},
+		nil)
+	undecryptableCertsDesc = prometheus.NewDesc(
+		"certbus_certificates_undecryptable",
+		"Certs whose private key isn't encrypted for our key (fingerprint mismatch), so we can't serve them",
+		nil,
+		nil)
+	cacheHitsDesc = prometheus.NewDesc(
+		"certbus_decrypted_store_cache_hits_total",
+		"Cert lookups served from decrypted cache",
+		nil,
+		nil)
+	cacheMissesDesc = prometheus.NewDesc(
+		"certbus_decrypted_store_cache_misses_total",
+		"Cert lookups not served from decrypted cache",
+		nil,
+		nil)
+	decryptErrorsDesc = prometheus.NewDesc(
+		"certbus_decrypted_store_decrypt_errors_total",
+		"Private key decryption or cert parsing failures",
+		nil,
+		nil)
+	validationErrorsDesc = prometheus.NewDesc(
+		"certbus_decrypted_store_validation_errors_total",
+		"Certs found but not fit for serving (expired, SANs don't match, untrusted chain)",
+		nil,
+		nil)
+	sniMissesDesc = prometheus.NewDesc(
+		"certbus_sni_misses_total",
+		"Handshakes for which we didn't have a cert (before MissHandler)",
+		nil,
+		nil)
+	lastSyncedDesc = prometheus.NewDesc(
+		"certbus_last_sync_timestamp_seconds",
+		"When we last successfully synced with the bus",
+		nil,
+		nil)
+	syncLagDesc = prometheus.NewDesc(
+		"certbus_sync_lag_seconds",
+		"How stale our view of the bus can be (time since last successful sync)",
+		nil,
+		nil)
+)
+
+// collects at scrape time from App's state, so there's nothing to keep up-to-date
+func (c *App) MetricsCollector() prometheus.Collector {
+	return &appCollector{c}
+}
+
+// serves MetricsCollector() (only - Go runtime metrics etc. are left to you)
+func (c *App) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c.MetricsCollector())
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+type appCollector struct {
+	app *App
+}
+
+func (a *appCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certDaysUntilExpiryDesc
+	ch <- undecryptableCertsDesc
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- decryptErrorsDesc
+	ch <- validationErrorsDesc
+	ch <- sniMissesDesc
+	ch <- lastSyncedDesc
+	ch <- syncLagDesc
+}
+
+func (a *appCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+
+	undecryptable := 0
+
+	for _, cert := range a.app.certsEncrypted.All() {
+		ch <- prometheus.MustNewConstMetric(
+			certDaysUntilExpiryDesc,
+			prometheus.GaugeValue,
+			cert.Certificate.NotAfter.Sub(now).Hours()/24,
+			cert.Id,
+			strings.Join(cert.Domains, ","))
+
+		if !a.app.Certs.Decryptable(cert) {
+			undecryptable++
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(undecryptableCertsDesc, prometheus.GaugeValue, float64(undecryptable))
+
+	stats := a.app.Certs.Stats()
+
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.CacheHits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.CacheMisses))
+	ch <- prometheus.MustNewConstMetric(decryptErrorsDesc, prometheus.CounterValue, float64(stats.DecryptErrors))
+	ch <- prometheus.MustNewConstMetric(validationErrorsDesc, prometheus.CounterValue, float64(stats.ValidationErrors))
+
+	a.app.statsMu.Lock()
+	sniMisses := a.app.sniMisses
+	lastSynced := a.app.lastSynced
+	a.app.statsMu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(sniMissesDesc, prometheus.CounterValue, float64(sniMisses))
+
+	ch <- prometheus.MustNewConstMetric(lastSyncedDesc, prometheus.GaugeValue, float64(lastSynced.UnixNano())/1e9)
+	ch <- prometheus.MustNewConstMetric(syncLagDesc, prometheus.GaugeValue, now.Sub(lastSynced).Seconds())
+}
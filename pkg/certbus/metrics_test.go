@@ -0,0 +1,87 @@
+package certbus
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/eventhorizon/pkg/ehreader/ehreadertest"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/gokit/cryptoutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	app, _ := testApp(t, cbdomain.NewCertificateObtained(
+		"dummyCertId",
+		"new",
+		[]string{"example.com"},
+		time.Now().AddDate(0, 0, 30),
+		"dummyCertPem",
+		"SHA256:someoneElsesKey",
+		[]byte("dummyPrivKey"),
+		"dns-01",
+		"",
+		"",
+		"",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0)))
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+
+	app.Certs, err = certificatestore.NewDecryptedStore(app.certsEncrypted, string(cryptoutil.MarshalPemBytes(
+		x509.MarshalPKCS1PrivateKey(key),
+		cryptoutil.PemTypeRsaPrivateKey)))
+	assert.Ok(t, err)
+
+	cert, err := app.GetCertificateAdapter()(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Ok(t, err)
+	assert.Assert(t, cert == nil)
+
+	assert.Ok(t, testutil.CollectAndCompare(app.MetricsCollector(), strings.NewReader(`
+# HELP certbus_certificates_undecryptable Certs whose private key isn't encrypted for our key (fingerprint mismatch), so we can't serve them
+# TYPE certbus_certificates_undecryptable gauge
+certbus_certificates_undecryptable 1
+# HELP certbus_decrypted_store_cache_misses_total Cert lookups not served from decrypted cache
+# TYPE certbus_decrypted_store_cache_misses_total counter
+certbus_decrypted_store_cache_misses_total 2
+# HELP certbus_sni_misses_total Handshakes for which we didn't have a cert (before MissHandler)
+# TYPE certbus_sni_misses_total counter
+certbus_sni_misses_total 1
+`),
+		"certbus_certificates_undecryptable",
+		"certbus_decrypted_store_cache_misses_total",
+		"certbus_sni_misses_total"))
+}
+
+func TestMetricsSyncedByNew(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+
+	eventLog := ehreadertest.NewEventLog()
+	eventLog.AppendE(testStream, cbdomain.NewCertificateRequested("example.com", ehevent.MetaSystemUser(t0)))
+
+	before := time.Now()
+
+	// New() succeeds only after loading the state, so that's our first sync
+	app, err := New(
+		context.Background(),
+		*ehreader.NewTenantCtx(testTenant, eventLog),
+		string(cryptoutil.MarshalPemBytes(x509.MarshalPKCS1PrivateKey(key), cryptoutil.PemTypeRsaPrivateKey)),
+		nil)
+	assert.Ok(t, err)
+
+	assert.Assert(t, !app.lastSynced.Before(before))
+	assert.Assert(t, testutil.CollectAndCount(app.MetricsCollector(), "certbus_last_sync_timestamp_seconds", "certbus_sync_lag_seconds") == 2)
+}
@@ -0,0 +1,116 @@
+package certbus
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"golang.org/x/time/rate"
+)
+
+// don't re-request same hostname more often than this (manager might be slow or fail to issue)
+const onDemandRequestCooldown = 1 * time.Hour
+
+// returns MissHandler that asks the manager (via CertificateRequested event) to issue a cert for
+// the requested hostname if "allowed" says so (nil = nothing is allowed). the handshake that
+// triggers the request will not get the new cert - that is left to "next" (can be nil).
+// subsequent handshakes will get the cert once the manager has issued it.
+//
+// NOTE: the loadbalancer's bus credentials need to have write access for this to work.
+func (c *App) RequestCertificateOnMiss(
+	allowed func(hostname string) bool,
+	next MissHandler,
+) MissHandler {
+	if allowed == nil { // SNI is attacker-controlled, so we can't default to allowing everything
+		allowed = func(string) bool { return false }
+	}
+
+	requests := newOnDemandRequests()
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		hostname := hello.ServerName
+
+		if hostname != "" && !c.isRequestPending(hostname) && allowed(hostname) && requests.shouldRequest(hostname, time.Now()) {
+			// don't block the handshake on the bus write
+			go func() {
+				if err := c.requestCertificate(hostname); err != nil {
+					c.logl.Error.Printf("requestCertificate %s: %v", hostname, err)
+				}
+			}()
+		}
+
+		if next == nil {
+			return nil, nil
+		}
+
+		return next(hello)
+	}
+}
+
+// rate limits on-demand requests
+type onDemandRequests struct {
+	limiter           *rate.Limiter
+	recentlyRequested map[string]time.Time // keyed by hostname
+	mu                sync.Mutex
+}
+
+func newOnDemandRequests() *onDemandRequests {
+	return &onDemandRequests{
+		// SNI is attacker-controlled, so don't let anyone flood the bus
+		limiter:           rate.NewLimiter(rate.Every(10*time.Second), 10),
+		recentlyRequested: map[string]time.Time{},
+	}
+}
+
+func (o *onDemandRequests) shouldRequest(hostname string, now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if requestedAt, found := o.recentlyRequested[hostname]; found && now.Sub(requestedAt) < onDemandRequestCooldown {
+		return false
+	}
+
+	if !o.limiter.AllowN(now, 1) {
+		return false
+	}
+
+	// hostnames are attacker-controlled, so the map must not grow forever
+	for requestedHostname, requestedAt := range o.recentlyRequested {
+		if now.Sub(requestedAt) >= onDemandRequestCooldown {
+			delete(o.recentlyRequested, requestedHostname)
+		}
+	}
+
+	o.recentlyRequested[hostname] = now
+
+	return true
+}
+
+func (c *App) requestCertificate(hostname string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c.logl.Info.Printf("requesting certificate for %s", hostname)
+
+	_, err := c.tenantCtx.Client.Append(
+		ctx,
+		c.tenantCtx.Stream(certificatestore.Stream),
+		[]string{ehevent.Serialize(cbdomain.NewCertificateRequested(
+			hostname,
+			cbdomain.MetaActor("loadbalancer")))})
+	return err
+}
+
+func (c *App) isRequestPending(hostname string) bool {
+	for _, req := range c.certsEncrypted.PendingRequests() {
+		if req.Hostname == hostname {
+			return true
+		}
+	}
+
+	return false
+}
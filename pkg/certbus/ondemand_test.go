@@ -0,0 +1,38 @@
+package certbus
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/assert"
+)
+
+func TestOnDemandRequests(t *testing.T) {
+	requests := newOnDemandRequests()
+
+	assert.Assert(t, requests.shouldRequest("example.com", t0))
+
+	// cooldown
+	assert.Assert(t, !requests.shouldRequest("example.com", t0.Add(time.Minute)))
+
+	// expired entries are pruned
+	assert.Assert(t, requests.shouldRequest("example.net", t0.Add(2*time.Hour)))
+	assert.Assert(t, len(requests.recentlyRequested) == 1)
+	assert.Assert(t, requests.shouldRequest("example.com", t0.Add(2*time.Hour)))
+}
+
+func TestRequestCertificateOnMissNilAllowed(t *testing.T) {
+	app, _ := testApp(t)
+
+	// nothing is allowed
+	cert, err := app.RequestCertificateOnMiss(nil, nil)(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.Ok(t, err)
+	assert.Assert(t, cert == nil)
+
+	time.Sleep(50 * time.Millisecond) // requests are made in the background
+
+	assert.Ok(t, app.reader.LoadUntilRealtime(context.Background()))
+	assert.Assert(t, len(app.certsEncrypted.PendingRequests()) == 0)
+}
@@ -0,0 +1,74 @@
+package certbus
+
+import (
+	"crypto/tls"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+)
+
+// caches TLS-ALPN-01 challenge certs, since generating them is expensive
+type tlsAlpn01Certs struct {
+	byToken map[string]*tls.Certificate
+	mu      sync.Mutex
+}
+
+// answers ACME TLS-ALPN-01 challenges that the manager presented via the bus. other handshakes
+// proceed with your normal config. use alongside GetCertificateAdapter():
+//
+//	TLSConfig: &tls.Config{
+//	    GetCertificate:     certBus.GetCertificateAdapter(),
+//	    GetConfigForClient: certBus.GetConfigForClientAdapter(),
+//	}
+func (c *App) GetConfigForClientAdapter() func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		// ACME servers offer only this protocol when validating
+		if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != tlsalpn01.ACMETLS1Protocol {
+			return nil, nil // nil => use the normal config
+		}
+
+		cert, err := c.tlsAlpn01ChallengeCert(strings.ToLower(hello.ServerName))
+		if err != nil || cert == nil {
+			return nil, err
+		}
+
+		return &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			NextProtos:   []string{tlsalpn01.ACMETLS1Protocol},
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	}
+}
+
+// returns nil if no challenge is presented for the domain
+func (c *App) tlsAlpn01ChallengeCert(domain string) (*tls.Certificate, error) {
+	chal := c.certsEncrypted.ChallengeByDomain(challenge.TLSALPN01.String(), domain)
+	if chal == nil {
+		return nil, nil
+	}
+
+	c.tlsAlpn01Certs.mu.Lock()
+	defer c.tlsAlpn01Certs.mu.Unlock()
+
+	if cert, found := c.tlsAlpn01Certs.byToken[chal.Token]; found {
+		return cert, nil
+	}
+
+	cert, err := tlsalpn01.ChallengeCert(chal.Domain, chal.KeyAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	// forget challenges that have been cleaned up
+	for token := range c.tlsAlpn01Certs.byToken {
+		if c.certsEncrypted.ChallengeByToken(token) == nil {
+			delete(c.tlsAlpn01Certs.byToken, token)
+		}
+	}
+
+	c.tlsAlpn01Certs.byToken[chal.Token] = cert
+
+	return cert, nil
+}
@@ -0,0 +1,65 @@
+package certbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/assert"
+)
+
+func TestGetConfigForClientAdapter(t *testing.T) {
+	app, _ := testApp(t, cbdomain.NewChallengePresented(
+		"tls-alpn-01",
+		"customer.com",
+		"dummyToken",
+		"dummyToken.thumbprint",
+		ehevent.MetaSystemUser(t0)))
+
+	getConfigForClient := app.GetConfigForClientAdapter()
+
+	// regular handshakes proceed with normal config
+	conf, err := getConfigForClient(&tls.ClientHelloInfo{
+		ServerName:      "customer.com",
+		SupportedProtos: []string{"h2", "http/1.1"},
+	})
+	assert.Ok(t, err)
+	assert.Assert(t, conf == nil)
+
+	// no challenge for this domain
+	conf, err = getConfigForClient(&tls.ClientHelloInfo{
+		ServerName:      "other.com",
+		SupportedProtos: []string{"acme-tls/1"},
+	})
+	assert.Ok(t, err)
+	assert.Assert(t, conf == nil)
+
+	challengeCert := func() *x509.Certificate {
+		conf, err := getConfigForClient(&tls.ClientHelloInfo{
+			ServerName:      "customer.com",
+			SupportedProtos: []string{"acme-tls/1"},
+		})
+		assert.Ok(t, err)
+		assert.Assert(t, conf.NextProtos[0] == "acme-tls/1")
+
+		cert, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+		assert.Ok(t, err)
+		return cert
+	}
+
+	first := challengeCert()
+	assert.EqualString(t, first.DNSNames[0], "customer.com")
+
+	hasAcmeExtension := false
+	for _, extension := range first.Extensions {
+		if extension.Id.String() == "1.3.6.1.5.5.7.1.31" {
+			hasAcmeExtension = true
+		}
+	}
+	assert.Assert(t, hasAcmeExtension)
+
+	// comes from cache
+	assert.Assert(t, challengeCert().SerialNumber.Cmp(first.SerialNumber) == 0)
+}
@@ -0,0 +1,85 @@
+package certbusmanager
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
+)
+
+// what we need from an ACME client. LEGO's *certificate.Certifier satisfies this
+type AcmeClient interface {
+	Obtain(request certificate.ObtainRequest) (*certificate.Resource, error)
+	ObtainForCSR(request certificate.ObtainForCSRRequest) (*certificate.Resource, error)
+}
+
+var _ AcmeClient = (*certificate.Certifier)(nil)
+
+// makes a client (for given config's account & CA) that answers challenges with the provider
+type AcmeClientFactory func(
+	conf Config,
+	challengeType challenge.Type,
+	provider challenge.Provider,
+) (AcmeClient, error)
+
+// dns01Options are for e.g. tests that don't have working DNS (LEGO checks propagation from
+// authoritative nameservers)
+func LegoClientFactory(dns01Options ...dns01.ChallengeOption) AcmeClientFactory {
+	return func(
+		conf Config,
+		challengeType challenge.Type,
+		provider challenge.Provider,
+	) (AcmeClient, error) {
+		adapter, err := conf.LetsEncrypt.ToLegoInterface()
+		if err != nil {
+			return nil, err
+		}
+
+		legoConf := lego.NewConfig(adapter)
+		if conf.AcmeDirectoryURL != "" {
+			legoConf.CADirURL = conf.AcmeDirectoryURL
+		}
+
+		legoClient, err := lego.NewClient(legoConf)
+		if err != nil {
+			return nil, err
+		}
+
+		if adapter.GetRegistration() == nil {
+			// one could be obtained with:
+			//     legoClient.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+			return nil, errors.New("LetsEncrypt registration empty")
+		}
+
+		switch challengeType {
+		case challenge.DNS01:
+			if err := legoClient.Challenge.SetDNS01Provider(provider, dns01Options...); err != nil {
+				return nil, err
+			}
+		case challenge.HTTP01:
+			if err := legoClient.Challenge.SetHTTP01Provider(provider); err != nil {
+				return nil, err
+			}
+		case challenge.TLSALPN01:
+			if err := legoClient.Challenge.SetTLSALPN01Provider(provider); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unimplemented challenge: %s", challengeType)
+		}
+
+		return legoClient.Certificate, nil
+	}
+}
+
+func cloudflareDNS01Provider(conf Config) (challenge.Provider, error) {
+	cfConf := cloudflare.NewDefaultConfig() // sets important fields (like TTL)
+	cfConf.AuthEmail = conf.CloudflareCredentials.Email
+	cfConf.AuthKey = conf.CloudflareCredentials.ApiKey
+
+	return cloudflare.NewDNSProviderConfig(cfConf)
+}
@@ -0,0 +1,242 @@
+package certbusmanager
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/gokit/cryptoutil"
+	"github.com/function61/gokit/ezhttp"
+	"github.com/function61/lambda-alertmanager/pkg/alertmanagerclient"
+	"github.com/function61/lambda-alertmanager/pkg/alertmanagertypes"
+)
+
+// same as alertmanagerclient.ClientFromEnvOptional() uses
+const alertManagerBaseurlEnvVarName = "ALERTMANAGER_BASEURL"
+
+// alertmanager tells alerts apart by subject, so each cert & condition gets its own subject.
+// that's also how we find the alert to resolve once the condition clears
+
+func alertSubjectExpiring(certId string) string {
+	return "CertBus: cert " + certId + " expiring"
+}
+
+func alertSubjectRenewalFailing(certId string) string {
+	return "CertBus: cert " + certId + " renewal failing"
+}
+
+func alertSubjectUndecryptable(certId string) string {
+	return "CertBus: cert " + certId + " undecryptable"
+}
+
+func alertSubjectImportedDue(certId string) string {
+	return "CertBus: cert " + certId + " needs manual renewal"
+}
+
+func alertSubjectConfigUnavailable(stream string) string {
+	return "CertBus: config unavailable for " + stream
+}
+
+// alerts that should be firing at given time
+func certAlerts(
+	certs *certificatestore.Store,
+	conf Config,
+	at time.Time,
+) ([]alertmanagertypes.Alert, error) {
+	thresholds := conf.alertThresholds()
+
+	knownKeks, err := knownKekFingerprints(append([]string{conf.KekPublicKey}, thresholds.KnownKekPublicKeys...))
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := []alertmanagertypes.Alert{}
+
+	for _, cert := range certs.All() {
+		renewalErr := certs.LastRenewalError(cert.Id)
+
+		if cert.ChallengeType == certificatestore.ChallengeTypeImported && cert.RenewAt.Before(at) {
+			alerts = append(alerts, importedCertificateDueAlert(cert, at))
+		}
+
+		// imported certs have their own alert (they need manual renewal anyway)
+		expiresIn := cert.Certificate.NotAfter.Sub(at)
+		if cert.ChallengeType != certificatestore.ChallengeTypeImported && expiresIn < time.Duration(thresholds.ExpiresWithinDays)*24*time.Hour {
+			details := fmt.Sprintf(
+				"cert %s (%v) expires %s (in %d days) and hasn't been renewed",
+				cert.Id,
+				cert.Domains,
+				cert.Certificate.NotAfter.Format(time.RFC3339),
+				int(expiresIn.Hours()/24))
+			if renewalErr != nil {
+				details += ". latest renewal error: " + renewalErr.Error
+			}
+
+			alerts = append(alerts, alertmanagertypes.Alert{
+				Subject:   alertSubjectExpiring(cert.Id),
+				Details:   details,
+				Timestamp: at,
+			})
+		}
+
+		if renewalErr != nil && renewalErr.Failures >= thresholds.RenewalFailures {
+			alerts = append(alerts, alertmanagertypes.Alert{
+				Subject: alertSubjectRenewalFailing(cert.Id),
+				Details: fmt.Sprintf(
+					"renewing cert %s (%v) failed %d times in a row. latest (%s): %s",
+					cert.Id,
+					cert.Domains,
+					renewalErr.Failures,
+					renewalErr.Timestamp.Format(time.RFC3339),
+					renewalErr.Error),
+				Timestamp: at,
+			})
+		}
+
+		// with CSR the private key isn't on the bus at all
+		if cert.CSR == "" && !knownKeks[privateKeyFingerprint(cert)] {
+			alerts = append(alerts, alertmanagertypes.Alert{
+				Subject: alertSubjectUndecryptable(cert.Id),
+				Details: fmt.Sprintf(
+					"cert %s (%v) private key is encrypted with KEK %s, which isn't kek_public_key or in alerts.known_kek_public_keys. loadbalancers can't serve it",
+					cert.Id,
+					cert.Domains,
+					privateKeyFingerprint(cert)),
+				Timestamp: at,
+			})
+		}
+	}
+
+	return alerts, nil
+}
+
+// every subject we could fire for certs of this stream (including removed ones, whose alerts
+// resolve on removal), so we know which active alerts are ours to resolve. alerts of other certs
+// are left alone (e.g. another tenant's manager using the same alertmanager)
+func managedAlertSubjects(certs *certificatestore.Store) map[string]bool {
+	subjects := map[string]bool{}
+
+	for _, issuance := range certs.Issuances() {
+		subjects[alertSubjectExpiring(issuance.CertId)] = true
+		subjects[alertSubjectRenewalFailing(issuance.CertId)] = true
+		subjects[alertSubjectUndecryptable(issuance.CertId)] = true
+		subjects[alertSubjectImportedDue(issuance.CertId)] = true
+	}
+
+	return subjects
+}
+
+// fires alerts that aren't active yet and resolves our active alerts that are no longer firing
+func syncAlerts(
+	ctx context.Context,
+	baseUrl string,
+	firing []alertmanagertypes.Alert,
+	managed map[string]bool,
+) error {
+	active := []activeAlert{}
+	if _, err := ezhttp.Get(ctx, baseUrl+"/alerts", ezhttp.RespondsJson(&active, true)); err != nil {
+		return fmt.Errorf("syncAlerts: %w", err)
+	}
+
+	activeSubjects := map[string]bool{}
+	for _, alert := range active {
+		activeSubjects[alert.Subject] = true
+	}
+
+	firingSubjects := map[string]bool{}
+	for _, alert := range firing {
+		firingSubjects[alert.Subject] = true
+
+		if activeSubjects[alert.Subject] {
+			continue
+		}
+
+		if err := alertmanagerclient.New(baseUrl).Alert(ctx, alert); err != nil {
+			return fmt.Errorf("syncAlerts: %w", err)
+		}
+	}
+
+	for _, alert := range active {
+		if !managed[alert.Subject] || firingSubjects[alert.Subject] {
+			continue
+		}
+
+		// acknowledging is the closest thing alertmanager has to resolving
+		if _, err := ezhttp.Get(ctx, baseUrl+"/alerts/acknowledge?id="+url.QueryEscape(alert.Id)); err != nil {
+			return fmt.Errorf("syncAlerts: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// we can't read alertmanager_baseurl from config we don't have, so the "config unavailable" alert
+// goes via ALERTMANAGER_BASEURL (if set). it's also resolved via it, once config is available again
+func (m *Manager) decryptConfigOrAlert(ctx context.Context, certs *certificatestore.Store) (*Config, error) {
+	conf, configErr := m.decryptConfig(certs)
+
+	baseUrl := os.Getenv(alertManagerBaseurlEnvVarName)
+	if baseUrl == "" {
+		return conf, configErr
+	}
+
+	stream := m.tenantCtx.Stream(certificatestore.Stream)
+
+	firing := []alertmanagertypes.Alert{}
+	if configErr != nil {
+		firing = append(firing, alertmanagertypes.Alert{
+			Subject:   alertSubjectConfigUnavailable(stream),
+			Details:   fmt.Sprintf("%s: %v. certs won't be renewed until it's fixed", stream, configErr),
+			Timestamp: m.now(),
+		})
+	}
+
+	if err := syncAlerts(ctx, baseUrl, firing, map[string]bool{
+		alertSubjectConfigUnavailable(stream): true,
+	}); err != nil {
+		if configErr != nil {
+			return nil, fmt.Errorf("%v (also failed alerting about it: %w)", configErr, err)
+		}
+
+		// config is fine, so no reason to fail the caller
+		m.logl.Error.Printf("resolving config alert: %v", err)
+	}
+
+	return conf, configErr
+}
+
+type activeAlert struct {
+	Id      string `json:"alert_key"`
+	Subject string `json:"subject"`
+}
+
+func knownKekFingerprints(publicKeys []string) (map[string]bool, error) {
+	fingerprints := map[string]bool{}
+
+	for _, publicKey := range publicKeys {
+		pubKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPublicKey([]byte(publicKey))
+		if err != nil {
+			return nil, fmt.Errorf("known KEK: %w", err)
+		}
+
+		fingerprint, err := cryptoutil.Sha256FingerprintForPublicKey(pubKey)
+		if err != nil {
+			return nil, err
+		}
+
+		fingerprints[fingerprint] = true
+	}
+
+	return fingerprints, nil
+}
+
+func privateKeyFingerprint(cert certificatestore.ManagedCertificate) string {
+	if cert.Certificate.PrivateKeyEncrypted == nil {
+		return ""
+	}
+
+	return cert.Certificate.PrivateKeyEncrypted.KeyFingerprint
+}
@@ -0,0 +1,350 @@
+package certbusmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/gokit/cryptoutil"
+	"github.com/function61/lambda-alertmanager/pkg/alertmanagertypes"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+func TestCheckinAlerts(t *testing.T) {
+	ctx := context.Background()
+
+	alertManager := newFakeAlertManager()
+	defer alertManager.Close()
+
+	// not ours => must be left alone
+	alertManager.active["Backups failing"] = "alert0"
+
+	m := newTestManager(t)
+
+	configure := func(alerts map[string]interface{}) {
+		m.configure(t, map[string]interface{}{
+			"acme_http01_challenges": map[string]string{
+				"via": "bus",
+			},
+			"alertmanager_baseurl": alertManager.URL,
+			"alerts":               alerts,
+		})
+	}
+
+	configure(map[string]interface{}{
+		"renewal_failures": 2,
+	})
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing")
+
+	// nobody has renewed it
+	assert.Ok(t, m.Checkin(ctx, time.Now().AddDate(0, 0, 80)))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing, CertBus: cert "+id+" expiring")
+	assert.EqualString(
+		t,
+		alertManager.details("CertBus: cert "+id+" expiring"),
+		"cert "+id+" ([example.com]) expires "+m.state(t).ById(id).Certificate.NotAfter.Format(time.RFC3339)+" (in 9 days) and hasn't been renewed")
+
+	// resolves once we no longer consider it expiring
+	configure(map[string]interface{}{
+		"renewal_failures":    2,
+		"expires_within_days": 5,
+	})
+
+	assert.Ok(t, m.Checkin(ctx, time.Now().AddDate(0, 0, 80)))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing")
+	assert.EqualString(t, alertManager.acknowledged(), "alert1")
+
+	workingCA := m.acmeClient
+	m.acmeClient = func(Config, challenge.Type, challenge.Provider) (AcmeClient, error) {
+		return nil, errors.New("CA is down")
+	}
+
+	// one failure is not yet worth waking anyone up
+	assert.EqualString(t, m.Renew(ctx, id, nil).Error(), "CA is down")
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing")
+
+	assert.EqualString(t, m.Renew(ctx, id, nil).Error(), "CA is down")
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing, CertBus: cert "+id+" renewal failing")
+	assert.Assert(t, strings.HasPrefix(
+		alertManager.details("CertBus: cert "+id+" renewal failing"),
+		"renewing cert "+id+" ([example.com]) failed 2 times in a row. latest ("))
+
+	// still firing => not re-sent
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.Assert(t, alertManager.ingested == 2)
+
+	m.acmeClient = workingCA
+	assert.Ok(t, m.Renew(ctx, id, nil))
+
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing")
+
+	// KEK rotated, but cert is still encrypted with the previous one
+	previousKekPrivatePem := m.kekPrivatePem
+
+	kek, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+
+	m.kekPrivatePem = string(cryptoutil.MarshalPemBytes(
+		x509.MarshalPKCS1PrivateKey(kek),
+		cryptoutil.PemTypeRsaPrivateKey))
+
+	configure(nil)
+
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing, CertBus: cert "+id+" undecryptable")
+
+	// loadbalancers still have the previous KEK
+	previousKek, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey([]byte(previousKekPrivatePem))
+	assert.Ok(t, err)
+
+	configure(map[string]interface{}{
+		"known_kek_public_keys": []string{string(cryptoutil.MarshalPemBytes(
+			x509.MarshalPKCS1PublicKey(&previousKek.PublicKey),
+			cryptoutil.PemTypeRsaPublicKey))},
+	})
+
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing")
+	assert.EqualString(t, alertManager.acknowledged(), "alert1, alert2, alert3")
+
+	// removing a cert resolves its alerts
+	assert.Ok(t, m.Checkin(ctx, time.Now().AddDate(0, 0, 86)))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing, CertBus: cert "+id+" expiring")
+
+	assert.Ok(t, m.Remove(ctx, id))
+
+	assert.Ok(t, m.Checkin(ctx, time.Now().AddDate(0, 0, 86)))
+	assert.EqualString(t, alertManager.activeSubjects(), "Backups failing")
+}
+
+func TestConfigUnavailableAlert(t *testing.T) {
+	ctx := context.Background()
+
+	alertManager := newFakeAlertManager()
+	defer alertManager.Close()
+
+	m := newTestManagerWithoutCA(t)
+
+	// without config we only know of alertmanager via ENV
+	assert.EqualString(t, m.Checkin(ctx, time.Now()).Error(), "decryptConfig: no config found")
+	assert.EqualString(t, alertManager.activeSubjects(), "")
+
+	os.Setenv("ALERTMANAGER_BASEURL", alertManager.URL)
+	defer os.Unsetenv("ALERTMANAGER_BASEURL")
+
+	for _, run := range []func() error{
+		func() error { return m.Checkin(ctx, time.Now()) },
+		func() error { return m.RenewDue(ctx, time.Now()) },
+		func() error { return m.ProcessRequests(ctx, -1) },
+	} {
+		alertManager.reset()
+
+		assert.EqualString(t, run().Error(), "decryptConfig: no config found")
+		assert.EqualString(t, alertManager.activeSubjects(), "CertBus: config unavailable for /t-test/certbus")
+		assert.EqualString(
+			t,
+			alertManager.details("CertBus: config unavailable for /t-test/certbus"),
+			"/t-test/certbus: decryptConfig: no config found. certs won't be renewed until it's fixed")
+	}
+
+	// resolved via the same alertmanager (config doesn't even have one)
+	m.configure(t, map[string]interface{}{})
+
+	assert.Ok(t, m.RenewDue(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "")
+}
+
+func TestCheckinAlertsImported(t *testing.T) {
+	ctx := context.Background()
+
+	alertManager := newFakeAlertManager()
+	defer alertManager.Close()
+
+	m := newTestManagerWithoutCA(t)
+	m.configure(t, map[string]interface{}{})
+
+	ca := newTestCA(t)
+
+	certPem, keyPem := ca.issueKeypair(t, 1, time.Now().AddDate(0, 0, 20))
+	id, err := m.Import(ctx, certPem, keyPem, "", false)
+	assert.Ok(t, err)
+
+	// due, but without alertmanager it's only logged
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+
+	m.configure(t, map[string]interface{}{
+		"alertmanager_baseurl": alertManager.URL,
+	})
+
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "CertBus: cert "+id+" needs manual renewal")
+
+	// renewed by hand
+	certPem, keyPem = ca.issueKeypair(t, 2, time.Now().AddDate(1, 0, 0))
+	_, err = m.Import(ctx, certPem, keyPem, id, false)
+	assert.Ok(t, err)
+
+	assert.Ok(t, m.Checkin(ctx, time.Now()))
+	assert.EqualString(t, alertManager.activeSubjects(), "")
+}
+
+func TestCheckinAlertsBrokenConfig(t *testing.T) {
+	ctx := context.Background()
+
+	alertManager := newFakeAlertManager()
+	defer alertManager.Close()
+
+	m := newTestManagerWithoutCA(t)
+
+	_, err := ValidateConfig(strings.NewReader(`{"alerts": {"known_kek_public_keys": ["bogus"]}}`))
+	assert.EqualString(t, err.Error(), "alerts.known_kek_public_keys: known KEK: PEM decode failed")
+
+	// kek_public_key isn't validated, so it could still be broken
+	confJson, err := json.Marshal(map[string]interface{}{
+		"kek_public_key":       "bogus",
+		"alertmanager_baseurl": alertManager.URL,
+	})
+	assert.Ok(t, err)
+
+	confEncrypted, err := m.configDecrypter.Encrypt(confJson)
+	assert.Ok(t, err)
+
+	assert.Ok(t, m.write(ctx, m.state(t), func(*certificatestore.Store) ([]ehevent.Event, error) {
+		return []ehevent.Event{cbdomain.NewConfigUpdated(
+			confEncrypted.KeyFingerprint,
+			confEncrypted.Ciphertext,
+			m.meta())}, nil
+	}))
+
+	// alerting is broken, but renewals still run
+	assert.EqualString(t, m.Checkin(ctx, time.Now()).Error(), "known KEK: PEM decode failed")
+	assert.Assert(t, alertManager.checkins == 1)
+}
+
+// stand-in for lambda-alertmanager's REST API. alerts are told apart by subject
+type fakeAlertManager struct {
+	*httptest.Server
+	active   map[string]string // subject => id
+	byId     map[string]alertmanagertypes.Alert
+	acked    []string
+	ingested int
+	checkins int
+	mu       sync.Mutex
+}
+
+func newFakeAlertManager() *fakeAlertManager {
+	f := &fakeAlertManager{
+		active: map[string]string{},
+		byId:   map[string]alertmanagertypes.Alert{},
+	}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/alerts":
+			active := []activeAlert{}
+			for subject, id := range f.active {
+				active = append(active, activeAlert{Id: id, Subject: subject})
+			}
+
+			_ = json.NewEncoder(w).Encode(active)
+		case r.Method == http.MethodPost && r.URL.Path == "/alerts/ingest":
+			alert := alertmanagertypes.Alert{}
+			if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			f.ingested++
+
+			if _, found := f.active[alert.Subject]; found {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			id := "alert" + strconv.Itoa(len(f.byId)+1)
+			f.active[alert.Subject] = id
+			f.byId[id] = alert
+
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodGet && r.URL.Path == "/alerts/acknowledge":
+			id := r.URL.Query().Get("id")
+
+			alert, found := f.byId[id]
+			if !found {
+				http.Error(w, "alert not found: "+id, http.StatusNotFound)
+				return
+			}
+
+			delete(f.active, alert.Subject)
+			f.acked = append(f.acked, id)
+		case r.Method == http.MethodPost && r.URL.Path == "/deadmansswitch/checkin":
+			f.checkins++
+		default:
+			http.Error(w, "unexpected "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+		}
+	}))
+
+	return f
+}
+
+func (f *fakeAlertManager) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active = map[string]string{}
+}
+
+func (f *fakeAlertManager) activeSubjects() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subjects := []string{}
+	for subject := range f.active {
+		subjects = append(subjects, subject)
+	}
+
+	sort.Strings(subjects)
+
+	return strings.Join(subjects, ", ")
+}
+
+func (f *fakeAlertManager) details(subject string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.byId[f.active[subject]].Details
+}
+
+func (f *fakeAlertManager) acknowledged() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return strings.Join(f.acked, ", ")
+}
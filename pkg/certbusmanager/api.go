@@ -0,0 +1,483 @@
+package certbusmanager
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/certbus/pkg/encryptedbox"
+	"github.com/function61/gokit/cryptorandombytes"
+	"github.com/function61/gokit/jsonfile"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+const (
+	apiMaxRequestBody = 1024 * 1024
+	apiJobRetention   = 24 * time.Hour // finished jobs are forgotten after this
+)
+
+// returns the caller's identity (recorded as actor in the audit trail). error = unauthenticated
+type ApiAuthenticator func(r *http.Request) (string, error)
+
+// tokens maps token to its holder's identity
+func BearerTokenAuthenticator(tokens map[string]string) ApiAuthenticator {
+	return func(r *http.Request) (string, error) {
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			return "", errors.New("no bearer token")
+		}
+
+		token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+
+		for candidate, identity := range tokens {
+			if subtle.ConstantTimeCompare(token, []byte(candidate)) == 1 {
+				return identity, nil
+			}
+		}
+
+		return "", errors.New("invalid bearer token")
+	}
+}
+
+// identity is the client cert's CN. the server's TLS config must verify client certs (ClientCAs &
+// ClientAuth), we only look at chains that were verified
+func ClientCertAuthenticator() ApiAuthenticator {
+	return func(r *http.Request) (string, error) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return "", errors.New("no verified client certificate")
+		}
+
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+	}
+}
+
+// first one to succeed wins
+func AnyAuthenticator(authenticators ...ApiAuthenticator) ApiAuthenticator {
+	return func(r *http.Request) (string, error) {
+		errs := []string{}
+		for _, authenticate := range authenticators {
+			identity, err := authenticate(r)
+			if err == nil {
+				return identity, nil
+			}
+
+			errs = append(errs, err.Error())
+		}
+
+		return "", errors.New(strings.Join(errs, "; "))
+	}
+}
+
+// issuance (and renewal) can take minutes, so they're run as jobs whose status is polled
+type Job struct {
+	Id       string     `json:"id"`
+	Kind     string     `json:"kind"` // "issue" | "renew"
+	CertId   string     `json:"cert_id"`
+	Status   string     `json:"status"` // "running" | "succeeded" | "failed"
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+type ApiIssueRequest struct {
+	Domains          []string `json:"domains"`                      // (optional if CSR given) e.g. ["*.example.com", "example.com"]
+	ChallengeType    string   `json:"challenge_type"`               // "dns-01" (default) | "http-01" | "tls-alpn-01"
+	DNS01DelegatedTo string   `json:"dns01_delegated_to,omitempty"` // (optional) zone that _acme-challenge CNAMEs point to
+	PreferredChain   string   `json:"preferred_chain,omitempty"`    // (optional) overrides config's
+	CSR              string   `json:"csr,omitempty"`                // (optional) PEM. domains come from it
+}
+
+// what GET /certs/{id} returns. ciphertext of private key is opt-in (?include_ciphertext=true)
+type ApiCertDetails struct {
+	certificatestore.CertSummary
+	DNS01DelegatedTo    string            `json:"dns01_delegated_to,omitempty"`
+	PreferredChain      string            `json:"preferred_chain,omitempty"`
+	CSR                 string            `json:"csr,omitempty"`
+	CertPemBundle       string            `json:"cert_pem_bundle"`
+	PrivateKeyEncrypted *encryptedbox.Box `json:"private_key_encrypted,omitempty"`
+}
+
+type ApiRenewRequest struct {
+	Staged        bool   `json:"staged"`
+	ActivateAfter string `json:"activate_after,omitempty"` // (with staged) e.g. "24h". "" = activate manually
+}
+
+// HTTP/JSON API for managing certs (for e.g. self-service portals). mirrors the CLI:
+//
+//	GET    /certs              list ([]CertSummary)
+//	POST   /certs              issue (ApiIssueRequest) => 202 Job
+//	GET    /certs/{id}         inspect (ApiCertDetails)
+//	POST   /certs/{id}/renew   renew (ApiRenewRequest, optional) => 202 Job
+//	DELETE /certs/{id}         remove
+//	GET    /renewable?at=..    certs due for renewal ([]CertSummary. at RFC 3339, defaults to now)
+//	POST   /conf/validate      validate config (without storing it)
+//	GET    /jobs/{id}          job status
+//
+// with waitForJobs the Job is already finished when we respond: 201 for a succeeded issue (Location
+// is the cert), otherwise 200. there's no job Location to poll
+type Api struct {
+	ctx          context.Context // jobs are cancelled when this is
+	manager      *Manager
+	authenticate ApiAuthenticator
+	waitForJobs  bool // jobs can't outlive the request e.g. in Lambda (process is frozen after responding)
+	jobs         map[string]*Job
+	jobsMu       sync.Mutex
+}
+
+func NewApi(
+	ctx context.Context,
+	manager *Manager,
+	authenticate ApiAuthenticator,
+	waitForJobs bool,
+) *Api {
+	return &Api{
+		ctx:          ctx,
+		manager:      manager,
+		authenticate: authenticate,
+		waitForJobs:  waitForJobs,
+		jobs:         map[string]*Job{},
+	}
+}
+
+func (a *Api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	identity, err := a.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	manager := a.manager.WithActor("api:" + identity)
+
+	r.Body = http.MaxBytesReader(w, r.Body, apiMaxRequestBody)
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(path) == 1 && path[0] == "certs" && r.Method == http.MethodGet:
+		a.list(w, r, manager)
+	case len(path) == 1 && path[0] == "certs" && r.Method == http.MethodPost:
+		a.issue(w, r, manager)
+	case len(path) == 2 && path[0] == "certs" && r.Method == http.MethodGet:
+		a.inspect(w, r, manager, path[1])
+	case len(path) == 2 && path[0] == "certs" && r.Method == http.MethodDelete:
+		a.remove(w, r, manager, path[1])
+	case len(path) == 3 && path[0] == "certs" && path[2] == "renew" && r.Method == http.MethodPost:
+		a.renew(w, r, manager, path[1])
+	case len(path) == 1 && path[0] == "renewable" && r.Method == http.MethodGet:
+		a.renewable(w, r, manager)
+	case len(path) == 2 && path[0] == "conf" && path[1] == "validate" && r.Method == http.MethodPost:
+		a.validateConfig(w, r)
+	case len(path) == 2 && path[0] == "jobs" && r.Method == http.MethodGet:
+		a.job(w, path[1])
+	default:
+		apiError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (a *Api) list(w http.ResponseWriter, r *http.Request, manager *Manager) {
+	certs, err := manager.State(r.Context())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiRespond(w, http.StatusOK, summarizeAll(certs, certs.All(), manager.now()))
+}
+
+func (a *Api) inspect(w http.ResponseWriter, r *http.Request, manager *Manager, id string) {
+	certs, err := manager.State(r.Context())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	cert := certs.ById(id)
+	if cert == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("cert not found: %s", id))
+		return
+	}
+
+	details := ApiCertDetails{
+		CertSummary:      certificatestore.Summarize(certs, *cert, manager.now()),
+		DNS01DelegatedTo: cert.DNS01DelegatedTo,
+		PreferredChain:   cert.PreferredChain,
+		CSR:              cert.CSR,
+		CertPemBundle:    cert.Certificate.CertPemBundle,
+	}
+
+	if r.URL.Query().Get("include_ciphertext") == "true" {
+		details.PrivateKeyEncrypted = cert.Certificate.PrivateKeyEncrypted
+	}
+
+	apiRespond(w, http.StatusOK, details)
+}
+
+func (a *Api) issue(w http.ResponseWriter, r *http.Request, manager *Manager) {
+	req := ApiIssueRequest{}
+	if err := jsonfile.Unmarshal(r.Body, &req, true); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	domains := req.Domains
+	if req.CSR != "" {
+		if len(domains) > 0 {
+			apiError(w, http.StatusBadRequest, errors.New("specify either domains or csr"))
+			return
+		}
+
+		var err error
+		domains, err = CSRDomains([]byte(req.CSR))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("csr: %w", err))
+			return
+		}
+	}
+
+	if len(domains) == 0 {
+		apiError(w, http.StatusBadRequest, errors.New("no domains"))
+		return
+	}
+
+	challengeType := challenge.Type(req.ChallengeType)
+	switch challengeType {
+	case "":
+		challengeType = challenge.DNS01
+	case challenge.DNS01, challenge.HTTP01, challenge.TLSALPN01:
+	default:
+		apiError(w, http.StatusBadRequest, fmt.Errorf("unsupported challenge_type: %s", req.ChallengeType))
+		return
+	}
+
+	certId := newCertId() // known up-front so the caller can find the cert via the job
+
+	a.startJob(w, r, "issue", true, certId, func(ctx context.Context) error {
+		return manager.issue(
+			ctx,
+			domains,
+			certId,
+			"new",
+			challengeType,
+			req.DNS01DelegatedTo,
+			req.PreferredChain,
+			req.CSR,
+			nil)
+	})
+}
+
+func (a *Api) renew(w http.ResponseWriter, r *http.Request, manager *Manager, id string) {
+	req := ApiRenewRequest{}
+	if r.ContentLength != 0 { // body is optional
+		if err := jsonfile.Unmarshal(r.Body, &req, true); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	var staged *Staging // nil = config decides
+	if req.Staged {
+		staged = &Staging{}
+
+		if req.ActivateAfter != "" {
+			activateAfter, err := time.ParseDuration(req.ActivateAfter)
+			if err != nil {
+				apiError(w, http.StatusBadRequest, fmt.Errorf("activate_after: %w", err))
+				return
+			}
+
+			staged.ActivateAfter = activateAfter
+		}
+	}
+
+	certs, err := manager.State(r.Context())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if certs.ById(id) == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("cert not found: %s", id))
+		return
+	}
+
+	a.startJob(w, r, "renew", false, id, func(ctx context.Context) error {
+		return manager.Renew(ctx, id, staged)
+	})
+}
+
+func (a *Api) remove(w http.ResponseWriter, r *http.Request, manager *Manager, id string) {
+	certs, err := manager.State(r.Context())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if certs.ById(id) == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("cert not found: %s", id))
+		return
+	}
+
+	if err := manager.Remove(r.Context(), id); err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Api) renewable(w http.ResponseWriter, r *http.Request, manager *Manager) {
+	at := manager.now()
+	if atParam := r.URL.Query().Get("at"); atParam != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, atParam)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("at: %w", err))
+			return
+		}
+	}
+
+	certs, err := manager.State(r.Context())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiRespond(w, http.StatusOK, summarizeAll(certs, certificatestore.CertsDueForRenewal(certs, at), manager.now()))
+}
+
+func (a *Api) validateConfig(w http.ResponseWriter, r *http.Request) {
+	if _, err := ValidateConfig(r.Body); err != nil {
+		apiError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	apiRespond(w, http.StatusOK, map[string]bool{"valid": true})
+}
+
+func (a *Api) job(w http.ResponseWriter, id string) {
+	a.jobsMu.Lock()
+	job := a.jobs[id]
+	var snapshot Job
+	if job != nil {
+		snapshot = *job
+	}
+	a.jobsMu.Unlock()
+
+	if job == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("job not found: %s", id))
+		return
+	}
+
+	apiRespond(w, http.StatusOK, snapshot)
+}
+
+// responds with the job (202). if we can't run in the background, responds only after it's done
+// (201 if it created certId, otherwise 200)
+func (a *Api) startJob(
+	w http.ResponseWriter,
+	r *http.Request,
+	kind string,
+	createsCert bool,
+	certId string,
+	run func(ctx context.Context) error,
+) {
+	job := &Job{
+		Id:      cryptorandombytes.Base64UrlWithoutLeadingDash(8),
+		Kind:    kind,
+		CertId:  certId,
+		Status:  "running",
+		Started: a.manager.now(),
+	}
+
+	a.jobsMu.Lock()
+	a.pruneJobs()
+	a.jobs[job.Id] = job
+	a.jobsMu.Unlock()
+
+	finish := func(err error) {
+		a.jobsMu.Lock()
+		defer a.jobsMu.Unlock()
+
+		finished := a.manager.now()
+		job.Finished = &finished
+
+		if err != nil {
+			a.manager.logl.Error.Printf("job %s (%s %s): %v", job.Id, kind, certId, err)
+
+			job.Status = "failed"
+			job.Error = err.Error()
+		} else {
+			job.Status = "succeeded"
+		}
+	}
+
+	if a.waitForJobs {
+		finish(run(r.Context()))
+	} else {
+		go func() {
+			finish(run(a.ctx))
+		}()
+	}
+
+	a.jobsMu.Lock()
+	snapshot := *job
+	a.jobsMu.Unlock()
+
+	if !a.waitForJobs {
+		w.Header().Set("Location", "/jobs/"+job.Id)
+		apiRespond(w, http.StatusAccepted, snapshot)
+		return
+	}
+
+	// we waited, so the job is already done (and it might not be pollable, e.g. in Lambda the next
+	// request can get a fresh Api)
+	if createsCert && snapshot.Status == "succeeded" {
+		w.Header().Set("Location", "/certs/"+certId)
+		apiRespond(w, http.StatusCreated, snapshot)
+		return
+	}
+
+	apiRespond(w, http.StatusOK, snapshot)
+}
+
+// must hold jobsMu
+func (a *Api) pruneJobs() {
+	now := a.manager.now()
+
+	for id, job := range a.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > apiJobRetention {
+			delete(a.jobs, id)
+		}
+	}
+}
+
+func summarizeAll(
+	certs *certificatestore.Store,
+	managedCerts []certificatestore.ManagedCertificate,
+	now time.Time,
+) []certificatestore.CertSummary {
+	summaries := []certificatestore.CertSummary{}
+	for _, cert := range managedCerts {
+		summaries = append(summaries, certificatestore.Summarize(certs, cert, now))
+	}
+
+	return summaries
+}
+
+func apiRespond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = jsonfile.Marshal(w, body)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiRespond(w, status, map[string]string{"error": err.Error()})
+}
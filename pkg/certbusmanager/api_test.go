@@ -0,0 +1,178 @@
+package certbusmanager
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/gokit/assert"
+)
+
+func TestApi(t *testing.T) {
+	m := newTestManager(t)
+
+	api := httptest.NewServer(NewApi(
+		context.Background(),
+		m.Manager,
+		BearerTokenAuthenticator(map[string]string{"s3cret": "portal"}),
+		false))
+	defer api.Close()
+
+	call := func(method string, path string, body string, token string) (int, string) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		assert.Ok(t, err)
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Ok(t, err)
+		defer resp.Body.Close()
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		assert.Ok(t, err)
+
+		return resp.StatusCode, string(respBody)
+	}
+
+	// polls until job is done
+	waitJob := func(body string) Job {
+		t.Helper()
+
+		job := Job{}
+		assert.Ok(t, json.Unmarshal([]byte(body), &job))
+
+		for job.Status == "running" {
+			time.Sleep(10 * time.Millisecond)
+
+			status, body := call(http.MethodGet, "/jobs/"+job.Id, "", "s3cret")
+			assert.Assert(t, status == http.StatusOK)
+			assert.Ok(t, json.Unmarshal([]byte(body), &job))
+		}
+
+		return job
+	}
+
+	status, _ := call(http.MethodGet, "/certs", "", "")
+	assert.Assert(t, status == http.StatusUnauthorized)
+
+	status, _ = call(http.MethodGet, "/certs", "", "wrong")
+	assert.Assert(t, status == http.StatusUnauthorized)
+
+	status, body := call(http.MethodPost, "/certs", `{"domains": ["example.com"], "challenge_type": "http-01"}`, "s3cret")
+	assert.Assert(t, status == http.StatusAccepted)
+
+	job := waitJob(body)
+	assert.EqualString(t, job.Status, "succeeded")
+	assert.EqualString(t, job.Kind, "issue")
+
+	status, body = call(http.MethodGet, "/certs/"+job.CertId, "", "s3cret")
+	assert.Assert(t, status == http.StatusOK)
+
+	cert := ApiCertDetails{}
+	assert.Ok(t, json.Unmarshal([]byte(body), &cert))
+	assert.EqualString(t, strings.Join(cert.Domains, ", "), "example.com")
+	assert.Assert(t, !strings.Contains(body, "private_key_encrypted"))
+
+	// ciphertext is opt-in
+	status, body = call(http.MethodGet, "/certs/"+job.CertId+"?include_ciphertext=true", "", "s3cret")
+	assert.Assert(t, status == http.StatusOK)
+	assert.Ok(t, json.Unmarshal([]byte(body), &cert))
+	assert.Assert(t, cert.PrivateKeyEncrypted != nil)
+
+	status, body = call(http.MethodGet, "/certs", "", "s3cret")
+	assert.Assert(t, status == http.StatusOK)
+	assert.Assert(t, !strings.Contains(body, "private_key_encrypted"))
+
+	// attributed to the API client in the audit trail
+	assert.EqualString(t, m.state(t).History(job.CertId)[0].Actor, "api:portal")
+
+	status, body = call(http.MethodPost, "/certs/"+job.CertId+"/renew", "", "s3cret")
+	assert.Assert(t, status == http.StatusAccepted)
+	assert.EqualString(t, waitJob(body).Status, "succeeded")
+	assert.Assert(t, m.issued == 2)
+
+	// failures are reported via the job
+	status, body = call(http.MethodPost, "/certs", `{"domains": ["example.net"], "challenge_type": "tls-alpn-01"}`, "s3cret")
+	assert.Assert(t, status == http.StatusAccepted)
+	assert.EqualString(t, waitJob(body).Error, "unexpected challengeType")
+
+	status, body = call(http.MethodGet, "/renewable?at="+time.Now().AddDate(0, 0, 75).Format(time.RFC3339), "", "s3cret")
+	assert.Assert(t, status == http.StatusOK)
+
+	renewable := []certificatestore.CertSummary{}
+	assert.Ok(t, json.Unmarshal([]byte(body), &renewable))
+	assert.Assert(t, len(renewable) == 1)
+
+	status, body = call(http.MethodPost, "/conf/validate", `{"lets_encrypt": {}, "typo": true}`, "s3cret")
+	assert.Assert(t, status == http.StatusUnprocessableEntity)
+	assert.Assert(t, strings.Contains(body, `unknown field \"typo\"`))
+
+	status, _ = call(http.MethodDelete, "/certs/"+job.CertId, "", "s3cret")
+	assert.Assert(t, status == http.StatusNoContent)
+
+	status, _ = call(http.MethodDelete, "/certs/"+job.CertId, "", "s3cret")
+	assert.Assert(t, status == http.StatusNotFound)
+
+	status, _ = call(http.MethodPost, "/certs", `{}`, "s3cret")
+	assert.Assert(t, status == http.StatusBadRequest)
+}
+
+func TestApiJobResponses(t *testing.T) {
+	m := newTestManager(t)
+
+	call := func(waitForJobs bool, path string, body string) *httptest.ResponseRecorder {
+		api := NewApi(
+			context.Background(),
+			m.Manager,
+			BearerTokenAuthenticator(map[string]string{"s3cret": "portal"}),
+			waitForJobs)
+
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	jobOf := func(rec *httptest.ResponseRecorder) Job {
+		job := Job{}
+		assert.Ok(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return job
+	}
+
+	// in the background
+	rec := call(false, "/certs", `{"domains": ["example.com"], "challenge_type": "http-01"}`)
+	assert.Assert(t, rec.Code == http.StatusAccepted)
+	assert.EqualString(t, rec.Header().Get("Location"), "/jobs/"+jobOf(rec).Id)
+
+	// e.g. Lambda: the job is done already, and the next request might get a fresh Api
+	rec = call(true, "/certs", `{"domains": ["example.net"], "challenge_type": "http-01"}`)
+	assert.Assert(t, rec.Code == http.StatusCreated)
+
+	issued := jobOf(rec)
+	assert.EqualString(t, issued.Status, "succeeded")
+	assert.EqualString(t, rec.Header().Get("Location"), "/certs/"+issued.CertId)
+
+	rec = call(true, "/certs/"+issued.CertId+"/renew", "")
+	assert.Assert(t, rec.Code == http.StatusOK)
+	assert.EqualString(t, rec.Header().Get("Location"), "")
+	assert.EqualString(t, jobOf(rec).Status, "succeeded")
+
+	// nothing was created
+	rec = call(true, "/certs", `{"domains": ["example.org"], "challenge_type": "tls-alpn-01"}`)
+	assert.Assert(t, rec.Code == http.StatusOK)
+	assert.EqualString(t, rec.Header().Get("Location"), "")
+	assert.EqualString(t, jobOf(rec).Status, "failed")
+}
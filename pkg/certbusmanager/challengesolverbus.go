@@ -0,0 +1,163 @@
+package certbusmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+)
+
+// presents an ACME challenge by publishing it on the bus, from where loadbalancers answer it.
+// supports HTTP-01 (see certbus.App.HTTP01ChallengeHandler()) and TLS-ALPN-01 (see
+// certbus.App.GetConfigForClientAdapter())
+type busChallengePublisher struct {
+	ctx           context.Context
+	manager       *Manager
+	challengeType challenge.Type
+}
+
+var _ challenge.Provider = (*busChallengePublisher)(nil)
+
+// loadbalancers poll the bus, so it takes a while for them to see the challenge
+const busChallengePropagationTimeout = 1 * time.Minute
+
+func (b *busChallengePublisher) Present(domain string, token string, keyAuth string) error {
+	if err := b.manager.writeUnconditionally(b.ctx, cbdomain.NewChallengePresented(
+		b.challengeType.String(),
+		domain,
+		token,
+		keyAuth,
+		b.manager.meta(),
+	)); err != nil {
+		return err
+	}
+
+	// if we returned before loadbalancers have picked up the challenge, the ACME server's
+	// validation would fail (and burn rate limits)
+	if err := waitForChallengePropagation(b.ctx, func(ctx context.Context) (bool, error) {
+		switch b.challengeType {
+		case challenge.HTTP01:
+			return isHTTP01ChallengeServed(ctx, b.manager.httpClient, domain, token, keyAuth)
+		case challenge.TLSALPN01:
+			return isTLSALPN01ChallengeServed(ctx, domain, keyAuth)
+		default:
+			return false, fmt.Errorf("unsupported challenge type: %s", b.challengeType)
+		}
+	}); err != nil {
+		// LEGO doesn't call CleanUp() if Present() fails, and loadbalancers would keep serving it
+		if errCleanup := b.CleanUp(domain, token, keyAuth); errCleanup != nil {
+			return fmt.Errorf("%v (also failed cleaning up the challenge: %w)", err, errCleanup)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (b *busChallengePublisher) CleanUp(domain string, token string, keyAuth string) error {
+	// not b.ctx, as we must clean up even if we were cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return b.manager.writeUnconditionally(ctx, cbdomain.NewChallengeCleanedUp(
+		token,
+		b.manager.meta()))
+}
+
+func waitForChallengePropagation(ctx context.Context, isServed func(context.Context) (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, busChallengePropagationTimeout)
+	defer cancel()
+
+	for {
+		served, err := isServed(ctx)
+		if served {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("challenge not served within %s (last error: %v)", busChallengePropagationTimeout, err)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func isHTTP01ChallengeServed(
+	ctx context.Context,
+	httpClient *http.Client,
+	domain string,
+	token string,
+	keyAuth string,
+) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+domain+http01.ChallengePath(token), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// key authorization is ~100 bytes, so anything much bigger isn't our challenge anyway
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return false, err
+	}
+
+	return resp.StatusCode == http.StatusOK && strings.TrimSpace(string(body)) == keyAuth, nil
+}
+
+func isTLSALPN01ChallengeServed(ctx context.Context, domain string, keyAuth string) (bool, error) {
+	dialer := &tls.Dialer{
+		Config: &tls.Config{
+			ServerName: domain,
+			NextProtos: []string{tlsalpn01.ACMETLS1Protocol},
+			// challenge certs are self-signed. we verify the only thing that matters (below)
+			InsecureSkipVerify: true,
+		},
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(domain, "443"))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	peerCerts := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		return false, errors.New("no peer certificates")
+	}
+
+	keyAuthHash := sha256.Sum256([]byte(keyAuth))
+	expectedExtensionValue, err := asn1.Marshal(keyAuthHash[:])
+	if err != nil {
+		return false, err
+	}
+
+	idPeAcmeIdentifierV1 := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+	for _, extension := range peerCerts[0].Extensions {
+		if extension.Id.Equal(idPeAcmeIdentifierV1) {
+			return bytes.Equal(extension.Value, expectedExtensionValue), nil
+		}
+	}
+
+	return false, errors.New("certificate is not a TLS-ALPN-01 challenge certificate")
+}
@@ -0,0 +1,40 @@
+package certbusmanager
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/assert"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+func TestBusChallengePublisherCleansUpIfNotServed(t *testing.T) {
+	m := newTestManagerWithoutCA(t)
+
+	m.httpClient = &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("loadbalancer unreachable")
+	})}
+
+	// cancelled before propagation completes (caller giving up)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	publisher := &busChallengePublisher{ctx, m.Manager, challenge.HTTP01}
+
+	err := publisher.Present("example.com", "dummyToken", "dummyToken.dummyThumbprint")
+	assert.Assert(t, strings.HasPrefix(err.Error(), "challenge not served within 1m0s (last error: "))
+
+	// loadbalancers would otherwise keep serving it
+	assert.Assert(t, m.state(t).ChallengeByToken("dummyToken") == nil)
+	assert.EqualString(t, m.eventTypes(t), "ChallengePresented ChallengeCleanedUp")
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (r roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r(req)
+}
@@ -0,0 +1,314 @@
+package certbusmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/certbus/pkg/encryptedbox"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/cryptoutil"
+	"github.com/function61/gokit/jsonfile"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+type Config struct {
+	LetsEncrypt           LetsEncryptAccount    `json:"lets_encrypt"`
+	CloudflareCredentials CloudflareCredentials `json:"cloudflare_credentials"`
+	KekPublicKey          string                `json:"kek_public_key"`                   // used to encrypt certs' private keys
+	AlertManagerBaseurl   string                `json:"alertmanager_baseurl,omitempty"`   // (optional) alertmanager integration
+	Alerts                *Alerts               `json:"alerts,omitempty"`                 // (optional) thresholds for alertmanager alerts
+	AcmeHTTP01Challenges  *AcmeHTTP01Challenges `json:"acme_http01_challenges,omitempty"` // (optional) where to present HTTP-01 challenges
+	CAAIdentity           string                `json:"caa_identity,omitempty"`           // (optional) CA's identity in CAA records
+	RateLimitBudget       *RateLimitBudget      `json:"rate_limit_budget,omitempty"`      // (optional) defaults to LetsEncrypt's limits
+	StageRenewals         *StageRenewals        `json:"stage_renewals,omitempty"`         // (optional) renewals are served only by canaries until activated
+	PreferredChain        string                `json:"preferred_chain,omitempty"`        // (optional) issuer CN of chain's top cert, if CA offers alternate chains
+	AcmeDirectoryURL      string                `json:"acme_directory_url,omitempty"`     // (optional) defaults to LetsEncrypt production
+}
+
+// cert's own preference wins over config's
+func (c *Config) preferredChain(certPreferredChain string) string {
+	if certPreferredChain != "" {
+		return certPreferredChain
+	}
+
+	return c.PreferredChain
+}
+
+type Alerts struct {
+	ExpiresWithinDays  int      `json:"expires_within_days,omitempty"`   // default 14
+	RenewalFailures    int      `json:"renewal_failures,omitempty"`      // consecutive. default 3
+	KnownKekPublicKeys []string `json:"known_kek_public_keys,omitempty"` // KEKs loadbalancers have besides kek_public_key (e.g. mid-rotation)
+}
+
+func (c *Config) alertThresholds() Alerts {
+	thresholds := Alerts{
+		ExpiresWithinDays: 14,
+		RenewalFailures:   3,
+	}
+
+	if c.Alerts != nil {
+		if c.Alerts.ExpiresWithinDays > 0 {
+			thresholds.ExpiresWithinDays = c.Alerts.ExpiresWithinDays
+		}
+
+		if c.Alerts.RenewalFailures > 0 {
+			thresholds.RenewalFailures = c.Alerts.RenewalFailures
+		}
+
+		thresholds.KnownKekPublicKeys = c.Alerts.KnownKekPublicKeys
+	}
+
+	return thresholds
+}
+
+type StageRenewals struct {
+	ActivateAfter string `json:"activate_after,omitempty"` // e.g. "24h". "" = activate manually
+}
+
+// nil if renewals are not staged
+func (c *Config) renewalStaging() (*Staging, error) {
+	if c.StageRenewals == nil {
+		return nil, nil
+	}
+
+	if c.StageRenewals.ActivateAfter == "" {
+		return &Staging{}, nil
+	}
+
+	activateAfter, err := time.ParseDuration(c.StageRenewals.ActivateAfter)
+	if err != nil {
+		return nil, fmt.Errorf("stage_renewals.activate_after: %w", err)
+	}
+
+	return &Staging{activateAfter}, nil
+}
+
+type RateLimitBudget struct {
+	CertsPerRegisteredDomain int `json:"certs_per_registered_domain,omitempty"` // per week. default 50
+	DuplicateCerts           int `json:"duplicate_certs,omitempty"`             // per week. default 5
+}
+
+func (c *Config) RateLimits() certificatestore.RateLimitBudget {
+	budget := certificatestore.LetsEncryptRateLimits()
+
+	// fields not given keep LetsEncrypt's limits
+	if c.RateLimitBudget != nil {
+		if c.RateLimitBudget.CertsPerRegisteredDomain > 0 {
+			budget.CertsPerRegisteredDomain = c.RateLimitBudget.CertsPerRegisteredDomain
+		}
+
+		if c.RateLimitBudget.DuplicateCerts > 0 {
+			budget.DuplicateCerts = c.RateLimitBudget.DuplicateCerts
+		}
+	}
+
+	return budget
+}
+
+func (c *Config) caaIdentity() string {
+	if c.CAAIdentity != "" {
+		return c.CAAIdentity
+	}
+
+	return "letsencrypt.org"
+}
+
+type AcmeHTTP01Challenges struct {
+	Via    string `json:"via,omitempty"` // "bucket" (default) | "bus"
+	Bucket string `json:"bucket,omitempty"`
+	Region string `json:"region,omitempty"` // e.g. "us-east-1"
+}
+
+// decrypts the config stored on the bus (and encrypts updates to it). the config is encrypted
+// with the manager's key pair
+type ConfigDecrypter interface {
+	Decrypt(encrypted *encryptedbox.Box) ([]byte, error)
+	Encrypt(plaintext []byte) (*encryptedbox.Box, error)
+}
+
+// loads the manager's private key on first use, so operations that don't touch config work
+// without the key
+func RsaConfigDecrypter(loadKey func() (*rsa.PrivateKey, error)) ConfigDecrypter {
+	return &rsaConfigDecrypter{loadKey: loadKey}
+}
+
+type rsaConfigDecrypter struct {
+	loadKey func() (*rsa.PrivateKey, error)
+	key     *rsa.PrivateKey
+	mu      sync.Mutex
+}
+
+func (r *rsaConfigDecrypter) Decrypt(encrypted *encryptedbox.Box) ([]byte, error) {
+	key, err := r.privateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypted.DecryptNoFingerprint(key)
+}
+
+func (r *rsaConfigDecrypter) Encrypt(plaintext []byte) (*encryptedbox.Box, error) {
+	key, err := r.privateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedbox.Encrypt(plaintext, &key.PublicKey)
+}
+
+func (r *rsaConfigDecrypter) privateKey() (*rsa.PrivateKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.key == nil {
+		key, err := r.loadKey()
+		if err != nil {
+			return nil, err
+		}
+
+		r.key = key
+	}
+
+	return r.key, nil
+}
+
+// decrypted config (warning: contains secrets)
+func (m *Manager) Config(ctx context.Context) (*Config, error) {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.decryptConfig(certs)
+}
+
+// refuses if someone else updated the config concurrently (we'd silently overwrite their change)
+func (m *Manager) UpdateConfig(ctx context.Context, confToValidate io.Reader) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	conf, err := ValidateConfig(confToValidate)
+	if err != nil {
+		return err
+	}
+
+	// re-marshal to JSON (so our input JSON effectively becomes validated)
+	confAsJson := &bytes.Buffer{}
+	if err := jsonfile.Marshal(confAsJson, conf); err != nil {
+		return err
+	}
+
+	confJsonEncrypted, err := m.configDecrypter.Encrypt(confAsJson.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		if configChanged(certs, current) {
+			return nil, errors.New("config was updated concurrently - review it and try again")
+		}
+
+		return []ehevent.Event{cbdomain.NewConfigUpdated(
+			confJsonEncrypted.KeyFingerprint,
+			confJsonEncrypted.Ciphertext,
+			m.meta())}, nil
+	})
+}
+
+// strict: unknown fields are errors (they're probably typos)
+func ValidateConfig(conf io.Reader) (*Config, error) {
+	validated := &Config{}
+	if err := jsonfile.Unmarshal(conf, validated, true); err != nil {
+		return nil, err
+	}
+
+	// otherwise we'd find out only when alerting (and then there'd be no alerts at all)
+	if validated.Alerts != nil {
+		if _, err := knownKekFingerprints(validated.Alerts.KnownKekPublicKeys); err != nil {
+			return nil, fmt.Errorf("alerts.known_kek_public_keys: %w", err)
+		}
+	}
+
+	return validated, nil
+}
+
+func configChanged(before *certificatestore.Store, current *certificatestore.Store) bool {
+	beforeConf, currentConf := before.GetLatestEncryptedConfig(), current.GetLatestEncryptedConfig()
+	if beforeConf == nil || currentConf == nil {
+		return beforeConf != currentConf
+	}
+
+	return !bytes.Equal(beforeConf.ConfigCiphertext, currentConf.ConfigCiphertext)
+}
+
+func (m *Manager) decryptConfig(certs *certificatestore.Store) (*Config, error) {
+	encryptedConf := certs.GetLatestEncryptedConfig()
+	if encryptedConf == nil {
+		return nil, errors.New("decryptConfig: no config found")
+	}
+
+	plaintextJson, err := m.configDecrypter.Decrypt(encryptedbox.New(
+		encryptedConf.ConfigEncryptionKeyFingerprint,
+		encryptedConf.ConfigCiphertext))
+	if err != nil {
+		return nil, fmt.Errorf("decryptConfig: %w", err)
+	}
+
+	conf := &Config{}
+	return conf, jsonfile.Unmarshal(bytes.NewReader(plaintextJson), conf, true)
+}
+
+type CloudflareCredentials struct {
+	Email  string `json:"email"`
+	ApiKey string `json:"api_key"`
+}
+
+type LetsEncryptAccount struct {
+	Email        string                 `json:"email"`
+	PrivateKey   string                 `json:"private_key"`
+	Registration *registration.Resource `json:"registration"`
+}
+
+type letsEncryptAccountLego struct {
+	LetsEncryptAccount
+	privateKeyParsed crypto.PrivateKey
+}
+
+func (l *LetsEncryptAccount) ToLegoInterface() (*letsEncryptAccountLego, error) {
+	key, err := cryptoutil.ParsePemEncodedPrivateKey([]byte(l.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &letsEncryptAccountLego{
+		LetsEncryptAccount: *l,
+		privateKeyParsed:   key,
+	}, nil
+}
+
+func (l *letsEncryptAccountLego) GetEmail() string {
+	return l.Email
+}
+
+func (u *letsEncryptAccountLego) GetPrivateKey() crypto.PrivateKey {
+	return u.privateKeyParsed
+}
+
+func (l *letsEncryptAccountLego) GetRegistration() *registration.Resource {
+	return l.Registration
+}
+
+func (l *letsEncryptAccountLego) SetRegistration(reg *registration.Resource) {
+	l.Registration = reg
+}
@@ -0,0 +1,27 @@
+package certbusmanager
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/assert"
+)
+
+func TestRateLimits(t *testing.T) {
+	rateLimits := func(confJson string) string {
+		conf, err := ValidateConfig(strings.NewReader(confJson))
+		assert.Ok(t, err)
+
+		budget := conf.RateLimits()
+
+		return fmt.Sprintf("%d %d", budget.CertsPerRegisteredDomain, budget.DuplicateCerts)
+	}
+
+	assert.EqualString(t, rateLimits(`{}`), "50 5")
+	assert.EqualString(t, rateLimits(`{"rate_limit_budget": {"certs_per_registered_domain": 20, "duplicate_certs": 2}}`), "20 2")
+
+	// partial override keeps the default for the other one
+	assert.EqualString(t, rateLimits(`{"rate_limit_budget": {"duplicate_certs": 2}}`), "50 2")
+	assert.EqualString(t, rateLimits(`{"rate_limit_budget": {"certs_per_registered_domain": 20}}`), "20 5")
+}
@@ -0,0 +1,47 @@
+package certbusmanager
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// returns the domains the CSR asks for (after checking its signature)
+func CSRDomains(csrPem []byte) ([]string, error) {
+	csr, err := certcrypto.PemDecodeTox509CSR(csrPem)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	domains := csrDomains(csr)
+	if len(domains) == 0 {
+		return nil, errors.New("CSR has no domains")
+	}
+
+	return domains, nil
+}
+
+// same domains (in same order) that lego will ask the CA for
+func csrDomains(csr *x509.CertificateRequest) []string {
+	domains := []string{}
+	seen := map[string]bool{}
+
+	add := func(domain string) {
+		if domain != "" && !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+
+	add(csr.Subject.CommonName)
+	for _, domain := range csr.DNSNames {
+		add(domain)
+	}
+
+	return domains
+}
@@ -0,0 +1,219 @@
+package certbusmanager
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/gokit/backoff"
+	"github.com/function61/gokit/jsonfile"
+)
+
+const (
+	daemonPollInterval   = 10 * time.Second
+	maxRenewalJitter     = 1 * time.Hour
+	daemonCheckinEvery   = 1 * time.Hour      // dead man's switch expects a checkin within 48h
+	unhealthyAfterNoSync = 2 * time.Minute    // bus unreachable
+	unhealthyIfExpiresIn = 7 * 24 * time.Hour // renewal keeps failing and time is running out
+)
+
+// runs the manager continuously (as an alternative to cron or Lambda): renews certs when they're
+// due, issues certs requested on-demand and activates staged certs
+type Daemon struct {
+	manager     *Manager
+	certs       *certificatestore.Store // kept up-to-date by reader
+	reader      *ehreader.Reader
+	retries     map[string]*renewalRetry // keyed by cert id
+	lastSynced  time.Time
+	lastCheckin time.Time
+	mu          sync.Mutex
+}
+
+type renewalRetry struct {
+	next    time.Time
+	backoff backoff.Func
+	lastErr error
+}
+
+func NewDaemon(manager *Manager) *Daemon {
+	certs := certificatestore.New(manager.tenantCtx.Tenant, nil)
+
+	return &Daemon{
+		manager: manager,
+		certs:   certs,
+		reader:  ehreader.New(certs, manager.tenantCtx.Client, nil),
+		retries: map[string]*renewalRetry{},
+	}
+}
+
+// returns (with nil error) when ctx is cancelled. failures are logged & retried, not returned
+func (d *Daemon) Run(ctx context.Context) error {
+	pollInterval := time.NewTicker(daemonPollInterval)
+	defer pollInterval.Stop()
+
+	for {
+		d.tick(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-pollInterval.C:
+			// eventually we'll migrate to realtime notifications from eventhorizon,
+			// but until then polling will do
+		}
+	}
+}
+
+func (d *Daemon) tick(ctx context.Context) {
+	now := d.manager.now()
+
+	if err := d.reader.LoadUntilRealtime(ctx); err != nil {
+		d.manager.logl.Error.Printf("LoadUntilRealtime: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.lastSynced = now
+	d.mu.Unlock()
+
+	if len(d.certs.PendingRequests()) > 0 {
+		if err := d.manager.ProcessRequests(ctx, -1); err != nil {
+			d.manager.logl.Error.Printf("ProcessRequests: %v", err)
+		}
+	}
+
+	if len(certificatestore.StagedCertsDueForActivation(d.certs, now)) > 0 {
+		if err := d.manager.ActivateDue(ctx); err != nil {
+			d.manager.logl.Error.Printf("ActivateDue: %v", err)
+		}
+	}
+
+	// (already renewed ones waiting for activation are not due)
+	for _, cert := range certificatestore.CertsDueForRenewal(d.certs, now) {
+		if cert.ChallengeType == certificatestore.ChallengeTypeImported || now.Before(renewalScheduledAt(cert)) {
+			continue
+		}
+
+		d.renew(ctx, cert.Id, now)
+	}
+
+	if now.Sub(d.lastCheckin) >= daemonCheckinEvery {
+		if err := d.manager.Checkin(ctx, now); err != nil {
+			d.manager.logl.Error.Printf("Checkin: %v", err)
+		} else {
+			d.lastCheckin = now
+		}
+	}
+}
+
+// failed renewals are retried with exponential backoff
+func (d *Daemon) renew(ctx context.Context, id string, now time.Time) {
+	d.mu.Lock()
+	retry := d.retries[id]
+	d.mu.Unlock()
+
+	if retry != nil && now.Before(retry.next) {
+		return
+	}
+
+	err := d.manager.Renew(ctx, id, nil)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err == nil {
+		delete(d.retries, id)
+		return
+	}
+
+	if retry == nil {
+		retry = &renewalRetry{backoff: backoff.ExponentialWithCappedMax(1*time.Minute, 6*time.Hour)}
+		retry.backoff() // first one would be 0 (= retry immediately)
+
+		d.retries[id] = retry
+	}
+
+	retry.next = now.Add(retry.backoff())
+	retry.lastErr = err
+
+	d.manager.logl.Error.Printf("renewing %s (retrying at %s): %v", id, retry.next.Format(time.RFC3339), err)
+}
+
+// spreads renewals of certs obtained at the same time, so they don't all hit the CA at once.
+// deterministic so the schedule doesn't move around between ticks
+func renewalScheduledAt(cert certificatestore.ManagedCertificate) time.Time {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(cert.Id + cert.RenewAt.String()))
+
+	return cert.RenewAt.Add(time.Duration(hash.Sum64() % uint64(maxRenewalJitter)))
+}
+
+type DaemonHealth struct {
+	Healthy         bool             `json:"healthy"`
+	LastSynced      time.Time        `json:"last_synced"` // zero = never
+	FailingRenewals []FailingRenewal `json:"failing_renewals"`
+}
+
+type FailingRenewal struct {
+	CertId      string    `json:"cert_id"`
+	Expires     time.Time `json:"expires"`
+	Error       string    `json:"error"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+func (d *Daemon) Health() DaemonHealth {
+	now := d.manager.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	health := DaemonHealth{
+		Healthy:         !d.lastSynced.IsZero() && now.Sub(d.lastSynced) < unhealthyAfterNoSync,
+		LastSynced:      d.lastSynced,
+		FailingRenewals: []FailingRenewal{},
+	}
+
+	for id, retry := range d.retries {
+		cert := d.certs.ById(id)
+		if cert == nil { // removed meanwhile
+			continue
+		}
+
+		if cert.Certificate.NotAfter.Sub(now) < unhealthyIfExpiresIn {
+			health.Healthy = false
+		}
+
+		health.FailingRenewals = append(health.FailingRenewals, FailingRenewal{
+			CertId:      id,
+			Expires:     cert.Certificate.NotAfter,
+			Error:       retry.lastErr.Error(),
+			NextAttempt: retry.next,
+		})
+	}
+
+	sort.Slice(health.FailingRenewals, func(i, j int) bool {
+		return health.FailingRenewals[i].CertId < health.FailingRenewals[j].CertId
+	})
+
+	return health
+}
+
+// responds 503 if unhealthy. body is DaemonHealth
+func (d *Daemon) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		health := d.Health()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		_ = jsonfile.Marshal(w, health)
+	})
+}
@@ -0,0 +1,90 @@
+package certbusmanager
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/assert"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+func TestDaemon(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	clock := time.Now()
+
+	d := NewDaemon(m.anotherManager(func() time.Time { return clock }))
+
+	d.tick(ctx)
+	assert.Assert(t, m.issued == 1)
+	assert.Assert(t, d.Health().Healthy)
+
+	workingCA := d.manager.acmeClient
+
+	attempts := 0
+	d.manager.acmeClient = func(Config, challenge.Type, challenge.Provider) (AcmeClient, error) {
+		attempts++
+		return nil, errors.New("CA is down")
+	}
+
+	// 75 days from now the cert (valid for 90 days) is inside its renewal window (jitter is < 1h)
+	clock = clock.AddDate(0, 0, 75).Add(maxRenewalJitter)
+
+	d.tick(ctx)
+	assert.Assert(t, attempts == 1)
+
+	health := d.Health()
+	assert.Assert(t, health.Healthy) // still 15 days left
+	assert.Assert(t, len(health.FailingRenewals) == 1)
+	assert.EqualString(t, health.FailingRenewals[0].CertId, id)
+	assert.EqualString(t, health.FailingRenewals[0].Error, "CA is down")
+
+	// backing off
+	d.tick(ctx)
+	assert.Assert(t, attempts == 1)
+
+	d.manager.acmeClient = workingCA
+	clock = clock.Add(2 * time.Minute)
+
+	d.tick(ctx)
+	assert.Assert(t, m.issued == 2)
+	assert.Assert(t, len(d.Health().FailingRenewals) == 0)
+
+	// haven't been able to sync with the bus in a while
+	clock = clock.Add(3 * time.Minute)
+
+	rec := httptest.NewRecorder()
+	d.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Assert(t, rec.Code == http.StatusServiceUnavailable)
+}
+
+func TestDaemonDoesNotRenewStagedAgain(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	// renewed, waiting for manual activation
+	assert.Ok(t, m.Renew(ctx, id, &Staging{}))
+	assert.Assert(t, m.issued == 2)
+
+	clock := time.Now().AddDate(0, 0, 75).Add(maxRenewalJitter)
+
+	d := NewDaemon(m.anotherManager(func() time.Time { return clock }))
+
+	d.tick(ctx)
+	d.tick(ctx)
+	assert.Assert(t, m.issued == 2)
+	assert.Assert(t, len(d.Health().FailingRenewals) == 0)
+}
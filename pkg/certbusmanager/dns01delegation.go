@@ -0,0 +1,80 @@
+package certbusmanager
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+// DNS-01 for domains whose DNS we don't control (think customers) can be delegated to a zone
+// that we do control (acme-dns style). the domain owner creates (once):
+//
+//	_acme-challenge.customer.com. CNAME _acme-challenge.customer.com.acme.example.net.
+//
+// and we write the TXT records to acme.example.net (via our DNS provider). ACME servers follow
+// the CNAME. this also gives us wildcard certs for customer domains.
+type delegatedDNS01Provider struct {
+	upstream challenge.Provider
+	zone     string
+}
+
+var _ challenge.Provider = (*delegatedDNS01Provider)(nil)
+
+func (d *delegatedDNS01Provider) Present(domain string, token string, keyAuth string) error {
+	return d.upstream.Present(delegatedDNS01Domain(domain, d.zone), token, keyAuth)
+}
+
+func (d *delegatedDNS01Provider) CleanUp(domain string, token string, keyAuth string) error {
+	return d.upstream.CleanUp(delegatedDNS01Domain(domain, d.zone), token, keyAuth)
+}
+
+// otherwise we'd lose upstream's (e.g. longer propagation time) preference
+func (d *delegatedDNS01Provider) Timeout() (time.Duration, time.Duration) {
+	if withTimeout, ok := d.upstream.(challenge.ProviderTimeout); ok {
+		return withTimeout.Timeout()
+	}
+
+	return dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+}
+
+// ("*.customer.com", "acme.example.net") => "customer.com.acme.example.net"
+// (our provider will then write to "_acme-challenge.customer.com.acme.example.net")
+func delegatedDNS01Domain(domain string, zone string) string {
+	return strings.TrimPrefix(domain, "*.") + "." + strings.TrimSuffix(zone, ".")
+}
+
+// "_acme-challenge.customer.com." => "_acme-challenge.customer.com.acme.example.net."
+func delegatedDNS01CNAMEs(domains []string, zone string) map[string]string {
+	cnames := map[string]string{}
+	for _, domain := range domains {
+		cnames[dns.Fqdn("_acme-challenge."+strings.TrimPrefix(domain, "*."))] = dns.Fqdn(
+			"_acme-challenge." + delegatedDNS01Domain(domain, zone))
+	}
+
+	return cnames
+}
+
+// verifies (before ordering, so we don't burn rate limits with failed validations) that the
+// domain owner has set up the CNAMEs
+func verifyDNS01Delegation(resolver *dnsResolver, domains []string, zone string) error {
+	for name, expectedTarget := range delegatedDNS01CNAMEs(domains, zone) {
+		target, err := resolver.LookupCNAME(name)
+		if err != nil {
+			return fmt.Errorf("verifyDNS01Delegation: %s: %w", name, err)
+		}
+
+		if !strings.EqualFold(target, expectedTarget) {
+			return fmt.Errorf(
+				"verifyDNS01Delegation: expecting %s CNAME %s; got '%s'",
+				name,
+				expectedTarget,
+				target)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package certbusmanager
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/assert"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+)
+
+func TestDelegatedDNS01Provider(t *testing.T) {
+	recording := &recordingChallengeProvider{}
+
+	provider := &delegatedDNS01Provider{recording, "acme.example.net."}
+
+	assert.Ok(t, provider.Present("customer.com", "token", "keyAuth"))
+	assert.Ok(t, provider.Present("*.customer.com", "token", "keyAuth"))
+	assert.Ok(t, provider.CleanUp("www.customer.com", "token", "keyAuth"))
+
+	assert.EqualString(t, strings.Join(recording.log, ", "), "present customer.com.acme.example.net, present customer.com.acme.example.net, cleanup www.customer.com.acme.example.net")
+
+	// upstream doesn't have a preference
+	propagation, interval := provider.Timeout()
+	assert.Assert(t, propagation == dns01.DefaultPropagationTimeout)
+	assert.Assert(t, interval == dns01.DefaultPollingInterval)
+
+	// upstream's preference is kept
+	propagation, interval = (&delegatedDNS01Provider{&slowChallengeProvider{}, "acme.example.net"}).Timeout()
+	assert.Assert(t, propagation == 10*time.Minute)
+	assert.Assert(t, interval == 30*time.Second)
+}
+
+func TestVerifyDNS01Delegation(t *testing.T) {
+	resolver := startTestDNSServer(t,
+		`_acme-challenge.customer.com. 300 IN CNAME _acme-challenge.customer.com.acme.example.net.`,
+		`_acme-challenge.uppercase.com. 300 IN CNAME _ACME-CHALLENGE.UPPERCASE.COM.ACME.EXAMPLE.NET.`,
+		`_acme-challenge.wrong.com. 300 IN CNAME _acme-challenge.wrong.com.somewhere.else.net.`,
+	)
+
+	verify := func(domains ...string) string {
+		if err := verifyDNS01Delegation(resolver, domains, "acme.example.net"); err != nil {
+			return err.Error()
+		}
+
+		return "ok"
+	}
+
+	assert.EqualString(t, verify("customer.com"), "ok")
+	assert.EqualString(t, verify("*.customer.com", "customer.com"), "ok") // share one CNAME
+	assert.EqualString(t, verify("uppercase.com"), "ok")
+
+	assert.EqualString(
+		t,
+		verify("missing.com"),
+		"verifyDNS01Delegation: expecting _acme-challenge.missing.com. CNAME _acme-challenge.missing.com.acme.example.net.; got ''")
+
+	assert.EqualString(
+		t,
+		verify("wrong.com"),
+		"verifyDNS01Delegation: expecting _acme-challenge.wrong.com. CNAME _acme-challenge.wrong.com.acme.example.net.; got '_acme-challenge.wrong.com.somewhere.else.net.'")
+
+	// one bad apple spoils the bunch
+	assert.EqualString(
+		t,
+		verify("customer.com", "missing.com"),
+		"verifyDNS01Delegation: expecting _acme-challenge.missing.com. CNAME _acme-challenge.missing.com.acme.example.net.; got ''")
+}
+
+type slowChallengeProvider struct {
+	recordingChallengeProvider
+}
+
+func (s *slowChallengeProvider) Timeout() (time.Duration, time.Duration) {
+	return 10 * time.Minute, 30 * time.Second
+}
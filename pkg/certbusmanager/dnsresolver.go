@@ -0,0 +1,121 @@
+package certbusmanager
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// minimal DNS resolver for our pre-flight checks. talks to explicitly given servers so tests
+// can point it to a local DNS server.
+type dnsResolver struct {
+	servers []string // "host:port"
+}
+
+func newDNSResolver(servers ...string) *dnsResolver {
+	return &dnsResolver{servers}
+}
+
+// uses nameservers from /etc/resolv.conf (or public DNS if that fails, like LEGO does)
+func systemDNSResolver() *dnsResolver {
+	resolvConf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(resolvConf.Servers) == 0 {
+		return newDNSResolver("8.8.8.8:53", "8.8.4.4:53")
+	}
+
+	servers := []string{}
+	for _, server := range resolvConf.Servers {
+		servers = append(servers, net.JoinHostPort(server, resolvConf.Port))
+	}
+
+	return newDNSResolver(servers...)
+}
+
+// returns "" if name has no CNAME
+func (d *dnsResolver) LookupCNAME(name string) (string, error) {
+	resp, err := d.query(name, dns.TypeCNAME)
+	if err != nil {
+		return "", err
+	}
+
+	for _, answer := range resp.Answer {
+		if cname, ok := answer.(*dns.CNAME); ok {
+			return cname.Target, nil
+		}
+	}
+
+	return "", nil
+}
+
+// returns CAA records directly at name (or at the name it CNAMEs to)
+func (d *dnsResolver) LookupCAA(name string) ([]*dns.CAA, error) {
+	resp, err := d.query(name, dns.TypeCAA)
+	if err != nil {
+		return nil, err
+	}
+
+	caas := []*dns.CAA{}
+	for _, answer := range resp.Answer {
+		if caa, ok := answer.(*dns.CAA); ok {
+			caas = append(caas, caa)
+		}
+	}
+
+	return caas, nil
+}
+
+// returns IPv4 and IPv6 addresses
+func (d *dnsResolver) LookupHost(name string) ([]string, error) {
+	addrs := []string{}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := d.query(name, qtype)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, answer := range resp.Answer {
+			switch record := answer.(type) {
+			case *dns.A:
+				addrs = append(addrs, record.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, record.AAAA.String())
+			}
+		}
+	}
+
+	return addrs, nil
+}
+
+func (d *dnsResolver) query(name string, qtype uint16) (*dns.Msg, error) {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.RecursionDesired = true
+
+	var lastErr error
+	for _, server := range d.servers {
+		resp, _, err := (&dns.Client{}).Exchange(msg, server)
+		if err == nil && resp.Truncated {
+			resp, _, err = (&dns.Client{Net: "tcp"}).Exchange(msg, server)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError: // NXDOMAIN is a valid answer (= no records)
+			return resp, nil
+		default:
+			lastErr = fmt.Errorf("%s %s: %s", strings.TrimSuffix(msg.Question[0].Name, "."), dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no DNS servers")
+	}
+
+	return nil, lastErr
+}
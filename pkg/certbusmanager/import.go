@@ -0,0 +1,155 @@
+package certbusmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/lambda-alertmanager/pkg/alertmanagertypes"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+// for certs that can't be obtained via ACME. replaceId "" = import as new managed cert.
+// returns id of the managed cert.
+func (m *Manager) Import(
+	ctx context.Context,
+	certPem []byte,
+	keyPem []byte,
+	replaceId string,
+	verifyChain bool,
+) (string, error) {
+	domains, err := validateImportedCertificate(certPem, keyPem, verifyChain, m.now())
+	if err != nil {
+		return "", err
+	}
+
+	certs, err := m.State(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	certId := newCertId()
+	if replaceId != "" {
+		if err := replaceableByImport(certs, replaceId); err != nil {
+			return "", err
+		}
+
+		certId = replaceId
+	}
+
+	conf, err := m.decryptConfig(certs)
+	if err != nil {
+		return "", err
+	}
+
+	obtained, err := m.makeCertificateObtainedEvent(
+		certId,
+		certificate.Resource{
+			Certificate: certPem,
+			PrivateKey:  keyPem,
+		},
+		domains,
+		[]byte(conf.KekPublicKey),
+		"import",
+		challenge.Type(certificatestore.ChallengeTypeImported),
+		"",
+		"",
+		"",
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return certId, m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		if replaceId != "" {
+			if err := replaceableByImport(current, replaceId); err != nil {
+				return nil, err
+			}
+		}
+
+		return []ehevent.Event{obtained}, nil
+	})
+}
+
+func replaceableByImport(certs *certificatestore.Store, id string) error {
+	existing := certs.ById(id)
+	if existing == nil {
+		return fmt.Errorf("cert not found: %s", id)
+	}
+
+	if existing.ChallengeType != certificatestore.ChallengeTypeImported {
+		return fmt.Errorf("refusing to replace ACME-managed cert %s with an imported one", id)
+	}
+
+	return nil
+}
+
+// returns the domains the cert is for
+func validateImportedCertificate(
+	certPem []byte,
+	keyPem []byte,
+	verifyChain bool,
+	now time.Time,
+) ([]string, error) {
+	keypair, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil { // also checks that private key matches the cert
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(keypair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("cert expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	domains := leaf.DNSNames
+	if len(domains) == 0 {
+		return nil, errors.New("cert has no DNS names (SANs)")
+	}
+
+	if verifyChain {
+		intermediates := x509.NewCertPool()
+		for _, intermediateDer := range keypair.Certificate[1:] {
+			intermediate, err := x509.ParseCertificate(intermediateDer)
+			if err != nil {
+				return nil, err
+			}
+
+			intermediates.AddCert(intermediate)
+		}
+
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Intermediates: intermediates,
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}); err != nil {
+			return nil, fmt.Errorf("chain (is the file a full chain?): %w", err)
+		}
+	}
+
+	return domains, nil
+}
+
+// imported certs can't be renewed via ACME, so a human has to be told
+func importedCertificateDueAlert(cert certificatestore.ManagedCertificate, at time.Time) alertmanagertypes.Alert {
+	return alertmanagertypes.Alert{
+		Subject: alertSubjectImportedDue(cert.Id),
+		Details: fmt.Sprintf(
+			"cert %s (%v) expires %s. re-import with: certbus cert import --id %s",
+			cert.Id,
+			cert.Domains,
+			cert.Certificate.NotAfter.Format(time.RFC3339),
+			cert.Id),
+		Timestamp: at,
+	}
+}
@@ -0,0 +1,52 @@
+package certbusmanager
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/gokit/assert"
+)
+
+func TestValidateImportedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+
+	validate := func(certPem []byte, keyPem []byte, verifyChain bool, now time.Time) string {
+		domains, err := validateImportedCertificate(certPem, keyPem, verifyChain, now)
+		if err != nil {
+			return err.Error()
+		}
+
+		return strings.Join(domains, ", ")
+	}
+
+	withSans := func(leaf *x509.Certificate) { leaf.DNSNames = []string{"example.com", "www.example.com"} }
+
+	certPem, keyPem := ca.issueKeypair(t, 1, rollbackNow.AddDate(1, 0, 0), withSans)
+	_, otherKeyPem := ca.issueKeypair(t, 2, rollbackNow.AddDate(1, 0, 0))
+
+	assert.EqualString(t, validate(certPem, keyPem, false, rollbackNow), "example.com, www.example.com")
+
+	// test CA is not in system roots
+	assert.EqualString(t, validate(certPem, keyPem, true, rollbackNow), "chain (is the file a full chain?): x509: certificate signed by unknown authority")
+
+	assert.EqualString(t, validate(certPem, otherKeyPem, false, rollbackNow), "tls: private key does not match public key")
+
+	assert.EqualString(t, validate(certPem, keyPem, false, rollbackNow.AddDate(2, 0, 0)), "cert expired at 2021-05-15T12:00:00Z")
+}
+
+func TestImportedCertificateDueAlert(t *testing.T) {
+	alert := importedCertificateDueAlert(certificatestore.ManagedCertificate{
+		Id:            "dummyCertId",
+		Domains:       []string{"example.com"},
+		ChallengeType: certificatestore.ChallengeTypeImported,
+		Certificate: certificatestore.CertDetails{
+			NotAfter: rollbackNow,
+		},
+	}, rollbackNow)
+
+	assert.EqualString(t, alert.Subject, "CertBus: cert dummyCertId needs manual renewal")
+	assert.EqualString(t, alert.Details, "cert dummyCertId ([example.com]) expires 2020-05-15T12:00:00Z. re-import with: certbus cert import --id dummyCertId")
+}
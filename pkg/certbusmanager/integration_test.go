@@ -0,0 +1,278 @@
+package certbusmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/acmetest"
+	"github.com/function61/certbus/pkg/certbus"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/gokit/cryptoutil"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+)
+
+// the real manager code paths (lego included) against an in-process ACME server, DNS and
+// loadbalancer. no network access needed
+func TestIntegrationIssueAndRenew(t *testing.T) {
+	ctx := context.Background()
+
+	env := newIntegrationEnv(t)
+
+	issue := func(challengeType challenge.Type, domains ...string) {
+		t.Helper()
+
+		_, err := env.Issue(ctx, domains, challengeType, "", "", "")
+		assert.Ok(t, err)
+	}
+
+	issue(challenge.HTTP01, "www.example.com", "example.com")
+	issue(challenge.HTTP01, "api.example.org")
+	issue(challenge.DNS01, "*.example.net", "example.net")
+
+	assert.Assert(t, env.acme.Issued() == 3)
+	assert.Assert(t, len(env.state(t).All()) == 3)
+
+	// challenges were cleaned up after use
+	assert.Assert(t, env.dns.recordCount() == 0)
+
+	// loadbalancer decrypts and serves all of them
+	for _, hostname := range []string{"example.com", "www.example.com", "api.example.org", "example.net", "foo.example.net"} {
+		assert.Assert(t, env.servedCert(t, hostname) != nil)
+	}
+
+	// without trusting our test CA, loadbalancer refuses to serve
+	untrustingLb, err := certbus.New(ctx, env.tenantCtx, env.kekPrivatePem, nil)
+	assert.Ok(t, err)
+
+	_, err = untrustingLb.GetCertificateAdapter()(&tls.ClientHelloInfo{ServerName: "example.com"})
+	validationErr := &certificatestore.CertificateValidationError{}
+	assert.Assert(t, errors.As(err, &validationErr))
+
+	// cert renew
+	exampleCom := env.state(t).ByHostname("example.com")
+	servedBefore := env.servedCert(t, "example.com")
+
+	assert.Ok(t, env.Renew(ctx, exampleCom.Id, nil))
+
+	assert.Assert(t, env.acme.Issued() == 4)
+	assert.Assert(t, len(env.state(t).History(exampleCom.Id)) == 2)
+
+	servedAfter := env.servedCert(t, "example.com")
+	assert.Assert(t, servedAfter.Leaf.SerialNumber.Cmp(servedBefore.Leaf.SerialNumber) != 0)
+
+	// nothing due today
+	assert.Ok(t, env.RenewDue(ctx, time.Now()))
+	assert.Assert(t, env.acme.Issued() == 4)
+
+	// in 75 days all three are due. one gets renewed per run
+	in75Days := time.Now().AddDate(0, 0, 75)
+
+	assert.Assert(t, len(certificatestore.CertsDueForRenewal(env.state(t), in75Days)) == 3)
+
+	assert.Ok(t, env.RenewDue(ctx, in75Days))
+	assert.Assert(t, env.acme.Issued() == 5)
+	assert.Assert(t, len(env.state(t).Issuances()) == 5)
+}
+
+type integrationEnv struct {
+	*testManager
+	acme *acmetest.Server
+	dns  *inProcessDNS
+}
+
+func newIntegrationEnv(t *testing.T) *integrationEnv {
+	t.Helper()
+
+	m := newTestManagerWithoutCA(t)
+
+	dns := &inProcessDNS{txt: map[string][]string{}}
+
+	// answers HTTP-01 challenges like a real loadbalancer would, straight from the bus
+	loadbalancer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lb, err := certbus.New(r.Context(), m.tenantCtx, m.kekPrivatePem, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		lb.HTTP01ChallengeHandler().ServeHTTP(w, r)
+	}))
+	t.Cleanup(loadbalancer.Close)
+
+	// all "http://<domain>/" requests land on our loadbalancer
+	toLoadbalancer := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, loadbalancer.Listener.Addr().String())
+			},
+		},
+	}
+
+	acmeServer, err := acmetest.NewServer(acmetest.Validators{
+		HTTP01: func(domain string, token string) (string, error) {
+			resp, err := toLoadbalancer.Get("http://" + domain + http01.ChallengePath(token))
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			return string(body), err
+		},
+		DNS01: func(fqdn string) ([]string, error) {
+			return dns.lookupTXT(fqdn), nil
+		},
+	})
+	assert.Ok(t, err)
+	t.Cleanup(acmeServer.Close)
+
+	m.httpClient = toLoadbalancer
+
+	m.SetDNS01Provider(func(Config) (challenge.Provider, error) {
+		return dns, nil
+	})
+
+	// LEGO would check propagation from (real) authoritative nameservers
+	m.acmeClient = LegoClientFactory(dns01.WrapPreCheck(func(_ string, fqdn string, value string, _ dns01.PreCheckFunc) (bool, error) {
+		for _, txt := range dns.lookupTXT(fqdn) {
+			if txt == value {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}))
+
+	m.configure(t, map[string]interface{}{
+		"lets_encrypt":       registerAcmeAccount(t, acmeServer.URL),
+		"acme_directory_url": acmeServer.URL,
+		"acme_http01_challenges": map[string]string{
+			"via": "bus",
+		},
+	})
+
+	return &integrationEnv{m, acmeServer, dns}
+}
+
+// returns cert a (fresh) loadbalancer serves for the hostname
+func (e *integrationEnv) servedCert(t *testing.T, hostname string) *tls.Certificate {
+	t.Helper()
+
+	lb, err := certbus.New(context.Background(), e.tenantCtx, e.kekPrivatePem, nil)
+	assert.Ok(t, err)
+
+	lb.SetRoots(e.acme.Roots())
+
+	cert, err := lb.GetCertificateAdapter()(&tls.ClientHelloInfo{ServerName: hostname})
+	assert.Ok(t, err)
+
+	return cert
+}
+
+func registerAcmeAccount(t *testing.T, directoryUrl string) LetsEncryptAccount {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Ok(t, err)
+
+	account := LetsEncryptAccount{
+		Email:      "certbus@example.com",
+		PrivateKey: string(cryptoutil.MarshalPemBytes(keyDer, cryptoutil.PemTypeEcPrivateKey)),
+	}
+
+	adapter, err := account.ToLegoInterface()
+	assert.Ok(t, err)
+
+	legoConf := lego.NewConfig(adapter)
+	legoConf.CADirURL = directoryUrl
+
+	legoClient, err := lego.NewClient(legoConf)
+	assert.Ok(t, err)
+
+	account.Registration, err = legoClient.Registration.Register(registration.RegisterOptions{
+		TermsOfServiceAgreed: true,
+	})
+	assert.Ok(t, err)
+
+	return account
+}
+
+// DNS-01 provider whose TXT records the test ACME server reads directly
+type inProcessDNS struct {
+	txt map[string][]string
+	mu  sync.Mutex
+}
+
+var _ challenge.ProviderTimeout = (*inProcessDNS)(nil)
+
+func (d *inProcessDNS) Present(domain string, token string, keyAuth string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+
+	d.txt[fqdn] = append(d.txt[fqdn], value)
+
+	return nil
+}
+
+func (d *inProcessDNS) CleanUp(domain string, token string, keyAuth string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+
+	remaining := []string{}
+	for _, txt := range d.txt[fqdn] {
+		if txt != value {
+			remaining = append(remaining, txt)
+		}
+	}
+
+	if len(remaining) > 0 {
+		d.txt[fqdn] = remaining
+	} else {
+		delete(d.txt, fqdn)
+	}
+
+	return nil
+}
+
+// no propagation delay here
+func (d *inProcessDNS) Timeout() (time.Duration, time.Duration) {
+	return 5 * time.Second, 10 * time.Millisecond
+}
+
+func (d *inProcessDNS) lookupTXT(fqdn string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]string{}, d.txt[fqdn]...)
+}
+
+func (d *inProcessDNS) recordCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.txt)
+}
@@ -0,0 +1,76 @@
+package certbusmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+)
+
+// long enough for a renewal (challenge propagation etc.) to finish, short enough that a renewal
+// that crashed without releasing its lease gets retried soon
+const renewalLeaseDuration = 15 * time.Minute
+
+// another manager is renewing the cert
+type RenewalLeasedError struct {
+	Lease certificatestore.RenewalLease
+}
+
+func (r *RenewalLeasedError) Error() string {
+	return fmt.Sprintf(
+		"cert %s is being renewed by %s (lease expires %s)",
+		r.Lease.CertId,
+		r.Lease.Holder,
+		r.Lease.Expires.Format(time.RFC3339))
+}
+
+// keeps other managers (think Lambda and CLI running simultaneously) from renewing the cert
+// while we are, so we don't both order from the CA
+func (m *Manager) acquireRenewalLease(ctx context.Context, id string) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		if lease := current.ActiveRenewalLease(id, m.now()); lease != nil && lease.Holder != m.leaseHolder {
+			return nil, &RenewalLeasedError{*lease}
+		}
+
+		return []ehevent.Event{cbdomain.NewRenewalLeaseAcquired(
+			id,
+			m.leaseHolder,
+			m.now().Add(renewalLeaseDuration),
+			m.meta())}, nil
+	})
+}
+
+// so others don't have to wait for the lease to expire after a failed renewal (renewalErr is
+// recorded so operators can see why). renewalErr nil = not a failure, e.g. we discarded our cert.
+// a renewed cert ends the lease without this (then this is a no-op)
+func (m *Manager) releaseRenewalLease(ctx context.Context, id string, renewalErr error) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		if lease := current.ActiveRenewalLease(id, m.now()); lease == nil || lease.Holder != m.leaseHolder {
+			return nil, nil // expired (and maybe reclaimed by someone else)
+		}
+
+		renewalErrStr := ""
+		if renewalErr != nil {
+			renewalErrStr = renewalErr.Error()
+		}
+
+		return []ehevent.Event{cbdomain.NewRenewalLeaseReleased(
+			id,
+			m.leaseHolder,
+			renewalErrStr,
+			m.meta())}, nil
+	})
+}
@@ -0,0 +1,690 @@
+// Manages certs on the bus: issues, renews, imports, removes etc.
+package certbusmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certbus"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/certbus/pkg/encryptedbox"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/gokit/aws/s3facade"
+	"github.com/function61/gokit/cryptorandombytes"
+	"github.com/function61/gokit/cryptoutil"
+	"github.com/function61/gokit/logex"
+	"github.com/function61/lambda-alertmanager/pkg/alertmanagerclient"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+type Manager struct {
+	tenantCtx       ehreader.TenantCtx
+	now             func() time.Time
+	acmeClient      AcmeClientFactory
+	configDecrypter ConfigDecrypter
+	logl            *logex.Leveled
+	actor           string // who's recorded as having made the changes
+	leaseHolder     string // identifies us in renewal leases
+	dns01Provider   func(conf Config) (challenge.Provider, error)
+	httpClient      *http.Client // for checking that loadbalancers serve our challenges
+	metrics         *managerMetrics
+	preflight       func(
+		ctx context.Context,
+		domains []string,
+		challengeType challenge.Type,
+		dns01DelegatedTo string,
+		provider challenge.Provider,
+		caaIdentity string,
+	) error
+}
+
+// process ("cli", "daemon" etc.) is recorded in the audit trail, see cbdomain.Actor()
+func New(
+	tenantCtx ehreader.TenantCtx,
+	process string,
+	now func() time.Time,
+	acmeClient AcmeClientFactory,
+	configDecrypter ConfigDecrypter,
+	logger *log.Logger,
+) *Manager {
+	actor := cbdomain.Actor(process)
+
+	m := &Manager{
+		tenantCtx:       tenantCtx,
+		now:             now,
+		acmeClient:      acmeClient,
+		configDecrypter: configDecrypter,
+		logl:            logex.Levels(logger),
+		actor:           actor,
+		leaseHolder:     actor + "/" + cryptorandombytes.Base64UrlWithoutLeadingDash(4),
+		dns01Provider:   cloudflareDNS01Provider,
+		httpClient:      http.DefaultClient,
+		metrics:         newManagerMetrics(),
+	}
+
+	m.preflight = func(
+		ctx context.Context,
+		domains []string,
+		challengeType challenge.Type,
+		dns01DelegatedTo string,
+		provider challenge.Provider,
+		caaIdentity string,
+	) error {
+		return preflight(ctx, domains, challengeType, dns01DelegatedTo, provider, caaIdentity, systemDNSResolver(), m.httpClient)
+	}
+
+	return m
+}
+
+// same manager, but changes are recorded (in the audit trail) as made by given actor. e.g. for
+// attributing API calls to the API client
+func (m *Manager) WithActor(actor string) *Manager {
+	withActor := *m
+	withActor.actor = actor
+	return &withActor
+}
+
+// where DNS-01 challenges are presented. defaults to Cloudflare (with credentials from config)
+func (m *Manager) SetDNS01Provider(dns01Provider func(conf Config) (challenge.Provider, error)) {
+	m.dns01Provider = dns01Provider
+}
+
+func (m *Manager) State(ctx context.Context) (*certificatestore.Store, error) {
+	return certbus.ResolveRealtimeState(ctx, m.tenantCtx, nil)
+}
+
+// returns id of the new managed cert. csrPem "" = we generate the private key
+func (m *Manager) Issue(
+	ctx context.Context,
+	domains []string,
+	challengeType challenge.Type,
+	dns01DelegatedTo string,
+	preferredChain string, // "" = use config's
+	csrPem string,
+) (string, error) {
+	certId := newCertId()
+
+	return certId, m.issue(
+		ctx,
+		domains,
+		certId,
+		"new",
+		challengeType,
+		dns01DelegatedTo,
+		preferredChain,
+		csrPem,
+		nil)
+}
+
+// runs the pre-flight checks that issuing would run, without ordering the cert
+func (m *Manager) Preflight(
+	ctx context.Context,
+	domains []string,
+	challengeType challenge.Type,
+	dns01DelegatedTo string,
+) error {
+	conf, err := m.Config(ctx)
+	if err != nil {
+		return err
+	}
+
+	provider, err := m.makeChallengeProvider(ctx, *conf, challengeType, dns01DelegatedTo)
+	if err != nil {
+		return err
+	}
+
+	return m.preflight(ctx, domains, challengeType, dns01DelegatedTo, provider, conf.caaIdentity())
+}
+
+// staged nil = renewals staged according to config
+func (m *Manager) Renew(ctx context.Context, id string, staged *Staging) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	cert := certs.ById(id)
+	if cert == nil {
+		return fmt.Errorf("cert not found: %s", id)
+	}
+
+	return m.renewCertificate(ctx, *cert, staged)
+}
+
+// renews the first cert that is due at given time. certs whose rate limit budget is exhausted
+// (or that another manager is renewing) are deferred. also does Checkin()
+func (m *Manager) RenewDue(ctx context.Context, at time.Time) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	// up-front, so missing config gets alerted about even if renewing would fail first
+	if _, err := m.decryptConfigOrAlert(ctx, certs); err != nil {
+		return err
+	}
+
+	for _, cert := range certificatestore.CertsDueForRenewal(certs, at) {
+		if cert.ChallengeType == certificatestore.ChallengeTypeImported {
+			continue // we can't renew these. Checkin() alerts about them
+		}
+
+		if err := m.renewCertificate(ctx, cert, nil); err != nil {
+			// defer this cert until budget frees up, so one cert hogging the budget
+			// doesn't block renewing the rest
+			budgetExceeded := &certificatestore.RateLimitBudgetExceededError{}
+			leased := &RenewalLeasedError{}
+			if !errors.As(err, &budgetExceeded) && !errors.As(err, &leased) {
+				return err
+			}
+
+			m.logl.Error.Printf("deferring %s: %v", cert.Id, err)
+			continue
+		}
+
+		break
+	}
+
+	return m.Checkin(ctx, at)
+}
+
+// syncs alerts for certs that need attention (see certAlerts(), e.g. imported certs that are due)
+// and checks in to the dead man's switch, so we notice if renewals stop running. without
+// alertmanager the alerts are only logged
+func (m *Manager) Checkin(ctx context.Context, at time.Time) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	conf, err := m.decryptConfigOrAlert(ctx, certs)
+	if err != nil {
+		return err
+	}
+
+	firing, alertsErr := certAlerts(certs, *conf, at)
+
+	if conf.AlertManagerBaseurl == "" {
+		for _, alert := range firing {
+			m.logl.Error.Printf("%s (no alertmanager configured): %s", alert.Subject, alert.Details)
+		}
+
+		return alertsErr
+	}
+
+	if alertsErr == nil { // (can't resolve anything if we don't know what's firing)
+		alertsErr = syncAlerts(
+			ctx,
+			conf.AlertManagerBaseurl,
+			firing,
+			managedAlertSubjects(certs))
+	}
+
+	// renewals are running even if alerting has problems
+	if err := alertmanagerclient.New(conf.AlertManagerBaseurl).DeadMansSwitchCheckin(
+		ctx,
+		"CertBus "+m.tenantCtx.Stream(certificatestore.Stream),
+		48*time.Hour,
+	); err != nil {
+		return err
+	}
+
+	return alertsErr
+}
+
+// issues HTTP-01 certs for loadbalancers' on-demand requests. max < 0 means no limit
+func (m *Manager) ProcessRequests(ctx context.Context, max int) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	// otherwise every request would be recorded as failed
+	if _, err := m.decryptConfigOrAlert(ctx, certs); err != nil {
+		return err
+	}
+
+	for idx, req := range certs.PendingRequests() {
+		if max >= 0 && idx >= max {
+			break
+		}
+
+		if err := m.issue(
+			ctx,
+			[]string{req.Hostname},
+			newCertId(),
+			"on-demand",
+			challenge.HTTP01,
+			"",
+			"",
+			"",
+			nil,
+		); err != nil {
+			// record failure so we don't keep retrying (burning LetsEncrypt's rate limits).
+			// the loadbalancer can request again later.
+			if err := m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+				if !requestPending(current, req.Hostname) { // someone else got to it
+					return nil, nil
+				}
+
+				return []ehevent.Event{cbdomain.NewCertificateRequestFailed(
+					req.Hostname,
+					err.Error(),
+					m.meta())}, nil
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) Remove(ctx context.Context, id string) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	if certs.ById(id) == nil {
+		return fmt.Errorf("cert to remove not found by id: %s", id)
+	}
+
+	return m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		if current.ById(id) == nil { // someone else removed it already
+			return nil, nil
+		}
+
+		return []ehevent.Event{cbdomain.NewCertificateRemoved(
+			id,
+			m.meta())}, nil
+	})
+}
+
+// staged nil = renewals staged according to config
+func (m *Manager) renewCertificate(
+	ctx context.Context,
+	expiringCert certificatestore.ManagedCertificate,
+	staged *Staging,
+) error {
+	// we need to renew the cert using the same challenge type that we used before with this certificate
+	challengeType, err := func() (challenge.Type, error) {
+		switch expiringCert.ChallengeType {
+		case challenge.DNS01.String(), "": // old events didn't record challenge type
+			return challenge.DNS01, nil
+		case challenge.HTTP01.String():
+			return challenge.HTTP01, nil
+		case challenge.TLSALPN01.String():
+			return challenge.TLSALPN01, nil
+		case certificatestore.ChallengeTypeImported:
+			return "", fmt.Errorf("imported cert %s can't be renewed via ACME - re-import it", expiringCert.Id)
+		default:
+			return "", fmt.Errorf("unknown challengeType: %s", expiringCert.ChallengeType)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := m.acquireRenewalLease(ctx, expiringCert.Id); err != nil {
+		return err
+	}
+
+	started := m.now()
+
+	err = m.issue(
+		ctx,
+		expiringCert.Domains,
+		expiringCert.Id,
+		"renewal",
+		challengeType,
+		expiringCert.DNS01DelegatedTo,
+		expiringCert.PreferredChain,
+		expiringCert.CSR,
+		staged)
+
+	m.metrics.observeRenewal(challengeType, m.now().Sub(started), err)
+
+	// also when we discarded our cert (someone else got there first), so our lease isn't left hanging
+	if releaseErr := m.releaseRenewalLease(ctx, expiringCert.Id, err); releaseErr != nil {
+		m.logl.Error.Printf("releaseRenewalLease %s: %v", expiringCert.Id, releaseErr)
+	}
+
+	return err
+}
+
+func (m *Manager) issue(
+	ctx context.Context,
+	domains []string,
+	certId string,
+	reason string,
+	challengeType challenge.Type,
+	dns01DelegatedTo string,
+	preferredChain string, // "" = use config's
+	csrPem string, // "" = we generate the private key
+	staged *Staging,
+) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	conf, err := m.decryptConfig(certs)
+	if err != nil {
+		return err
+	}
+
+	if staged == nil && reason == "renewal" {
+		staged, err = conf.renewalStaging()
+		if err != nil {
+			return err
+		}
+	}
+
+	// so a misbehaving cron doesn't lock us out of LetsEncrypt for a week
+	if err := certificatestore.CheckRateLimitBudget(
+		certs.Issuances(),
+		domains,
+		conf.RateLimits(),
+		m.now(),
+	); err != nil {
+		return err
+	}
+
+	provider, err := m.makeChallengeProvider(ctx, *conf, challengeType, dns01DelegatedTo)
+	if err != nil {
+		return err
+	}
+
+	// misconfigured domains would otherwise burn LetsEncrypt's failed validation rate limits
+	if err := m.preflight(ctx, domains, challengeType, dns01DelegatedTo, provider, conf.caaIdentity()); err != nil {
+		return err
+	}
+
+	resp, err := m.obtainCertificate(*conf, challengeType, provider, domains, conf.preferredChain(preferredChain), csrPem)
+	if err != nil {
+		return err
+	}
+
+	obtained, err := m.makeCertificateObtainedEvent(
+		certId,
+		*resp,
+		domains,
+		[]byte(conf.KekPublicKey),
+		reason,
+		challengeType,
+		dns01DelegatedTo,
+		preferredChain,
+		csrPem,
+		staged,
+	)
+	if err != nil {
+		return err
+	}
+
+	// we were busy with the CA for a while, so others may have written meanwhile
+	return m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		stillWanted, err := obtainedCertStillWanted(certs, current, certId, reason, domains)
+		if err != nil {
+			return nil, err
+		}
+
+		if !stillWanted {
+			m.logl.Info.Printf("discarding obtained cert for %v: someone else got there first", domains)
+			return nil, nil
+		}
+
+		return []ehevent.Event{obtained}, nil
+	})
+}
+
+// re-validates the intent behind obtaining a cert after others (e.g. a cron while we were running
+// from laptop) have written to the bus since "before"
+func obtainedCertStillWanted(
+	before *certificatestore.Store,
+	current *certificatestore.Store,
+	certId string,
+	reason string,
+	domains []string,
+) (bool, error) {
+	switch reason {
+	case "renewal":
+		cert := current.ById(certId)
+		if cert == nil {
+			return false, fmt.Errorf("cert %s was removed while renewing it", certId)
+		}
+
+		// already renewed (or a renewal staged) by someone else => no longer due
+		return cert.Certificate.CertPemBundle == before.ById(certId).Certificate.CertPemBundle &&
+			stagedPemBundle(current, certId) == stagedPemBundle(before, certId), nil
+	case "on-demand":
+		// (the store clears the request also when a covering wildcard cert arrives)
+		return requestPending(current, domains[0]), nil
+	default:
+		return true, nil
+	}
+}
+
+// "" if none
+func stagedPemBundle(certs *certificatestore.Store, id string) string {
+	if staged := certs.StagedById(id); staged != nil {
+		return staged.Certificate.CertPemBundle
+	}
+
+	return ""
+}
+
+func requestPending(certs *certificatestore.Store, hostname string) bool {
+	for _, req := range certs.PendingRequests() {
+		if req.Hostname == hostname {
+			return true
+		}
+	}
+
+	return false
+}
+
+// preferredChain "" = CA's default chain
+func (m *Manager) obtainCertificate(
+	conf Config,
+	challengeType challenge.Type,
+	provider challenge.Provider,
+	domains []string,
+	preferredChain string,
+	csrPem string,
+) (*certificate.Resource, error) {
+	acmeClient, err := m.acmeClient(conf, challengeType, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	if csrPem != "" {
+		csr, err := certcrypto.PemDecodeTox509CSR([]byte(csrPem))
+		if err != nil {
+			return nil, err
+		}
+
+		return acmeClient.ObtainForCSR(certificate.ObtainForCSRRequest{
+			CSR:            csr,
+			Bundle:         true,
+			PreferredChain: preferredChain,
+		})
+	}
+
+	return acmeClient.Obtain(certificate.ObtainRequest{
+		Domains:        domains,
+		Bundle:         true,
+		PreferredChain: preferredChain,
+	})
+}
+
+func (m *Manager) makeChallengeProvider(
+	ctx context.Context,
+	conf Config,
+	challengeType challenge.Type,
+	dns01DelegatedTo string,
+) (challenge.Provider, error) {
+	switch challengeType {
+	case challenge.DNS01:
+		dnsProvider, err := m.dns01Provider(conf)
+		if err != nil {
+			return nil, err
+		}
+
+		if dns01DelegatedTo != "" {
+			return &delegatedDNS01Provider{dnsProvider, dns01DelegatedTo}, nil
+		}
+
+		return dnsProvider, nil
+	case challenge.HTTP01:
+		if conf.AcmeHTTP01Challenges == nil {
+			return nil, errors.New("cannot use HTTP-01 due to missing configuration")
+		}
+
+		switch conf.AcmeHTTP01Challenges.Via {
+		case "bucket", "":
+			validationsBucket, err := s3facade.Bucket(
+				conf.AcmeHTTP01Challenges.Bucket,
+				nil, // use AWS-SDK built-in credentials resolving so this works with Lambda roles
+				conf.AcmeHTTP01Challenges.Region)
+			if err != nil {
+				return nil, err
+			}
+
+			return &bucketChallengeUploader{validationsBucket}, nil
+		case "bus":
+			return &busChallengePublisher{ctx, m, challenge.HTTP01}, nil
+		default:
+			return nil, fmt.Errorf("unknown acme_http01_challenges.via: %s", conf.AcmeHTTP01Challenges.Via)
+		}
+	case challenge.TLSALPN01:
+		// only supported via the bus, since the loadbalancers are the ones terminating TLS
+		return &busChallengePublisher{ctx, m, challenge.TLSALPN01}, nil
+	default:
+		return nil, fmt.Errorf("unimplemented challenge: %s", challengeType)
+	}
+}
+
+func (m *Manager) makeCertificateObtainedEvent(
+	certId string,
+	certAndPrivateKey certificate.Resource,
+	domains []string,
+	publicKey []byte,
+	reason string,
+	challengeType challenge.Type,
+	dns01DelegatedTo string,
+	preferredChain string,
+	csrPem string,
+	staged *Staging,
+) (*cbdomain.CertificateObtained, error) {
+	certParsed, err := cryptoutil.ParsePemX509Certificate(certAndPrivateKey.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	// with CSR the private key never reaches us
+	privateKeyEncrypted := &encryptedbox.Box{}
+	if csrPem == "" {
+		pubKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPublicKey(publicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		privateKeyEncrypted, err = encryptedbox.Encrypt(certAndPrivateKey.PrivateKey, pubKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cbdomain.NewCertificateObtained(
+		certId,
+		reason,
+		domains,
+		certParsed.NotAfter,
+		string(certAndPrivateKey.Certificate),
+		privateKeyEncrypted.KeyFingerprint,
+		privateKeyEncrypted.Ciphertext,
+		challengeType.String(),
+		dns01DelegatedTo,
+		preferredChain,
+		csrPem,
+		staged != nil,
+		staged.activateAt(m.now()),
+		m.meta(),
+	), nil
+}
+
+// how many times we try to write when others keep writing in between
+const maxWriteAttempts = 5
+
+// writes events (made from state at "certs") with optimistic locking. if someone else wrote in
+// between, state is reloaded and makeEvents is re-run against it, so it can re-validate its
+// intent (e.g. "is this cert still due?"). makeEvents returning no events = nothing to write
+func (m *Manager) write(
+	ctx context.Context,
+	certs *certificatestore.Store,
+	makeEvents func(certs *certificatestore.Store) ([]ehevent.Event, error),
+) error {
+	for attempt := 1; ; attempt++ {
+		events, err := makeEvents(certs)
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		serialized := []string{}
+		for _, event := range events {
+			serialized = append(serialized, ehevent.Serialize(event))
+		}
+
+		_, err = m.tenantCtx.Client.AppendAfter(ctx, certs.Version(), serialized)
+		if err == nil {
+			return nil
+		}
+
+		conflict := &ehclient.ErrOptimisticLockingFailed{}
+		if !errors.As(err, &conflict) || attempt == maxWriteAttempts {
+			return err
+		}
+
+		m.logl.Info.Printf("concurrent write (attempt %d), re-validating: %v", attempt, err)
+
+		certs, err = m.State(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writes events that don't depend on state
+func (m *Manager) writeUnconditionally(ctx context.Context, events ...ehevent.Event) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.write(ctx, certs, func(_ *certificatestore.Store) ([]ehevent.Event, error) {
+		return events, nil
+	})
+}
+
+// event meta at manager's clock
+func (m *Manager) meta() ehevent.EventMeta {
+	return ehevent.Meta(m.now(), m.actor)
+}
+
+func newCertId() string {
+	return cryptorandombytes.Base64UrlWithoutLeadingDash(8)
+}
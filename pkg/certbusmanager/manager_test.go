@@ -0,0 +1,452 @@
+package certbusmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/certbus/pkg/encryptedbox"
+	"github.com/function61/certbus/pkg/membus"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/gokit/cryptoutil"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+func TestManagerLifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	_, err := m.Issue(ctx, []string{"www.example.com", "example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	certs := m.state(t)
+	assert.Assert(t, len(certs.All()) == 1)
+
+	cert := certs.All()[0]
+	assert.EqualString(t, strings.Join(cert.Domains, ", "), "www.example.com, example.com")
+	assert.EqualString(t, cert.ChallengeType, "http-01")
+	assert.Assert(t, len(cert.Certificate.PrivateKeyEncrypted.Ciphertext) > 0)
+
+	// manual renewal
+	assert.Ok(t, m.Renew(ctx, cert.Id, nil))
+
+	certs = m.state(t)
+	assert.Assert(t, len(certs.All()) == 1)
+	assert.Assert(t, len(certs.History(cert.Id)) == 2)
+	assert.EqualString(t, certs.History(cert.Id)[1].Reason, "renewal")
+
+	// nothing due yet
+	assert.Ok(t, m.RenewDue(ctx, time.Now()))
+	assert.Assert(t, m.issued == 2)
+
+	// 75 days from now the cert (valid for 90 days) is inside its renewal window
+	assert.Ok(t, m.RenewDue(ctx, time.Now().AddDate(0, 0, 75)))
+	assert.Assert(t, m.issued == 3)
+	assert.Assert(t, len(m.state(t).History(cert.Id)) == 3)
+
+	assert.Ok(t, m.Remove(ctx, cert.Id))
+
+	assert.Assert(t, len(m.state(t).All()) == 0)
+
+	assert.EqualString(t, m.eventTypes(t), "ConfigUpdated CertificateObtained RenewalLeaseAcquired CertificateObtained RenewalLeaseAcquired CertificateObtained CertificateRemoved")
+}
+
+func TestManagerRemoveRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	m.bus.InjectConflicts(1)
+
+	assert.Ok(t, m.Remove(ctx, id))
+
+	assert.Assert(t, len(m.state(t).All()) == 0)
+}
+
+func TestManagerGivesUpOnPersistentConflicts(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	m.bus.InjectConflicts(maxWriteAttempts)
+
+	err = m.Remove(ctx, id)
+
+	conflict := &ehclient.ErrOptimisticLockingFailed{}
+	assert.Assert(t, errors.As(err, &conflict))
+
+	assert.Assert(t, len(m.state(t).All()) == 1)
+
+	assert.Ok(t, m.Remove(ctx, id))
+
+	assert.Assert(t, len(m.state(t).All()) == 0)
+}
+
+func TestManagerRenewalRacedByAnotherRenewal(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	// our renewal is so slow that our lease expires and another manager reclaims it
+	other := m.anotherManager(func() time.Time { return time.Now().Add(renewalLeaseDuration + time.Minute) })
+
+	m.duringObtain = func() {
+		assert.Ok(t, other.Renew(ctx, id, nil))
+	}
+
+	assert.Ok(t, m.Renew(ctx, id, nil))
+
+	// both got a cert from the CA, but ours was discarded as the cert was no longer due
+	assert.Assert(t, m.issued == 3)
+	assert.Assert(t, len(m.state(t).History(id)) == 2)
+}
+
+func TestManagerRenewalLease(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	// e.g. Lambda is in the middle of renewing while we run from laptop
+	other := m.anotherManager(time.Now)
+	assert.Ok(t, other.acquireRenewalLease(ctx, id))
+
+	leased := &RenewalLeasedError{}
+	assert.Assert(t, errors.As(m.Renew(ctx, id, nil), &leased))
+	assert.EqualString(t, leased.Lease.Holder, other.leaseHolder)
+
+	// skipped without error
+	assert.Ok(t, m.RenewDue(ctx, time.Now().AddDate(0, 0, 75)))
+	assert.Assert(t, m.issued == 1)
+
+	// expired lease gets reclaimed
+	later := m.anotherManager(func() time.Time { return time.Now().Add(renewalLeaseDuration + time.Minute) })
+	assert.Ok(t, later.Renew(ctx, id, nil))
+	assert.Assert(t, m.issued == 2)
+
+	// successful renewal ended the lease
+	assert.Assert(t, m.state(t).ActiveRenewalLease(id, time.Now()) == nil)
+}
+
+func TestManagerFailedRenewalReleasesLease(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	m.acmeClient = func(Config, challenge.Type, challenge.Provider) (AcmeClient, error) {
+		return nil, errors.New("CA is down")
+	}
+
+	assert.EqualString(t, m.Renew(ctx, id, nil).Error(), "CA is down")
+
+	assert.Assert(t, m.state(t).ActiveRenewalLease(id, time.Now()) == nil)
+	assert.EqualString(t, m.state(t).LastRenewalError(id).Error, "CA is down")
+	assert.EqualString(t, m.eventTypes(t), "ConfigUpdated CertificateObtained RenewalLeaseAcquired RenewalLeaseReleased")
+}
+
+func TestManagerDiscardedRenewalReleasesLease(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	assert.Ok(t, m.Renew(ctx, id, &Staging{}))
+
+	// staged renewal gets activated while we renew => ours is no longer wanted
+	m.duringObtain = func() {
+		assert.Ok(t, m.Activate(ctx, id))
+	}
+
+	assert.Ok(t, m.Renew(ctx, id, nil))
+	assert.Assert(t, m.issued == 3)
+	assert.Assert(t, len(m.state(t).History(id)) == 2)
+
+	assert.Assert(t, m.state(t).ActiveRenewalLease(id, time.Now()) == nil)
+	assert.Assert(t, m.state(t).LastRenewalError(id) == nil) // not a failure
+	assert.EqualString(t, m.eventTypes(t), "ConfigUpdated CertificateObtained RenewalLeaseAcquired CertificateObtained RenewalLeaseAcquired CertificateActivated RenewalLeaseReleased")
+}
+
+func TestManagerRenewalRacedByRemoval(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	m.duringObtain = func() {
+		assert.Ok(t, m.Remove(ctx, id))
+	}
+
+	assert.EqualString(t, m.Renew(ctx, id, nil).Error(), "cert "+id+" was removed while renewing it")
+
+	assert.Assert(t, len(m.state(t).All()) == 0)
+}
+
+func TestManagerOnDemandRacedByWildcard(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	m.bus.AppendE(m.tenantCtx.Stream(certificatestore.Stream), cbdomain.NewCertificateRequested(
+		"www.example.com",
+		ehevent.MetaSystemUser(time.Now())))
+
+	// someone issues a wildcard (which also covers the requested hostname) while we talk to the CA
+	m.duringObtain = func() {
+		_, err := m.Issue(ctx, []string{"*.example.com"}, challenge.HTTP01, "", "", "")
+		assert.Ok(t, err)
+	}
+
+	assert.Ok(t, m.ProcessRequests(ctx, -1))
+
+	// both got a cert from the CA, but ours was discarded
+	assert.Assert(t, m.issued == 2)
+	assert.Assert(t, len(m.state(t).All()) == 1)
+	assert.EqualString(t, m.state(t).All()[0].Domains[0], "*.example.com")
+	assert.Assert(t, len(m.state(t).PendingRequests()) == 0)
+}
+
+func TestManagerUpdateConfigConflicts(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	// unrelated concurrent write => retried
+	m.bus.InjectConflicts(1)
+
+	m.configure(t, map[string]interface{}{
+		"caa_identity": "ours.example.com",
+	})
+
+	conf, err := m.Config(ctx)
+	assert.Ok(t, err)
+	assert.EqualString(t, conf.CAAIdentity, "ours.example.com")
+
+	// someone else updates config in between => we must not overwrite their change
+	m.configDecrypter = &racingConfigDecrypter{m.configDecrypter, func() {
+		m.configure(t, map[string]interface{}{
+			"caa_identity": "theirs.example.com",
+		})
+	}}
+
+	err = m.UpdateConfig(ctx, strings.NewReader(`{"caa_identity": "ours.example.com"}`))
+	assert.EqualString(t, err.Error(), "config was updated concurrently - review it and try again")
+
+	conf, err = m.Config(ctx)
+	assert.Ok(t, err)
+	assert.EqualString(t, conf.CAAIdentity, "theirs.example.com")
+}
+
+func TestManagerRenewUnknownCert(t *testing.T) {
+	m := newTestManager(t)
+
+	assert.EqualString(t, m.Renew(context.Background(), "nonExistent", nil).Error(), "cert not found: nonExistent")
+	assert.Assert(t, m.issued == 0)
+}
+
+func TestManagerRecordsProcessAsActor(t *testing.T) {
+	m := newTestManager(t)
+
+	events, err := m.bus.Events(m.tenantCtx.Stream(certificatestore.Stream), cbdomain.Types)
+	assert.Ok(t, err)
+
+	// ConfigUpdated
+	assert.Assert(t, strings.HasPrefix(events[0].Meta().UserId, "test:"))
+}
+
+// manager wired to an in-memory bus and a fake CA, so lifecycle is testable without AWS,
+// LetsEncrypt or DNS
+type testManager struct {
+	*Manager
+	bus           *membus.Bus
+	tenantCtx     ehreader.TenantCtx
+	kekPrivatePem string // what loadbalancers use to decrypt certs' private keys
+	issued        int    // by fake CA
+	duringObtain  func() // (optional) runs once while fake CA is issuing, to simulate concurrent writers
+}
+
+func newTestManager(t *testing.T) *testManager {
+	t.Helper()
+
+	m := newTestManagerWithoutCA(t)
+
+	ca := newTestCA(t)
+
+	m.acmeClient = func(_ Config, challengeType challenge.Type, _ challenge.Provider) (AcmeClient, error) {
+		if challengeType != challenge.HTTP01 {
+			return nil, errors.New("unexpected challengeType")
+		}
+
+		return &fakeAcmeClient{func(domains []string) (*certificate.Resource, error) {
+			if duringObtain := m.duringObtain; duringObtain != nil {
+				m.duringObtain = nil
+				duringObtain()
+			}
+
+			m.issued++
+
+			certPem, keyPem := ca.issueKeypair(t, int64(m.issued), time.Now().AddDate(0, 0, 90), func(leaf *x509.Certificate) {
+				leaf.DNSNames = domains
+				leaf.NotBefore = time.Now().Add(-time.Hour)
+			})
+
+			return &certificate.Resource{
+				Domain:      domains[0],
+				Certificate: certPem,
+				PrivateKey:  keyPem,
+			}, nil
+		}}, nil
+	}
+
+	m.configure(t, map[string]interface{}{
+		"acme_http01_challenges": map[string]string{
+			"via": "bus",
+		},
+	})
+
+	return m
+}
+
+// bus, keys & no pre-flight checks (they need DNS). you need to configure() and provide an ACME client
+func newTestManagerWithoutCA(t *testing.T) *testManager {
+	t.Helper()
+
+	bus := membus.New()
+	tenantCtx := bus.TenantCtx(ehreader.TenantId("test"))
+
+	managerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+
+	m := &testManager{
+		Manager: New(
+			tenantCtx,
+			"test",
+			time.Now,
+			nil,
+			RsaConfigDecrypter(func() (*rsa.PrivateKey, error) { return managerKey, nil }),
+			log.New(ioutil.Discard, "", 0)),
+		bus:       bus,
+		tenantCtx: tenantCtx,
+	}
+
+	m.preflight = func(context.Context, []string, challenge.Type, string, challenge.Provider, string) error {
+		return nil
+	}
+
+	kek, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+
+	m.kekPrivatePem = string(cryptoutil.MarshalPemBytes(
+		x509.MarshalPKCS1PrivateKey(kek),
+		cryptoutil.PemTypeRsaPrivateKey))
+
+	return m
+}
+
+// another manager (with its own clock) on the same bus, CA and config
+func (m *testManager) anotherManager(now func() time.Time) *Manager {
+	other := New(m.tenantCtx, "test", now, m.acmeClient, m.configDecrypter, log.New(ioutil.Discard, "", 0))
+	other.preflight = m.preflight
+
+	return other
+}
+
+// kek_public_key is filled in for you
+func (m *testManager) configure(t *testing.T, conf map[string]interface{}) {
+	t.Helper()
+
+	kek, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey([]byte(m.kekPrivatePem))
+	assert.Ok(t, err)
+
+	conf["kek_public_key"] = string(cryptoutil.MarshalPemBytes(
+		x509.MarshalPKCS1PublicKey(&kek.PublicKey),
+		cryptoutil.PemTypeRsaPublicKey))
+
+	confJson, err := json.Marshal(conf)
+	assert.Ok(t, err)
+
+	assert.Ok(t, m.UpdateConfig(context.Background(), strings.NewReader(string(confJson))))
+}
+
+func (m *testManager) state(t *testing.T) *certificatestore.Store {
+	t.Helper()
+
+	certs, err := m.State(context.Background())
+	assert.Ok(t, err)
+
+	return certs
+}
+
+func (m *testManager) eventTypes(t *testing.T) string {
+	t.Helper()
+
+	events, err := m.bus.Events(m.tenantCtx.Stream(certificatestore.Stream), cbdomain.Types)
+	assert.Ok(t, err)
+
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.MetaType())
+	}
+
+	return strings.Join(types, " ")
+}
+
+// issues whatever it's asked to, without challenges
+type fakeAcmeClient struct {
+	issue func(domains []string) (*certificate.Resource, error)
+}
+
+func (f *fakeAcmeClient) Obtain(req certificate.ObtainRequest) (*certificate.Resource, error) {
+	return f.issue(req.Domains)
+}
+
+func (f *fakeAcmeClient) ObtainForCSR(req certificate.ObtainForCSRRequest) (*certificate.Resource, error) {
+	return f.issue(req.CSR.DNSNames)
+}
+
+// runs "race" (once) just before encrypting, i.e. after UpdateConfig() has read state
+type racingConfigDecrypter struct {
+	ConfigDecrypter
+	race func()
+}
+
+func (r *racingConfigDecrypter) Encrypt(plaintext []byte) (*encryptedbox.Box, error) {
+	if race := r.race; race != nil {
+		r.race = nil
+		race()
+	}
+
+	return r.ConfigDecrypter.Encrypt(plaintext)
+}
@@ -0,0 +1,70 @@
+package certbusmanager
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// renewals that got as far as ordering from the CA (i.e. not deferred because of a lease)
+type managerMetrics struct {
+	renewals        *prometheus.CounterVec
+	renewalFailures *prometheus.CounterVec
+	renewalDuration *prometheus.HistogramVec
+}
+
+func newManagerMetrics() *managerMetrics {
+	return &managerMetrics{
+		renewals: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "certbus_manager_renewals_total",
+			Help: "Renewal attempts",
+		}, []string{"challenge_type"}),
+		renewalFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "certbus_manager_renewal_failures_total",
+			Help: "Renewal attempts that didn't result in a cert",
+		}, []string{"challenge_type"}),
+		renewalDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "certbus_manager_renewal_duration_seconds",
+			Help: "How long renewal attempts took (challenge propagation dominates)",
+			// DNS-01 can take minutes
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600},
+		}, []string{"challenge_type"}),
+	}
+}
+
+func (m *managerMetrics) observeRenewal(challengeType challenge.Type, took time.Duration, err error) {
+	m.renewals.WithLabelValues(string(challengeType)).Inc()
+	m.renewalDuration.WithLabelValues(string(challengeType)).Observe(took.Seconds())
+
+	if err != nil {
+		m.renewalFailures.WithLabelValues(string(challengeType)).Inc()
+	}
+}
+
+func (m *managerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.renewals.Describe(ch)
+	m.renewalFailures.Describe(ch)
+	m.renewalDuration.Describe(ch)
+}
+
+func (m *managerMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.renewals.Collect(ch)
+	m.renewalFailures.Collect(ch)
+	m.renewalDuration.Collect(ch)
+}
+
+// metrics of renewals made by this manager instance
+func (m *Manager) MetricsCollector() prometheus.Collector {
+	return m.metrics
+}
+
+// serves MetricsCollector() (only - Go runtime metrics etc. are left to you)
+func (m *Manager) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.MetricsCollector())
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
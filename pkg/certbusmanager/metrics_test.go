@@ -0,0 +1,80 @@
+package certbusmanager
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/assert"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRenewalMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	assert.Ok(t, m.Renew(ctx, id, nil))
+
+	m.acmeClient = func(Config, challenge.Type, challenge.Provider) (AcmeClient, error) {
+		return nil, errors.New("CA is down")
+	}
+
+	assert.EqualString(t, m.Renew(ctx, id, nil).Error(), "CA is down")
+
+	// issuing a new cert is not a renewal
+	assert.Ok(t, testutil.CollectAndCompare(m.MetricsCollector(), strings.NewReader(`
+# HELP certbus_manager_renewal_failures_total Renewal attempts that didn't result in a cert
+# TYPE certbus_manager_renewal_failures_total counter
+certbus_manager_renewal_failures_total{challenge_type="http-01"} 1
+# HELP certbus_manager_renewals_total Renewal attempts
+# TYPE certbus_manager_renewals_total counter
+certbus_manager_renewals_total{challenge_type="http-01"} 2
+`),
+		"certbus_manager_renewals_total",
+		"certbus_manager_renewal_failures_total"))
+
+	assert.Assert(t, testutil.CollectAndCount(m.MetricsCollector()) == 3)
+}
+
+func TestRenewalDurationUsesManagerClock(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	// the CA takes its time
+	m.duringObtain = func() {
+		now = now.Add(90 * time.Second)
+	}
+
+	assert.Ok(t, m.Renew(ctx, id, nil))
+
+	assert.Ok(t, testutil.CollectAndCompare(m.MetricsCollector(), strings.NewReader(`
+# HELP certbus_manager_renewal_duration_seconds How long renewal attempts took (challenge propagation dominates)
+# TYPE certbus_manager_renewal_duration_seconds histogram
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="1"} 0
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="5"} 0
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="15"} 0
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="30"} 0
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="60"} 0
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="120"} 1
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="300"} 1
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="600"} 1
+certbus_manager_renewal_duration_seconds_bucket{challenge_type="http-01",le="+Inf"} 1
+certbus_manager_renewal_duration_seconds_sum{challenge_type="http-01"} 90
+certbus_manager_renewal_duration_seconds_count{challenge_type="http-01"} 1
+`),
+		"certbus_manager_renewal_duration_seconds"))
+}
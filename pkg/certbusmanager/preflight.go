@@ -0,0 +1,191 @@
+package certbusmanager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/function61/gokit/cryptorandombytes"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/miekg/dns"
+)
+
+// checks things that would make the ACME order fail, before ordering. failed validations count
+// against LetsEncrypt's rate limits, so it's better to find problems here.
+//
+// NOTE: this exercises the challenge provider for real (with a dummy token), e.g. creates and
+// deletes a TXT record.
+func preflight(
+	ctx context.Context,
+	domains []string,
+	challengeType challenge.Type,
+	dns01DelegatedTo string,
+	provider challenge.Provider,
+	caaIdentity string,
+	resolver *dnsResolver,
+	httpClient *http.Client, // for HTTP-01 self-test
+) error {
+	if dns01DelegatedTo != "" && challengeType != challenge.DNS01 {
+		return fmt.Errorf("preflight: delegation only makes sense with DNS-01; got %s", challengeType)
+	}
+
+	for _, domain := range domains {
+		if err := checkCAA(resolver, domain, caaIdentity); err != nil {
+			return fmt.Errorf("preflight: %w", err)
+		}
+	}
+
+	switch challengeType {
+	case challenge.DNS01:
+		if dns01DelegatedTo != "" {
+			if err := verifyDNS01Delegation(resolver, domains, dns01DelegatedTo); err != nil {
+				return fmt.Errorf("preflight: %w", err)
+			}
+		}
+
+		// ("*.example.com", "example.com") share the same TXT record name
+		for _, domain := range uniqueBaseDomains(domains) {
+			if err := selfTestChallenge(provider, domain, nil); err != nil {
+				return fmt.Errorf("preflight: DNS-01 zone not manageable: %w", err)
+			}
+		}
+	case challenge.HTTP01, challenge.TLSALPN01:
+		for _, domain := range domains {
+			if strings.HasPrefix(domain, "*.") {
+				return fmt.Errorf("preflight: wildcard domains are only supported with DNS-01: %s", domain)
+			}
+
+			addrs, err := resolver.LookupHost(domain)
+			if err != nil {
+				return fmt.Errorf("preflight: resolving %s: %w", domain, err)
+			}
+			if len(addrs) == 0 {
+				return fmt.Errorf("preflight: %s does not resolve", domain)
+			}
+
+			domain := domain // pin
+
+			if err := selfTestChallenge(provider, domain, func(token string, keyAuth string) error {
+				return waitForChallengePropagation(ctx, func(ctx context.Context) (bool, error) {
+					if challengeType == challenge.HTTP01 {
+						return isHTTP01ChallengeServed(ctx, httpClient, domain, token, keyAuth)
+					} else {
+						return isTLSALPN01ChallengeServed(ctx, domain, keyAuth)
+					}
+				})
+			}); err != nil {
+				return fmt.Errorf("preflight: %s self-test for %s: %w", challengeType, domain, err)
+			}
+		}
+	default:
+		return fmt.Errorf("preflight: unsupported challenge: %s", challengeType)
+	}
+
+	return nil
+}
+
+// presents a dummy challenge, checks it via "verify" (optional) and cleans it up
+func selfTestChallenge(
+	provider challenge.Provider,
+	domain string,
+	verify func(token string, keyAuth string) error,
+) error {
+	token := "certbus-preflight-" + cryptorandombytes.Base64UrlWithoutLeadingDash(8)
+	keyAuth := token + ".preflight"
+
+	if err := provider.Present(domain, token, keyAuth); err != nil {
+		return err
+	}
+
+	var verifyErr error
+	if verify != nil {
+		verifyErr = verify(token, keyAuth)
+	}
+
+	if err := provider.CleanUp(domain, token, keyAuth); err != nil {
+		return err
+	}
+
+	return verifyErr
+}
+
+// checks that CAA records (if any) allow our CA to issue for the domain (RFC 8659).
+// the relevant CAA record set is the one found closest to the domain when climbing up the tree.
+func checkCAA(resolver *dnsResolver, domain string, caaIdentity string) error {
+	wildcard := strings.HasPrefix(domain, "*.")
+
+	for name := strings.TrimPrefix(domain, "*."); name != ""; name = parentDomain(name) {
+		records, err := resolver.LookupCAA(name)
+		if err != nil {
+			return fmt.Errorf("checkCAA: %s: %w", name, err)
+		}
+
+		if len(records) == 0 {
+			continue
+		}
+
+		issue := caaRecordsByTag(records, "issue")
+		issuewild := caaRecordsByTag(records, "issuewild")
+
+		relevant := issue
+		if wildcard && len(issuewild) > 0 {
+			relevant = issuewild
+		}
+
+		if len(relevant) == 0 { // e.g. only "iodef" records => no restrictions
+			return nil
+		}
+
+		for _, record := range relevant {
+			// "letsencrypt.org; validationmethods=dns-01" => "letsencrypt.org"
+			issuer := strings.TrimSpace(strings.Split(record.Value, ";")[0])
+
+			if strings.EqualFold(issuer, caaIdentity) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("CAA records at %s don't allow %s to issue for %s", name, caaIdentity, domain)
+	}
+
+	return nil // no CAA records => anyone can issue
+}
+
+func caaRecordsByTag(records []*dns.CAA, tag string) []*dns.CAA {
+	matching := []*dns.CAA{}
+	for _, record := range records {
+		if strings.EqualFold(record.Tag, tag) {
+			matching = append(matching, record)
+		}
+	}
+
+	return matching
+}
+
+// "www.example.com" => "example.com"
+// "com" => ""
+func parentDomain(domain string) string {
+	dotIdx := strings.Index(domain, ".")
+	if dotIdx == -1 {
+		return ""
+	}
+
+	return domain[dotIdx+1:]
+}
+
+// ("*.example.com", "example.com", "www.example.com") => ("example.com", "www.example.com")
+func uniqueBaseDomains(domains []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+
+	for _, domain := range domains {
+		base := strings.TrimPrefix(domain, "*.")
+		if !seen[base] {
+			seen[base] = true
+			unique = append(unique, base)
+		}
+	}
+
+	return unique
+}
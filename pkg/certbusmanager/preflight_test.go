@@ -0,0 +1,175 @@
+package certbusmanager
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/function61/gokit/assert"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/miekg/dns"
+)
+
+func TestCheckCAA(t *testing.T) {
+	resolver := startTestDNSServer(t,
+		`example.com. 300 IN CAA 0 issue "letsencrypt.org"`,
+		`example.com. 300 IN CAA 0 issuewild ";"`,
+		`other.com. 300 IN CAA 0 issue "digicert.com; cansignhttpexchanges=yes"`,
+		`sub.other.com. 300 IN CAA 0 issue "letsencrypt.org; validationmethods=dns-01"`,
+		`reporting.net. 300 IN CAA 0 iodef "mailto:security@reporting.net"`,
+	)
+
+	checkCAA := func(domain string) string {
+		if err := checkCAA(resolver, domain, "letsencrypt.org"); err != nil {
+			return err.Error()
+		}
+
+		return "ok"
+	}
+
+	assert.EqualString(t, checkCAA("example.com"), "ok")
+	assert.EqualString(t, checkCAA("www.example.com"), "ok") // inherited from parent
+	assert.EqualString(t, checkCAA("*.example.com"), "CAA records at example.com don't allow letsencrypt.org to issue for *.example.com")
+	assert.EqualString(t, checkCAA("other.com"), "CAA records at other.com don't allow letsencrypt.org to issue for other.com")
+	assert.EqualString(t, checkCAA("sub.other.com"), "ok") // closest record set wins
+	assert.EqualString(t, checkCAA("reporting.net"), "ok")
+	assert.EqualString(t, checkCAA("no-caa.org"), "ok")
+}
+
+func TestPreflightDNS01Delegation(t *testing.T) {
+	resolver := startTestDNSServer(t,
+		`_acme-challenge.customer.com. 300 IN CNAME _acme-challenge.customer.com.acme.example.net.`,
+		`_acme-challenge.www.wrong.com. 300 IN CNAME somewhere.else.net.`,
+	)
+
+	recording := &recordingChallengeProvider{}
+	// like in real usage
+	provider := &delegatedDNS01Provider{recording, "acme.example.net"}
+
+	preflightDelegated := func(domains ...string) string {
+		if err := preflight(
+			context.Background(),
+			domains,
+			challenge.DNS01,
+			"acme.example.net",
+			provider,
+			"letsencrypt.org",
+			resolver,
+			http.DefaultClient,
+		); err != nil {
+			return err.Error()
+		}
+
+		return "ok"
+	}
+
+	assert.EqualString(t, preflightDelegated("*.customer.com", "customer.com"), "ok")
+	// self-test TXT record was written once for both (they share a record), via delegation
+	assert.EqualString(t, strings.Join(recording.log, ", "), "present customer.com.acme.example.net, cleanup customer.com.acme.example.net")
+
+	assert.EqualString(
+		t,
+		preflightDelegated("www.wrong.com"),
+		"preflight: verifyDNS01Delegation: expecting _acme-challenge.www.wrong.com. CNAME _acme-challenge.www.wrong.com.acme.example.net.; got 'somewhere.else.net.'")
+
+	assert.EqualString(
+		t,
+		preflightDelegated("missing.com"),
+		"preflight: verifyDNS01Delegation: expecting _acme-challenge.missing.com. CNAME _acme-challenge.missing.com.acme.example.net.; got ''")
+}
+
+func TestPreflightHTTP01DomainMustResolve(t *testing.T) {
+	resolver := startTestDNSServer(t)
+
+	err := preflight(
+		context.Background(),
+		[]string{"unresolvable.com"},
+		challenge.HTTP01,
+		"",
+		&recordingChallengeProvider{},
+		"letsencrypt.org",
+		resolver,
+		http.DefaultClient)
+	assert.EqualString(t, err.Error(), "preflight: unresolvable.com does not resolve")
+
+	err = preflight(
+		context.Background(),
+		[]string{"*.example.com"},
+		challenge.HTTP01,
+		"",
+		&recordingChallengeProvider{},
+		"letsencrypt.org",
+		resolver,
+		http.DefaultClient)
+	assert.EqualString(t, err.Error(), "preflight: wildcard domains are only supported with DNS-01: *.example.com")
+}
+
+type recordingChallengeProvider struct {
+	log []string
+}
+
+func (r *recordingChallengeProvider) Present(domain string, token string, keyAuth string) error {
+	r.log = append(r.log, "present "+domain)
+	return nil
+}
+
+func (r *recordingChallengeProvider) CleanUp(domain string, token string, keyAuth string) error {
+	r.log = append(r.log, "cleanup "+domain)
+	return nil
+}
+
+// local DNS stand-in that answers from given records (in zone file format)
+func startTestDNSServer(t *testing.T, records ...string) *dnsResolver {
+	t.Helper()
+
+	rrs := []dns.RR{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		assert.Ok(t, err)
+
+		rrs = append(rrs, rr)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Ok(t, err)
+
+	started := make(chan interface{})
+
+	server := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := &dns.Msg{}
+			resp.SetReply(req)
+
+			question := req.Question[0]
+
+			for _, rr := range rrs {
+				if !strings.EqualFold(rr.Header().Name, question.Name) {
+					continue
+				}
+
+				// CNAMEs are returned for any query type, like real resolvers do
+				if rr.Header().Rrtype == question.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+					resp.Answer = append(resp.Answer, rr)
+				}
+			}
+
+			_ = w.WriteMsg(resp)
+		}),
+	}
+
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+
+	<-started
+
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	return newDNSResolver(conn.LocalAddr().String())
+}
@@ -0,0 +1,139 @@
+package certbusmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var errRevocationStatusUnknown = errors.New("cert has neither OCSP nor CRL URLs - cannot determine revocation status")
+
+// asks the CA (via OCSP, or CRL if no OCSP) whether the bundle's leaf cert has been revoked
+func checkNotRevoked(ctx context.Context, pemBundle string) error {
+	leaf, issuer, err := parseLeafAndIssuer(pemBundle)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	switch {
+	case len(leaf.OCSPServer) > 0:
+		return checkNotRevokedOCSP(ctx, leaf, issuer)
+	case len(leaf.CRLDistributionPoints) > 0:
+		return checkNotRevokedCRL(ctx, leaf, issuer)
+	default:
+		return errRevocationStatusUnknown
+	}
+}
+
+func checkNotRevokedOCSP(ctx context.Context, leaf *x509.Certificate, issuer *x509.Certificate) error {
+	ocspRequest, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(ocspRequest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	body, err := fetch(req)
+	if err != nil {
+		return fmt.Errorf("OCSP: %w", err)
+	}
+
+	ocspResponse, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("OCSP: %w", err)
+	}
+
+	switch ocspResponse.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("cert revoked at %s", ocspResponse.RevokedAt.Format(time.RFC3339))
+	default:
+		return errors.New("OCSP: CA doesn't know the cert's status")
+	}
+}
+
+func checkNotRevokedCRL(ctx context.Context, leaf *x509.Certificate, issuer *x509.Certificate) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, leaf.CRLDistributionPoints[0], nil)
+	if err != nil {
+		return err
+	}
+
+	body, err := fetch(req)
+	if err != nil {
+		return fmt.Errorf("CRL: %w", err)
+	}
+
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return fmt.Errorf("CRL: %w", err)
+	}
+
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("CRL: %w", err)
+	}
+
+	for _, revoked := range crl.RevokedCertificateEntries {
+		if revoked.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return fmt.Errorf("cert revoked at %s", revoked.RevocationTime.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+func fetch(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// bundle = leaf first, then its issuer
+func parseLeafAndIssuer(pemBundle string) (*x509.Certificate, *x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+
+	rest := []byte(pemBundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) < 2 {
+		return nil, nil, errors.New("bundle must contain leaf and its issuer")
+	}
+
+	return certs[0], certs[1], nil
+}
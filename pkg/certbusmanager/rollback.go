@@ -0,0 +1,73 @@
+package certbusmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+)
+
+// puts back the cert that was active before the current one (e.g. renewal produced a broken chain)
+func (m *Manager) Rollback(ctx context.Context, id string, checkRevocation bool) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	if certs.ById(id) == nil {
+		return fmt.Errorf("cert not found: %s", id)
+	}
+
+	previous := certs.PreviousVersion(id)
+	if previous == nil {
+		return fmt.Errorf("no previous cert to roll back to: %s", id)
+	}
+
+	if err := rollbackTargetUsable(ctx, *previous, checkRevocation, m.now()); err != nil {
+		return fmt.Errorf("refusing to roll back: %w", err)
+	}
+
+	return m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		// what we decided to roll back from must still be what's active
+		cert := current.ById(id)
+		if cert == nil || cert.Certificate.CertPemBundle != certs.ById(id).Certificate.CertPemBundle {
+			return nil, fmt.Errorf("cert %s changed concurrently - refusing to roll back", id)
+		}
+
+		return []ehevent.Event{cbdomain.NewCertificateRolledBack(
+			previous.Id,
+			previous.Domains,
+			previous.Certificate.NotAfter,
+			previous.Certificate.CertPemBundle,
+			previous.Certificate.PrivateKeyEncrypted.KeyFingerprint,
+			previous.Certificate.PrivateKeyEncrypted.Ciphertext,
+			previous.ChallengeType,
+			previous.DNS01DelegatedTo,
+			m.meta())}, nil
+	})
+}
+
+func rollbackTargetUsable(
+	ctx context.Context,
+	previous certificatestore.ManagedCertificate,
+	checkRevocation bool,
+	now time.Time,
+) error {
+	leaf, _, err := parseLeafAndIssuer(previous.Certificate.CertPemBundle)
+	if err != nil {
+		return err
+	}
+
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("previous cert expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	if !checkRevocation {
+		return nil
+	}
+
+	return checkNotRevoked(ctx, previous.Certificate.CertPemBundle)
+}
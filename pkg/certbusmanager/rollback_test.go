@@ -0,0 +1,208 @@
+package certbusmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/gokit/assert"
+	"github.com/go-acme/lego/v4/challenge"
+	"golang.org/x/crypto/ocsp"
+)
+
+var rollbackNow = time.Date(2020, 5, 15, 12, 0, 0, 0, time.UTC)
+
+func TestRollbackIsNotUndoneByRenewDue(t *testing.T) {
+	ctx := context.Background()
+
+	m := newTestManager(t)
+
+	id, err := m.Issue(ctx, []string{"example.com"}, challenge.HTTP01, "", "", "")
+	assert.Ok(t, err)
+
+	// renewal (that turns out to be broken) 75 days in, i.e. 15 days before expiry
+	later := m.anotherManager(func() time.Time { return time.Now().AddDate(0, 0, 75) })
+	assert.Ok(t, later.RenewDue(ctx, time.Now().AddDate(0, 0, 75)))
+	assert.Assert(t, m.issued == 2)
+
+	assert.Ok(t, later.Rollback(ctx, id, false))
+
+	// the broken one is no longer a rollback target
+	assert.EqualString(t, later.Rollback(ctx, id, false).Error(), "no previous cert to roll back to: "+id)
+
+	assert.Ok(t, later.RenewDue(ctx, time.Now().AddDate(0, 0, 76)))
+	assert.Assert(t, m.issued == 2)
+
+	// a week after rollback
+	assert.Ok(t, later.RenewDue(ctx, time.Now().AddDate(0, 0, 83)))
+	assert.Assert(t, m.issued == 3)
+}
+
+func TestRollbackTargetUsable(t *testing.T) {
+	ca := newTestCA(t)
+
+	revokedSerial := big.NewInt(666)
+
+	// answers both OCSP and CRL for our test CA
+	revocationServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/crl":
+			crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+				Number:     big.NewInt(1),
+				ThisUpdate: rollbackNow,
+				NextUpdate: rollbackNow.Add(time.Hour),
+				RevokedCertificateEntries: []x509.RevocationListEntry{
+					{SerialNumber: revokedSerial, RevocationTime: rollbackNow.Add(-time.Hour)},
+				},
+			}, ca.cert, ca.key)
+			assert.Ok(t, err)
+
+			_, _ = w.Write(crl)
+		case "/ocsp":
+			body, err := ioutil.ReadAll(r.Body)
+			assert.Ok(t, err)
+
+			req, err := ocsp.ParseRequest(body)
+			assert.Ok(t, err)
+
+			status := ocsp.Good
+			if req.SerialNumber.Cmp(revokedSerial) == 0 {
+				status = ocsp.Revoked
+			}
+
+			resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+				Status:       status,
+				SerialNumber: req.SerialNumber,
+				ThisUpdate:   time.Now(),
+				RevokedAt:    rollbackNow.Add(-time.Hour),
+			}, ca.key)
+			assert.Ok(t, err)
+
+			_, _ = w.Write(resp)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer revocationServer.Close()
+
+	usable := func(cert certificatestore.ManagedCertificate, checkRevocation bool) string {
+		if err := rollbackTargetUsable(context.Background(), cert, checkRevocation, rollbackNow); err != nil {
+			return err.Error()
+		}
+
+		return "ok"
+	}
+
+	withOCSP := func(leaf *x509.Certificate) { leaf.OCSPServer = []string{revocationServer.URL + "/ocsp"} }
+	withCRL := func(leaf *x509.Certificate) { leaf.CRLDistributionPoints = []string{revocationServer.URL + "/crl"} }
+
+	assert.EqualString(t, usable(ca.issue(t, 1, rollbackNow.Add(time.Hour), withOCSP), true), "ok")
+	assert.EqualString(t, usable(ca.issue(t, 666, rollbackNow.Add(time.Hour), withOCSP), true), "cert revoked at 2020-05-15T11:00:00Z")
+	assert.EqualString(t, usable(ca.issue(t, 1, rollbackNow.Add(time.Hour), withCRL), true), "ok")
+	assert.EqualString(t, usable(ca.issue(t, 666, rollbackNow.Add(time.Hour), withCRL), true), "cert revoked at 2020-05-15T11:00:00Z")
+
+	assert.EqualString(t, usable(ca.issue(t, 1, rollbackNow.Add(time.Hour)), true), errRevocationStatusUnknown.Error())
+	assert.EqualString(t, usable(ca.issue(t, 1, rollbackNow.Add(time.Hour)), false), "ok")
+
+	assert.EqualString(t, usable(ca.issue(t, 1, rollbackNow.Add(-time.Hour), withOCSP), true), "previous cert expired at 2020-05-15T11:00:00Z")
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CertBus test CA"},
+		NotBefore:             rollbackNow.AddDate(-1, 0, 0),
+		NotAfter:              rollbackNow.AddDate(1, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Ok(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Ok(t, err)
+
+	return &testCA{cert, key}
+}
+
+// returns managed cert whose bundle has leaf + CA
+func (c *testCA) issue(
+	t *testing.T,
+	serial int64,
+	notAfter time.Time,
+	customizations ...func(*x509.Certificate),
+) certificatestore.ManagedCertificate {
+	t.Helper()
+
+	bundle, _ := c.issueKeypair(t, serial, notAfter, customizations...)
+
+	return certificatestore.ManagedCertificate{
+		Id:      "dummyCertId",
+		Domains: []string{"example.com"},
+		Certificate: certificatestore.CertDetails{
+			NotAfter:      notAfter,
+			CertPemBundle: string(bundle),
+		},
+	}
+}
+
+// returns PEM bundle (leaf + CA) and leaf's private key PEM
+func (c *testCA) issueKeypair(
+	t *testing.T,
+	serial int64,
+	notAfter time.Time,
+	customizations ...func(*x509.Certificate),
+) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Ok(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    rollbackNow.AddDate(0, -2, 0),
+		NotAfter:     notAfter,
+	}
+
+	for _, customize := range customizations {
+		customize(template)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	assert.Ok(t, err)
+
+	bundle := append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Ok(t, err)
+
+	return bundle, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
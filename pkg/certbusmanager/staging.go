@@ -0,0 +1,65 @@
+package certbusmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/certbus/pkg/certificatestore"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+)
+
+// obtained cert is served only by canaries until activated. nil = takes effect immediately
+type Staging struct {
+	ActivateAfter time.Duration // 0 = manual activation
+}
+
+// zero = manual activation (or not staged at all)
+func (s *Staging) activateAt(now time.Time) time.Time {
+	if s == nil || s.ActivateAfter == 0 {
+		return time.Time{}
+	}
+
+	return now.Add(s.ActivateAfter)
+}
+
+func (m *Manager) Activate(ctx context.Context, id string) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	if certs.StagedById(id) == nil {
+		return fmt.Errorf("staged cert not found: %s", id)
+	}
+
+	return m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		if current.StagedById(id) == nil { // someone else activated it already
+			return nil, nil
+		}
+
+		return []ehevent.Event{cbdomain.NewCertificateActivated(
+			id,
+			m.meta())}, nil
+	})
+}
+
+// activates staged certs whose activation time has come
+func (m *Manager) ActivateDue(ctx context.Context) error {
+	certs, err := m.State(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.write(ctx, certs, func(current *certificatestore.Store) ([]ehevent.Event, error) {
+		activations := []ehevent.Event{}
+		for _, cert := range certificatestore.StagedCertsDueForActivation(current, m.now()) {
+			activations = append(activations, cbdomain.NewCertificateActivated(
+				cert.Id,
+				m.meta()))
+		}
+
+		return activations, nil
+	})
+}
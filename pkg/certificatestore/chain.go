@@ -0,0 +1,51 @@
+package certificatestore
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+// one cert of a managed cert's chain
+type ChainCert struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// cert chain as we serve it, leaf first. the last one's issuer is the root the chain leads to
+func Chain(cert ManagedCertificate) ([]ChainCert, error) {
+	chain := []ChainCert{}
+
+	rest := []byte(cert.Certificate.CertPemBundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		parsed, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, ChainCert{
+			Subject:  parsed.Subject.CommonName,
+			Issuer:   parsed.Issuer.CommonName,
+			NotAfter: parsed.NotAfter,
+		})
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("no certificates in bundle")
+	}
+
+	return chain, nil
+}
+
+// issuer CN of chain's top cert (= what lego's PreferredChain matches against)
+func ChainRoot(chain []ChainCert) string {
+	return chain[len(chain)-1].Issuer
+}
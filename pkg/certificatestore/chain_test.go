@@ -0,0 +1,25 @@
+package certificatestore
+
+import (
+	"testing"
+
+	"github.com/function61/gokit/assert"
+)
+
+func TestChain(t *testing.T) {
+	chain, err := Chain(ManagedCertificate{
+		Certificate: CertDetails{
+			CertPemBundle: exampleCert + "\n" + exampleRootCa,
+		},
+	})
+	assert.Ok(t, err)
+
+	assert.Assert(t, len(chain) == 2)
+	assert.EqualString(t, chain[0].Subject, "prod4.fn61.net")
+	assert.EqualString(t, chain[0].Issuer, "CertBus test root CA")
+	assert.EqualString(t, chain[1].Subject, "CertBus test root CA")
+	assert.EqualString(t, ChainRoot(chain), "CertBus test root CA")
+
+	_, err = Chain(ManagedCertificate{})
+	assert.EqualString(t, err.Error(), "no certificates in bundle")
+}
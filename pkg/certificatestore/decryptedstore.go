@@ -1,9 +1,15 @@
 package certificatestore
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/gokit/cryptoutil"
@@ -18,12 +24,52 @@ type VersionedByHostnameFinder interface {
 	Version() ehclient.Cursor
 }
 
+// returned when we found a cert for the hostname, but the cert is not fit for serving
+type CertificateValidationError struct {
+	CertId string
+	Err    error
+}
+
+func (c *CertificateValidationError) Error() string {
+	return fmt.Sprintf("certificate %s failed validation: %v", c.CertId, c.Err)
+}
+
+func (c *CertificateValidationError) Unwrap() error {
+	return c.Err
+}
+
+// for certs issued from a CSR (see ManagedCertificate.CSR) CertBus doesn't have the private key.
+// return the cert's private key (can be HSM-backed), or nil if this consumer doesn't have it
+type KeyLocator func(cert ManagedCertificate) (crypto.Signer, error)
+
+// counters since creation of the store
+type DecryptedStoreStats struct {
+	CacheHits        uint64
+	CacheMisses      uint64
+	DecryptErrors    uint64 // private key decryption or cert parsing failed
+	ValidationErrors uint64 // see CertificateValidationError
+}
+
+// validation failures are cached too (a bad cert would otherwise cost a decrypt & chain
+// verification on each handshake), but re-checked now and then as the verdict can depend on time
+const invalidCertRecheckAfter = 1 * time.Minute
+
+type invalidCert struct {
+	err       *CertificateValidationError
+	checkedAt time.Time
+}
+
 type DecryptedStore struct {
 	encryptedStore VersionedByHostnameFinder
 	cache          map[string]*tls.Certificate
+	invalid        map[string]invalidCert // keyed by cert id. discarded along with cache
 	cacheVersion   ehclient.Cursor
 	key            *rsa.PrivateKey
 	keyFingerprint string
+	keyLocator     KeyLocator       // nil = CSR-issued certs are not served
+	roots          *x509.CertPool   // nil = use system roots
+	now            func() time.Time // for testability
+	stats          DecryptedStoreStats
 	mu             sync.Mutex
 }
 
@@ -42,13 +88,16 @@ func NewDecryptedStore(est VersionedByHostnameFinder, privateKey string) (*Decry
 	return &DecryptedStore{
 		encryptedStore: est,
 		cache:          map[string]*tls.Certificate{},
+		invalid:        map[string]invalidCert{},
 		cacheVersion:   est.Version(),
 		key:            privKey,
 		keyFingerprint: fingerprint,
+		now:            time.Now,
 	}, nil
 }
 
 // NOTE: cert can be nil even if error nil
+// returns *CertificateValidationError if cert was found but it is not fit for serving
 func (d *DecryptedStore) ByHostname(hostname string) (*tls.Certificate, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -58,38 +107,223 @@ func (d *DecryptedStore) ByHostname(hostname string) (*tls.Certificate, error) {
 		// discard all cache.
 		// (not expecting cert changes so frequent as to have an overall effect)
 		d.cache = map[string]*tls.Certificate{}
+		d.invalid = map[string]invalidCert{}
+		d.cacheVersion = d.encryptedStore.Version()
 	}
 
 	cached, found := d.cache[hostname]
-	if !found {
-		managedCert := d.encryptedStore.ByHostname(hostname)
-		if managedCert == nil {
-			return nil, nil
-		}
+	if found {
+		d.stats.CacheHits++
+		return cached, nil
+	}
+
+	d.stats.CacheMisses++
+
+	managedCert := d.encryptedStore.ByHostname(hostname)
+	if managedCert == nil {
+		return nil, nil
+	}
+
+	now := d.now()
+
+	// (keyed by cert id, so this also covers hostnames served by a wildcard)
+	if invalid, found := d.invalid[managedCert.Id]; found && !now.Before(invalid.checkedAt) && now.Sub(invalid.checkedAt) < invalidCertRecheckAfter {
+		d.stats.ValidationErrors++
+		return nil, invalid.err
+	}
+
+	keypair, err := d.keypair(*managedCert)
+	if err != nil {
+		d.stats.DecryptErrors++
+		return nil, err
+	}
+	if keypair == nil { // private key not available to us
+		return nil, nil
+	}
+
+	// pre-parse so TLS stack (and our validation) doesn't have to parse it on each handshake
+	keypair.Leaf, err = x509.ParseCertificate(keypair.Certificate[0])
+	if err != nil {
+		d.stats.DecryptErrors++
+		return nil, err
+	}
+
+	// imported certs can chain to roots we don't know (internal PKI). the importer vouched for them
+	verifyChain := managedCert.ChallengeType != ChallengeTypeImported
+
+	if err := validateCertificate(keypair, managedCert.Domains, d.roots, verifyChain, now); err != nil {
+		d.stats.ValidationErrors++
+
+		validationErr := &CertificateValidationError{managedCert.Id, err}
+		d.invalid[managedCert.Id] = invalidCert{validationErr, now}
+
+		return nil, validationErr
+	}
+
+	cached = keypair
+
+	// sprinkle cache entries for all aliases so for ("*.example.com", "example.com") cert
+	// we won't end up polluting cache with a.example.com, b.example.com, c.example.com, ..
+	for _, domain := range managedCert.Domains {
+		d.cache[domain] = cached
+	}
+
+	return cached, nil
+}
+
+// set before you start serving
+func (d *DecryptedStore) SetKeyLocator(keyLocator KeyLocator) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.keyLocator = keyLocator
+}
+
+// set before you start serving. needed only if your CA is not in system roots (e.g. internal ACME CA)
+func (d *DecryptedStore) SetRoots(roots *x509.CertPool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.roots = roots
+	d.invalid = map[string]invalidCert{} // verdicts might change
+}
+
+// returns nil if private key is not available to us
+func (d *DecryptedStore) keypair(managedCert ManagedCertificate) (*tls.Certificate, error) {
+	if managedCert.CSR != "" {
+		return d.keypairWithLocatedKey(managedCert)
+	}
 
-		// our private key cannot decrypt this?
-		if d.keyFingerprint != managedCert.Certificate.PrivateKeyEncrypted.KeyFingerprint {
-			return nil, nil
+	// our private key cannot decrypt this?
+	if d.keyFingerprint != managedCert.Certificate.PrivateKeyEncrypted.KeyFingerprint {
+		return nil, nil
+	}
+
+	certKey, err := managedCert.Certificate.PrivateKeyEncrypted.Decrypt(d.key, d.keyFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	keypair, err := tls.X509KeyPair([]byte(managedCert.Certificate.CertPemBundle), certKey)
+	if err != nil { // also checks that private key matches the cert
+		return nil, err
+	}
+
+	return &keypair, nil
+}
+
+func (d *DecryptedStore) keypairWithLocatedKey(managedCert ManagedCertificate) (*tls.Certificate, error) {
+	if d.keyLocator == nil {
+		return nil, nil
+	}
+
+	key, err := d.keyLocator(managedCert)
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	keypair := &tls.Certificate{PrivateKey: key}
+
+	rest := []byte(managedCert.Certificate.CertPemBundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
 		}
 
-		certKey, err := managedCert.Certificate.PrivateKeyEncrypted.Decrypt(d.key, d.keyFingerprint)
-		if err != nil {
-			return nil, err
+		keypair.Certificate = append(keypair.Certificate, block.Bytes)
+	}
+
+	if len(keypair.Certificate) == 0 {
+		return nil, errors.New("no certificates in bundle")
+	}
+
+	leaf, err := x509.ParseCertificate(keypair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// tls.X509KeyPair() does this check for the decrypted keys
+	publicKey, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(leaf.PublicKey) {
+		return nil, errors.New("located private key does not match cert")
+	}
+
+	return keypair, nil
+}
+
+// false if the cert's private key is encrypted for some other consumer's key (or it's a CSR-issued
+// cert whose key we'd need a KeyLocator for)
+func (d *DecryptedStore) Decryptable(managedCert ManagedCertificate) bool {
+	if managedCert.CSR != "" {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		return d.keyLocator != nil
+	}
+
+	return managedCert.Certificate.PrivateKeyEncrypted != nil &&
+		managedCert.Certificate.PrivateKeyEncrypted.KeyFingerprint == d.keyFingerprint
+}
+
+func (d *DecryptedStore) Stats() DecryptedStoreStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.stats
+}
+
+// validates that a cert (with .Leaf populated) is something we can serve to clients at "now"
+func validateCertificate(
+	keypair *tls.Certificate,
+	domains []string,
+	roots *x509.CertPool,
+	verifyChain bool,
+	now time.Time,
+) error {
+	leaf := keypair.Leaf
+
+	// Verify() would also catch these, but we want more specific errors for the common cases
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	if len(domains) == 0 {
+		return errors.New("no domains")
+	}
+
+	for _, domain := range domains {
+		if err := leaf.VerifyHostname(domain); err != nil {
+			return fmt.Errorf("SANs don't cover domain %s: %w", domain, err)
 		}
+	}
+
+	if !verifyChain {
+		return nil
+	}
 
-		keypair, err := tls.X509KeyPair([]byte(managedCert.Certificate.CertPemBundle), certKey)
+	intermediates := x509.NewCertPool()
+	for _, intermediateDer := range keypair.Certificate[1:] {
+		intermediate, err := x509.ParseCertificate(intermediateDer)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("parsing intermediate: %w", err)
 		}
 
-		cached = &keypair
+		intermediates.AddCert(intermediate)
+	}
 
-		// sprinkle cache entries for all aliases so for ("*.example.com", "example.com") cert
-		// we won't end up polluting cache with a.example.com, b.example.com, c.example.com, ..
-		for _, domain := range managedCert.Domains {
-			d.cache[domain] = cached
-		}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return fmt.Errorf("chain: %w", err)
 	}
 
-	return cached, nil
+	return nil
 }
@@ -1,7 +1,12 @@
 package certificatestore
 
 import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/function61/certbus/pkg/cbdomain"
 	"github.com/function61/eventhorizon/pkg/ehevent"
@@ -18,8 +23,7 @@ func TestDecryptedStore(t *testing.T) {
 	assert.Assert(t, byHostnameCalls.calls == 0)
 
 	// this provides access to encrypted private keys in "certs" with our decryption key
-	decryptedStore, err := NewDecryptedStore(byHostnameCalls, exampleCertsKek)
-	assert.Ok(t, err)
+	decryptedStore := newDecryptedStoreTrustingExampleRoot(t, byHostnameCalls, exampleCertsKek)
 
 	cert, err := DecryptedByHostnameSupportingWildcard("prod4.fn61.net", decryptedStore)
 	assert.Ok(t, err)
@@ -67,15 +71,144 @@ func TestDecryptedStore(t *testing.T) {
 	assert.Assert(t, cert == nil)
 
 	assert.Assert(t, byHostnameCalls.calls == 6)
+
+	stats := decryptedStore.Stats()
+	assert.Assert(t, stats.CacheHits == 4)
+	assert.Assert(t, stats.CacheMisses == 6)
 }
 
-func TestDecryptedStoreWithWrongKek(t *testing.T) {
+func TestDecryptedStorePopulatesLeaf(t *testing.T) {
 	certs, _ := setupCommon(t)
 
-	withCorrectKek, err := NewDecryptedStore(certs, exampleCertsKek)
+	decryptedStore := newDecryptedStoreTrustingExampleRoot(t, certs, exampleCertsKek)
+
+	cert, err := decryptedStore.ByHostname("prod4.fn61.net")
 	assert.Ok(t, err)
-	withWrongKek, err := NewDecryptedStore(certs, unrelatedKek)
+	assert.EqualString(t, cert.Leaf.Subject.CommonName, "prod4.fn61.net")
+}
+
+func TestDecryptedStoreValidation(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	lookup := func(store *DecryptedStore) string {
+		_, err := store.ByHostname("prod4.fn61.net")
+		if err == nil {
+			return "ok"
+		}
+
+		var validationErr *CertificateValidationError
+		assert.Assert(t, errors.As(err, &validationErr))
+		assert.EqualString(t, validationErr.CertId, "dummyCertId")
+
+		return err.Error()
+	}
+
+	// chain doesn't verify with system roots
+	untrusting, err := NewDecryptedStore(certs, exampleCertsKek)
 	assert.Ok(t, err)
+	assert.Assert(t, strings.Contains(lookup(untrusting), "certificate dummyCertId failed validation: chain: x509: certificate signed by unknown authority"))
+	assert.Assert(t, untrusting.Stats().ValidationErrors == 1)
+
+	trusting := newDecryptedStoreTrustingExampleRoot(t, certs, exampleCertsKek)
+
+	trusting.now = func() time.Time { return time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC) }
+	assert.EqualString(t, lookup(trusting), "certificate dummyCertId failed validation: not valid before 2020-01-01T00:00:00Z")
+
+	trusting.now = func() time.Time { return time.Date(2051, 1, 1, 0, 0, 0, 0, time.UTC) }
+	assert.EqualString(t, lookup(trusting), "certificate dummyCertId failed validation: expired at 2050-01-01T00:00:00Z")
+
+	trusting.now = func() time.Time { return t0 }
+	assert.EqualString(t, lookup(trusting), "ok")
+
+	// cert claims domain that its SANs don't cover
+	pumpEvents(t, certs, cbdomain.NewCertificateObtained(
+		"dummyCertId",
+		"renewal",
+		[]string{"prod4.fn61.net", "example.com"},
+		t0.AddDate(0, 0, 21),
+		exampleCert,
+		"SHA256:wupoCrsM0GYWNWLwcBEDZZSe4ToLaxcuCWAgOiTsFCA",
+		certs.ById("dummyCertId").Certificate.PrivateKeyEncrypted.Ciphertext,
+		"dummyChallengeType",
+		"",
+		"",
+		"",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0)))
+
+	assert.EqualString(t, lookup(trusting), "certificate dummyCertId failed validation: SANs don't cover domain example.com: x509: certificate is valid for *.prod4.fn61.net, prod4.fn61.net, not example.com")
+
+	// failure is cached (no decrypt & validation on each handshake), but re-checked after a while
+	_, errFirst := trusting.ByHostname("prod4.fn61.net")
+	_, errCached := trusting.ByHostname("prod4.fn61.net")
+	assert.Assert(t, errCached == errFirst)
+
+	trusting.now = func() time.Time { return t0.Add(invalidCertRecheckAfter) }
+	_, errRechecked := trusting.ByHostname("prod4.fn61.net")
+	assert.Assert(t, errRechecked != errFirst)
+	assert.EqualString(t, errRechecked.Error(), errFirst.Error())
+
+	// imported certs may chain to roots we don't know (internal PKI), but other validations still apply
+	pumpEvents(t, certs, cbdomain.NewCertificateObtained(
+		"dummyCertId",
+		"import",
+		[]string{"prod4.fn61.net"},
+		t0.AddDate(0, 0, 21),
+		exampleCert,
+		"SHA256:wupoCrsM0GYWNWLwcBEDZZSe4ToLaxcuCWAgOiTsFCA",
+		certs.ById("dummyCertId").Certificate.PrivateKeyEncrypted.Ciphertext,
+		ChallengeTypeImported,
+		"",
+		"",
+		"",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0)))
+
+	untrusting.now = func() time.Time { return t0 }
+	assert.EqualString(t, lookup(untrusting), "ok")
+
+	pumpEvents(t, certs, cbdomain.NewCertificateObtained(
+		"dummyCertId",
+		"import",
+		[]string{"prod4.fn61.net", "example.com"},
+		t0.AddDate(0, 0, 21),
+		exampleCert,
+		"SHA256:wupoCrsM0GYWNWLwcBEDZZSe4ToLaxcuCWAgOiTsFCA",
+		certs.ById("dummyCertId").Certificate.PrivateKeyEncrypted.Ciphertext,
+		ChallengeTypeImported,
+		"",
+		"",
+		"",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0)))
+
+	assert.EqualString(t, lookup(untrusting), "certificate dummyCertId failed validation: SANs don't cover domain example.com: x509: certificate is valid for *.prod4.fn61.net, prod4.fn61.net, not example.com")
+}
+
+func newDecryptedStoreTrustingExampleRoot(
+	t *testing.T,
+	est VersionedByHostnameFinder,
+	kek string,
+) *DecryptedStore {
+	t.Helper()
+
+	store, err := NewDecryptedStore(est, kek)
+	assert.Ok(t, err)
+
+	store.roots = x509.NewCertPool()
+	assert.Assert(t, store.roots.AppendCertsFromPEM([]byte(exampleRootCa)))
+
+	return store
+}
+
+func TestDecryptedStoreWithWrongKek(t *testing.T) {
+	certs, _ := setupCommon(t)
+
+	withCorrectKek := newDecryptedStoreTrustingExampleRoot(t, certs, exampleCertsKek)
+	withWrongKek := newDecryptedStoreTrustingExampleRoot(t, certs, unrelatedKek)
 
 	canDecryptCertPrivateKey := func(store *DecryptedStore) bool {
 		cert, err := DecryptedByHostnameSupportingWildcard("foobar.prod4.fn61.net", store)
@@ -156,3 +289,71 @@ ZVqP5LHLvBXk5W0enr/eZuPdMOpaAF4yZ1tepkIEmbsOSiFvthzwwmxJrC8jfJO6
 -----END RSA PRIVATE KEY-----
 `
 )
+
+func TestDecryptedStoreKeyLocator(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	// in real life the consumer would have the key (maybe in a HSM). here we just steal it from the bus
+	kek, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey([]byte(exampleCertsKek))
+	assert.Ok(t, err)
+	certKeyPem, err := certs.ById("dummyCertId").Certificate.PrivateKeyEncrypted.DecryptNoFingerprint(kek)
+	assert.Ok(t, err)
+	certKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey(certKeyPem)
+	assert.Ok(t, err)
+
+	// issued from CSR => no private key on the bus
+	pumpEvents(t, certs, cbdomain.NewCertificateObtained(
+		"dummyCertId",
+		"renewal",
+		[]string{"*.prod4.fn61.net", "prod4.fn61.net"},
+		t0.AddDate(0, 0, 21),
+		exampleCert,
+		"",
+		nil,
+		"dns-01",
+		"",
+		"",
+		"dummyCsr",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0)))
+
+	lookup := func(store *DecryptedStore) string {
+		cert, err := store.ByHostname("prod4.fn61.net")
+		switch {
+		case err != nil:
+			return err.Error()
+		case cert == nil:
+			return "not found"
+		default:
+			return "ok"
+		}
+	}
+
+	withLocator := func(keyLocator KeyLocator) *DecryptedStore {
+		store := newDecryptedStoreTrustingExampleRoot(t, certs, exampleCertsKek)
+		store.now = func() time.Time { return t0 }
+		store.SetKeyLocator(keyLocator)
+		return store
+	}
+
+	assert.EqualString(t, lookup(withLocator(nil)), "not found")
+
+	assert.EqualString(t, lookup(withLocator(func(cert ManagedCertificate) (crypto.Signer, error) {
+		assert.EqualString(t, cert.CSR, "dummyCsr")
+
+		return certKey, nil
+	})), "ok")
+
+	assert.EqualString(t, lookup(withLocator(func(_ ManagedCertificate) (crypto.Signer, error) {
+		return nil, nil // we don't have the key for this cert
+	})), "not found")
+
+	assert.EqualString(t, lookup(withLocator(func(_ ManagedCertificate) (crypto.Signer, error) {
+		return kek, nil
+	})), "located private key does not match cert")
+
+	assert.EqualString(t, lookup(withLocator(func(_ ManagedCertificate) (crypto.Signer, error) {
+		return nil, errors.New("HSM unreachable")
+	})), "HSM unreachable")
+}
@@ -7,6 +7,11 @@ import (
 func CertsDueForRenewal(store *Store, now time.Time) []ManagedCertificate {
 	due := []ManagedCertificate{}
 	for _, cert := range store.All() {
+		// already renewed, waiting for activation
+		if store.StagedById(cert.Id) != nil {
+			continue
+		}
+
 		if cert.RenewAt.Before(now) {
 			due = append(due, cert)
 		}
@@ -19,3 +24,20 @@ func CertsDueForRenewal(store *Store, now time.Time) []ManagedCertificate {
 func renewAtFromExpiration(expires time.Time) time.Time {
 	return expires.AddDate(0, -1, 0)
 }
+
+// the cert we rolled back to would usually be due right away, and renewing it would undo the
+// rollback. give humans a week (or half of the remaining validity, if less) to fix what broke
+// the renewal. explicit renewal works anytime
+func renewAtAfterRollback(expires time.Time, rolledBackAt time.Time) time.Time {
+	grace := 7 * 24 * time.Hour
+	if remaining := expires.Sub(rolledBackAt) / 2; remaining < grace {
+		grace = remaining
+	}
+
+	renewAt := renewAtFromExpiration(expires)
+	if pinned := rolledBackAt.Add(grace); pinned.After(renewAt) {
+		return pinned
+	}
+
+	return renewAt
+}
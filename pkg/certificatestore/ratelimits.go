@@ -0,0 +1,163 @@
+package certificatestore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// how many certs we allow ourselves to issue within a rolling window. modeled after
+// https://letsencrypt.org/docs/rate-limits/
+type RateLimitBudget struct {
+	CertsPerRegisteredDomain int // renewals (= same exact set of domains issued before) don't count
+	DuplicateCerts           int // per exact set of domains
+	Window                   time.Duration
+}
+
+func LetsEncryptRateLimits() RateLimitBudget {
+	return RateLimitBudget{
+		CertsPerRegisteredDomain: 50,
+		DuplicateCerts:           5,
+		Window:                   7 * 24 * time.Hour,
+	}
+}
+
+// remaining budget if we were to issue a cert for given domains at "now"
+type RateLimitRemaining struct {
+	RegisteredDomain         int    `json:"registered_domain"`          // smallest remaining among the domains' registered domains
+	RegisteredDomainTightest string `json:"registered_domain_tightest"` // the registered domain that has the above remaining
+	DuplicateCerts           int    `json:"duplicate_certs"`
+	ExemptAsRenewal          bool   `json:"exempt_as_renewal"` // RegisteredDomain limit doesn't apply
+}
+
+// returned when issuing would exceed the budget
+type RateLimitBudgetExceededError struct {
+	Reason string
+}
+
+func (r *RateLimitBudgetExceededError) Error() string {
+	return "rate limit budget exceeded: " + r.Reason
+}
+
+func RemainingRateLimitBudget(
+	issuances []Issuance,
+	domains []string,
+	budget RateLimitBudget,
+	now time.Time,
+) RateLimitRemaining {
+	windowStart := now.Add(-budget.Window)
+	set := domainSetKey(domains)
+
+	remaining := RateLimitRemaining{
+		RegisteredDomain: budget.CertsPerRegisteredDomain,
+		DuplicateCerts:   budget.DuplicateCerts,
+	}
+
+	// domain set keys of issuances that happened before the one being looked at
+	issuedSetsSoFar := map[string]bool{}
+
+	usedPerRegisteredDomain := map[string]int{}
+
+	for _, issuance := range issuances {
+		if issuance.ChallengeType == ChallengeTypeImported { // not from the ACME CA
+			continue
+		}
+
+		issuanceSet := domainSetKey(issuance.Domains)
+		isRenewal := issuedSetsSoFar[issuanceSet]
+		issuedSetsSoFar[issuanceSet] = true
+
+		if issuance.Timestamp.Before(windowStart) || issuance.Timestamp.After(now) {
+			continue
+		}
+
+		if issuanceSet == set {
+			remaining.DuplicateCerts--
+		}
+
+		if !isRenewal {
+			// a cert counts once for each registered domain it contains
+			for _, registeredDomain := range registeredDomains(issuance.Domains) {
+				usedPerRegisteredDomain[registeredDomain]++
+			}
+		}
+	}
+
+	remaining.ExemptAsRenewal = issuedSetsSoFar[set]
+
+	for _, registeredDomain := range registeredDomains(domains) {
+		left := budget.CertsPerRegisteredDomain - usedPerRegisteredDomain[registeredDomain]
+
+		if remaining.RegisteredDomainTightest == "" || left < remaining.RegisteredDomain {
+			remaining.RegisteredDomain = left
+			remaining.RegisteredDomainTightest = registeredDomain
+		}
+	}
+
+	return remaining
+}
+
+// returns *RateLimitBudgetExceededError if issuing a cert for domains would exceed the budget
+func CheckRateLimitBudget(
+	issuances []Issuance,
+	domains []string,
+	budget RateLimitBudget,
+	now time.Time,
+) error {
+	remaining := RemainingRateLimitBudget(issuances, domains, budget, now)
+
+	if remaining.DuplicateCerts <= 0 {
+		return &RateLimitBudgetExceededError{fmt.Sprintf(
+			"%d certs for %s within %s",
+			budget.DuplicateCerts,
+			strings.Join(domains, ", "),
+			budget.Window)}
+	}
+
+	if !remaining.ExemptAsRenewal && remaining.RegisteredDomain <= 0 {
+		return &RateLimitBudgetExceededError{fmt.Sprintf(
+			"%d certs for registered domain %s within %s",
+			budget.CertsPerRegisteredDomain,
+			remaining.RegisteredDomainTightest,
+			budget.Window)}
+	}
+
+	return nil
+}
+
+// ("*.example.com", "www.example.co.uk") => ("example.co.uk", "example.com")
+func registeredDomains(domains []string) []string {
+	unique := map[string]bool{}
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "*."))
+
+		registeredDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+		if err != nil { // e.g. domain is itself a public suffix
+			registeredDomain = domain
+		}
+
+		unique[registeredDomain] = true
+	}
+
+	sorted := []string{}
+	for registeredDomain := range unique {
+		sorted = append(sorted, registeredDomain)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// order- and case-insensitive identity for a set of domains
+func domainSetKey(domains []string) string {
+	normalized := []string{}
+	for _, domain := range domains {
+		normalized = append(normalized, strings.ToLower(domain))
+	}
+	sort.Strings(normalized)
+
+	return strings.Join(normalized, ",")
+}
@@ -0,0 +1,120 @@
+package certificatestore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/function61/gokit/assert"
+)
+
+var (
+	rlNow    = time.Date(2020, 5, 15, 12, 0, 0, 0, time.UTC)
+	rlBudget = RateLimitBudget{
+		CertsPerRegisteredDomain: 3,
+		DuplicateCerts:           2,
+		Window:                   7 * 24 * time.Hour,
+	}
+)
+
+func issuedDaysAgo(days int, domains ...string) Issuance {
+	return Issuance{
+		Domains:   domains,
+		Timestamp: rlNow.Add(-time.Duration(days) * 24 * time.Hour),
+	}
+}
+
+func TestRateLimitDuplicateCerts(t *testing.T) {
+	issuances := []Issuance{
+		issuedDaysAgo(2, "example.com", "www.example.com"),
+		issuedDaysAgo(1, "www.example.com", "EXAMPLE.com"), // same set, different order & case
+	}
+
+	remaining := RemainingRateLimitBudget(issuances, []string{"example.com", "www.example.com"}, rlBudget, rlNow)
+	assert.Assert(t, remaining.DuplicateCerts == 0)
+	assert.Assert(t, remaining.ExemptAsRenewal)
+
+	err := CheckRateLimitBudget(issuances, []string{"example.com", "www.example.com"}, rlBudget, rlNow)
+	assert.EqualString(t, err.Error(), "rate limit budget exceeded: 2 certs for example.com, www.example.com within 168h0m0s")
+
+	budgetExceeded := &RateLimitBudgetExceededError{}
+	assert.Assert(t, errors.As(err, &budgetExceeded))
+
+	// different set is fine
+	assert.Ok(t, CheckRateLimitBudget(issuances, []string{"example.com"}, rlBudget, rlNow))
+}
+
+func TestRateLimitRegisteredDomain(t *testing.T) {
+	issuances := []Issuance{
+		issuedDaysAgo(3, "a.example.com"),
+		issuedDaysAgo(2, "b.example.com"),
+		issuedDaysAgo(1, "c.example.com", "example.net"),
+		issuedDaysAgo(1, "a.example.co.uk"),
+	}
+
+	remaining := RemainingRateLimitBudget(issuances, []string{"*.example.net", "d.example.com"}, rlBudget, rlNow)
+	assert.Assert(t, remaining.RegisteredDomain == 0)
+	assert.EqualString(t, remaining.RegisteredDomainTightest, "example.com")
+	assert.Assert(t, !remaining.ExemptAsRenewal)
+
+	assert.EqualString(
+		t,
+		CheckRateLimitBudget(issuances, []string{"d.example.com"}, rlBudget, rlNow).Error(),
+		"rate limit budget exceeded: 3 certs for registered domain example.com within 168h0m0s")
+
+	// public suffix awareness: example.co.uk is its own registered domain
+	remaining = RemainingRateLimitBudget(issuances, []string{"b.example.co.uk"}, rlBudget, rlNow)
+	assert.Assert(t, remaining.RegisteredDomain == 2)
+	assert.EqualString(t, remaining.RegisteredDomainTightest, "example.co.uk")
+}
+
+func TestRateLimitIgnoresImported(t *testing.T) {
+	imported := issuedDaysAgo(1, "example.com")
+	imported.ChallengeType = ChallengeTypeImported
+
+	issuances := []Issuance{imported, imported, imported}
+
+	remaining := RemainingRateLimitBudget(issuances, []string{"example.com"}, rlBudget, rlNow)
+	assert.Assert(t, remaining.DuplicateCerts == 2)
+	assert.Assert(t, remaining.RegisteredDomain == 3)
+	assert.Assert(t, !remaining.ExemptAsRenewal)
+}
+
+func TestRateLimitRenewalExemption(t *testing.T) {
+	issuances := []Issuance{
+		issuedDaysAgo(30, "a.example.com"), // outside window, but makes later ones renewals
+		issuedDaysAgo(3, "a.example.com"),
+		issuedDaysAgo(2, "b.example.com"),
+		issuedDaysAgo(2, "c.example.com"),
+	}
+
+	// renewal of a.example.com didn't consume registered domain budget
+	remaining := RemainingRateLimitBudget(issuances, []string{"d.example.com"}, rlBudget, rlNow)
+	assert.Assert(t, remaining.RegisteredDomain == 1)
+	assert.Ok(t, CheckRateLimitBudget(issuances, []string{"d.example.com"}, rlBudget, rlNow))
+
+	// exhaust registered domain budget
+	issuances = append(issuances, issuedDaysAgo(1, "d.example.com"))
+
+	assert.Assert(t, CheckRateLimitBudget(issuances, []string{"e.example.com"}, rlBudget, rlNow) != nil)
+
+	// renewals are still allowed
+	assert.Ok(t, CheckRateLimitBudget(issuances, []string{"b.example.com"}, rlBudget, rlNow))
+}
+
+func TestRateLimitWindowExpiry(t *testing.T) {
+	issuances := []Issuance{
+		issuedDaysAgo(8, "example.com"),
+		issuedDaysAgo(6, "example.com"),
+		issuedDaysAgo(5, "example.com"),
+	}
+
+	assert.Assert(t, CheckRateLimitBudget(issuances, []string{"example.com"}, rlBudget, rlNow) != nil)
+
+	// two days later the oldest in-window issuance has dropped out
+	later := rlNow.Add(48 * time.Hour)
+
+	remaining := RemainingRateLimitBudget(issuances, []string{"example.com"}, rlBudget, later)
+	assert.Assert(t, remaining.DuplicateCerts == 1)
+	assert.Ok(t, CheckRateLimitBudget(issuances, []string{"example.com"}, rlBudget, later))
+}
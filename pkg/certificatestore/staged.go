@@ -0,0 +1,40 @@
+package certificatestore
+
+import (
+	"time"
+
+	"github.com/function61/eventhorizon/pkg/ehclient"
+)
+
+// for canaries: staged certs take precedence over active ones
+func PreferStaged(store *Store) VersionedByHostnameFinder {
+	return &preferStaged{store}
+}
+
+type preferStaged struct {
+	store *Store
+}
+
+func (p *preferStaged) ByHostname(hostname string) *ManagedCertificate {
+	if staged := p.store.StagedByHostname(hostname); staged != nil {
+		return staged
+	}
+
+	return p.store.ByHostname(hostname)
+}
+
+func (p *preferStaged) Version() ehclient.Cursor {
+	return p.store.Version()
+}
+
+// staged certs whose automatic activation time has passed
+func StagedCertsDueForActivation(store *Store, now time.Time) []StagedCertificate {
+	due := []StagedCertificate{}
+	for _, cert := range store.Staged() {
+		if !cert.ActivateAt.IsZero() && !cert.ActivateAt.After(now) {
+			due = append(due, cert)
+		}
+	}
+
+	return due
+}
@@ -2,8 +2,13 @@ package certificatestore
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/function61/certbus/pkg/cbdomain"
 	"github.com/function61/certbus/pkg/encryptedbox"
@@ -21,6 +26,14 @@ const (
 type Store struct {
 	certificates []*ManagedCertificate
 	byHostname   map[string]*ManagedCertificate
+	staged       []*StagedCertificate
+	stagedByHost map[string]*ManagedCertificate
+	requests     []CertificateRequest             // pending ones, oldest first
+	challenges   map[string]Challenge             // keyed by token
+	leases       map[string]RenewalLease          // keyed by cert id
+	renewalErrs  map[string]RenewalError          // keyed by cert id. cleared by successful renewal
+	issuances    []Issuance                       // oldest first
+	versions     map[string][]*ManagedCertificate // by id, every cert that has been active, oldest first
 	latestConfig *cbdomain.ConfigUpdated
 	version      ehclient.Cursor
 	mu           sync.Mutex
@@ -31,6 +44,14 @@ func New(tenant ehreader.Tenant, logger *log.Logger) *Store {
 	return &Store{
 		certificates: []*ManagedCertificate{},
 		byHostname:   map[string]*ManagedCertificate{},
+		staged:       []*StagedCertificate{},
+		stagedByHost: map[string]*ManagedCertificate{},
+		requests:     []CertificateRequest{},
+		challenges:   map[string]Challenge{},
+		leases:       map[string]RenewalLease{},
+		renewalErrs:  map[string]RenewalError{},
+		issuances:    []Issuance{},
+		versions:     map[string][]*ManagedCertificate{},
 		version:      ehclient.Beginning(tenant.Stream(Stream)),
 		logl:         logex.Levels(logger),
 	}
@@ -86,6 +107,146 @@ func (c *Store) All() []ManagedCertificate {
 	return copied
 }
 
+func (c *Store) Staged() []StagedCertificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	copied := []StagedCertificate{}
+	for _, cert := range c.staged {
+		copied = append(copied, *cert)
+	}
+
+	return copied
+}
+
+func (c *Store) StagedById(id string) *StagedCertificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cert := range c.staged {
+		if cert.Id == id {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+func (c *Store) StagedByHostname(hostname string) *ManagedCertificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stagedByHost[hostname]
+}
+
+// the cert that was active for this id before the current one (nil if none)
+func (c *Store) PreviousVersion(id string) *ManagedCertificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var current *ManagedCertificate
+	for _, cert := range c.certificates {
+		if cert.Id == id {
+			current = cert
+		}
+	}
+	if current == nil {
+		return nil
+	}
+
+	versions := c.versions[id]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Certificate.CertPemBundle != current.Certificate.CertPemBundle {
+			previous := *versions[i]
+			return &previous
+		}
+	}
+
+	return nil
+}
+
+// all certificates ever obtained (including ones of removed managed certs), oldest first
+func (c *Store) Issuances() []Issuance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Issuance{}, c.issuances...)
+}
+
+// all certificates obtained for given managed cert id, oldest first
+func (c *Store) History(id string) []Issuance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	history := []Issuance{}
+	for _, issuance := range c.issuances {
+		if issuance.CertId == id {
+			history = append(history, issuance)
+		}
+	}
+
+	return history
+}
+
+// requests that are not yet fulfilled nor failed
+func (c *Store) PendingRequests() []CertificateRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]CertificateRequest{}, c.requests...)
+}
+
+// nil if cert is not being renewed (or the lease has expired)
+func (c *Store) ActiveRenewalLease(id string, now time.Time) *RenewalLease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lease, found := c.leases[id]
+	if !found || !now.Before(lease.Expires) {
+		return nil
+	}
+
+	return &lease
+}
+
+// nil if latest renewal (if any) succeeded
+func (c *Store) LastRenewalError(id string) *RenewalError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	renewalErr, found := c.renewalErrs[id]
+	if !found {
+		return nil
+	}
+
+	return &renewalErr
+}
+
+func (c *Store) ChallengeByToken(token string) *Challenge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	challenge, found := c.challenges[token]
+	if !found {
+		return nil
+	}
+
+	return &challenge
+}
+
+func (c *Store) ChallengeByDomain(challengeType string, domain string) *Challenge {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, challenge := range c.challenges {
+		if challenge.Type == challengeType && challenge.Domain == domain {
+			return &challenge
+		}
+	}
+
+	return nil
+}
+
 func (c *Store) ProcessEvents(_ context.Context, processAndCommit ehreader.EventProcessorHandler) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -116,20 +277,66 @@ func (c *Store) processEvent(ev ehevent.Event) error {
 					Ciphertext:     e.PrivateKeyCiphertext,
 				},
 			},
+			ChallengeType:    e.ChallengeType,
+			DNS01DelegatedTo: e.DNS01DelegatedTo,
+			PreferredChain:   e.PreferredChain,
+			CSR:              e.CSR,
+		}
+
+		if e.Staged {
+			// a newer staged cert replaces the previous staged one
+			c.removeStagedById(cert.Id)
+
+			c.staged = append(c.staged, &StagedCertificate{
+				ManagedCertificate: *cert,
+				ActivateAt:         e.ActivateAt,
+			})
+		} else {
+			// non-staged cert supersedes a staged one
+			c.removeStagedById(cert.Id)
+
+			c.setActive(cert)
+		}
+
+		issuance := Issuance{
+			CertId:        e.Id,
+			Domains:       e.Domains,
+			Timestamp:     e.Meta().Timestamp,
+			Reason:        e.Reason,
 			ChallengeType: e.ChallengeType,
+			Actor:         e.Meta().ActingUserOrDefaultToTarget(),
+			NotAfter:      e.Expires,
+		}
+
+		// history is informational, so a bad cert shouldn't stop the whole projection
+		if leaf, err := parseLeafFromPemBundle(e.CertPemBundle); err == nil {
+			issuance.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+			issuance.Issuer = leaf.Issuer.String()
+			issuance.NotBefore = leaf.NotBefore
+			issuance.NotAfter = leaf.NotAfter
+		} else {
+			c.logl.Error.Printf("CertificateObtained id=%s: %v", e.Id, err)
 		}
 
-		// since we'll append the cert to a list, we don't want 2x CertificateObtained
-		// events adding two items to the list. double is natural due to renewals
-		c.removeCertById(cert.Id)
+		c.issuances = append(c.issuances, issuance)
 
-		c.certificates = append(c.certificates, cert)
+		delete(c.leases, e.Id) // renewal done
+		delete(c.renewalErrs, e.Id)
 
 		c.rebuildByHostname()
+
+		// new cert might fulfill on-demand requests
+		c.removeRequests(func(req CertificateRequest) bool {
+			return c.hasCertFor(req.Hostname)
+		})
 	case *cbdomain.CertificateRemoved:
 		c.logl.Info.Printf("CertificateRemoved id=%s", e.Id)
 
 		c.removeCertById(e.Id)
+		c.removeStagedById(e.Id)
+		delete(c.versions, e.Id) // re-used id (e.g. import) must not roll back to before removal
+		delete(c.leases, e.Id)
+		delete(c.renewalErrs, e.Id)
 
 		// we could just delete each cert.Domains from c.byHostname here and have better perf,
 		// but that doesn't take into account this case:
@@ -140,11 +347,121 @@ func (c *Store) processEvent(ev ehevent.Event) error {
 		//
 		// in this case example.com wouldn't have a cert in byHostname. i.e obtaining wildcard before
 		// decommissioning old ManagedCertificate
+		c.rebuildByHostname()
+	case *cbdomain.CertificateActivated:
+		c.logl.Info.Printf("CertificateActivated id=%s", e.Id)
+
+		staged := c.removeStagedById(e.Id)
+		if staged == nil { // already activated, or superseded by non-staged cert
+			return nil
+		}
+
+		activated := staged.ManagedCertificate
+
+		c.setActive(&activated)
+
+		c.rebuildByHostname()
+
+		c.removeRequests(func(req CertificateRequest) bool {
+			return c.hasCertFor(req.Hostname)
+		})
+	case *cbdomain.CertificateRolledBack:
+		c.logl.Info.Printf("CertificateRolledBack id=%s", e.Id)
+
+		// a pending staged cert would otherwise replace the one we rolled back to
+		c.removeStagedById(e.Id)
+
+		// these are settings of the managed cert, not of a particular version
+		preferredChain := ""
+		csr := ""
+		for _, cert := range c.certificates {
+			if cert.Id == e.Id {
+				preferredChain = cert.PreferredChain
+				csr = cert.CSR
+			}
+		}
+
+		// the version we roll back from is broken, so it's no longer a rollback target
+		c.removeVersion(e.Id, c.activeBundle(e.Id))
+
+		c.setActive(&ManagedCertificate{
+			Id:      e.Id,
+			Domains: e.Domains,
+			RenewAt: renewAtAfterRollback(e.Expires, e.Meta().Timestamp),
+			Certificate: CertDetails{
+				NotAfter:      e.Expires,
+				CertPemBundle: e.CertPemBundle,
+				PrivateKeyEncrypted: &encryptedbox.Box{
+					KeyFingerprint: e.PrivateKeyDekFingerprint,
+					Ciphertext:     e.PrivateKeyCiphertext,
+				},
+			},
+			ChallengeType:    e.ChallengeType,
+			DNS01DelegatedTo: e.DNS01DelegatedTo,
+			PreferredChain:   preferredChain,
+			CSR:              csr,
+		})
+
 		c.rebuildByHostname()
 	case *cbdomain.ConfigUpdated:
 		c.logl.Info.Println("ConfigUpdated")
 
 		c.latestConfig = e
+	case *cbdomain.CertificateRequested:
+		c.logl.Info.Printf("CertificateRequested hostname=%s", e.Hostname)
+
+		// multiple loadbalancers can request the same hostname before the manager gets to it
+		if c.hasCertFor(e.Hostname) || c.hasRequestFor(e.Hostname) {
+			return nil
+		}
+
+		c.requests = append(c.requests, CertificateRequest{
+			Hostname:    e.Hostname,
+			RequestedAt: e.Meta().Timestamp,
+		})
+	case *cbdomain.CertificateRequestFailed:
+		c.logl.Error.Printf("CertificateRequestFailed hostname=%s: %s", e.Hostname, e.Error)
+
+		c.removeRequests(func(req CertificateRequest) bool {
+			return req.Hostname == e.Hostname
+		})
+	case *cbdomain.ChallengePresented:
+		c.logl.Debug.Printf("ChallengePresented type=%s domain=%s", e.ChallengeType, e.Domain)
+
+		c.challenges[e.Token] = Challenge{
+			Type:    e.ChallengeType,
+			Domain:  e.Domain,
+			Token:   e.Token,
+			KeyAuth: e.KeyAuth,
+		}
+	case *cbdomain.ChallengeCleanedUp:
+		c.logl.Debug.Printf("ChallengeCleanedUp token=%s", e.Token)
+
+		delete(c.challenges, e.Token)
+	case *cbdomain.RenewalLeaseAcquired:
+		c.logl.Debug.Printf("RenewalLeaseAcquired id=%s holder=%s", e.Id, e.Holder)
+
+		// an expired lease is simply reclaimed by the next acquirer
+		c.leases[e.Id] = RenewalLease{
+			CertId:  e.Id,
+			Holder:  e.Holder,
+			Expires: e.Expires,
+		}
+	case *cbdomain.RenewalLeaseReleased:
+		c.logl.Debug.Printf("RenewalLeaseReleased id=%s holder=%s", e.Id, e.Holder)
+
+		// lease might've been reclaimed by someone else meanwhile
+		if lease, found := c.leases[e.Id]; found && lease.Holder == e.Holder {
+			delete(c.leases, e.Id)
+		}
+
+		if e.Error != "" {
+			c.renewalErrs[e.Id] = RenewalError{
+				Error:     e.Error,
+				Timestamp: e.Meta().Timestamp,
+				Failures:  c.renewalErrs[e.Id].Failures + 1,
+			}
+		}
 	default:
 		return ehreader.UnsupportedEventTypeErr(ev)
 	}
@@ -164,6 +481,53 @@ func (c *Store) removeCertById(id string) {
 	}
 }
 
+// replaces the currently active cert (if any) for the id
+func (c *Store) setActive(cert *ManagedCertificate) {
+	// since we'll append the cert to a list, we don't want 2x CertificateObtained
+	// events adding two items to the list. double is natural due to renewals
+	c.removeCertById(cert.Id)
+
+	c.certificates = append(c.certificates, cert)
+
+	c.versions[cert.Id] = append(c.versions[cert.Id], cert)
+}
+
+func (c *Store) activeBundle(id string) string {
+	for _, cert := range c.certificates {
+		if cert.Id == id {
+			return cert.Certificate.CertPemBundle
+		}
+	}
+
+	return ""
+}
+
+func (c *Store) removeVersion(id string, certPemBundle string) {
+	kept := []*ManagedCertificate{}
+	for _, version := range c.versions[id] {
+		if version.Certificate.CertPemBundle != certPemBundle {
+			kept = append(kept, version)
+		}
+	}
+
+	c.versions[id] = kept
+}
+
+// returns the removed cert (nil if not found)
+func (c *Store) removeStagedById(id string) *StagedCertificate {
+	for idx, cert := range c.staged {
+		if cert.Id != id {
+			continue
+		}
+
+		c.staged = append(c.staged[:idx], c.staged[idx+1:]...)
+
+		return cert
+	}
+
+	return nil
+}
+
 func (c *Store) rebuildByHostname() {
 	c.byHostname = map[string]*ManagedCertificate{}
 
@@ -172,4 +536,52 @@ func (c *Store) rebuildByHostname() {
 			c.byHostname[domain] = cert
 		}
 	}
+
+	c.stagedByHost = map[string]*ManagedCertificate{}
+
+	for _, cert := range c.staged {
+		for _, domain := range cert.Domains {
+			c.stagedByHost[domain] = &cert.ManagedCertificate
+		}
+	}
+}
+
+func (c *Store) hasCertFor(hostname string) bool {
+	if _, found := c.byHostname[hostname]; found {
+		return true
+	}
+
+	_, found := c.byHostname[wildcardVersionOfHostname(hostname)]
+	return found
+}
+
+func (c *Store) hasRequestFor(hostname string) bool {
+	for _, req := range c.requests {
+		if req.Hostname == hostname {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Store) removeRequests(shouldRemove func(CertificateRequest) bool) {
+	remaining := []CertificateRequest{}
+	for _, req := range c.requests {
+		if !shouldRemove(req) {
+			remaining = append(remaining, req)
+		}
+	}
+
+	c.requests = remaining
+}
+
+// first cert in bundle is the leaf
+func parseLeafFromPemBundle(pemBundle string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(pemBundle))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate in PEM bundle")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
 }
@@ -3,6 +3,7 @@ package certificatestore
 import (
 	"context"
 	"encoding/base64"
+	"strings"
 	"testing"
 	"time"
 
@@ -55,6 +56,206 @@ func TestCertificateRemoval(t *testing.T) {
 	assert.Assert(t, certs.ByHostname("prod4.fn61.net") == nil)
 }
 
+func TestHistory(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	pumpEvents(t, certs,
+		cbdomain.NewCertificateObtained(
+			"dummyCertId",
+			"renewal",
+			[]string{"*.prod4.fn61.net", "prod4.fn61.net"},
+			t0.AddDate(0, 0, 90),
+			"not a PEM",
+			"dummyFingerprint",
+			[]byte{},
+			"dns-01",
+			"",
+			"",
+			"",
+			false,
+			time.Time{},
+			ehevent.Meta(t0.AddDate(0, 0, 60), "joonas")),
+		cbdomain.NewCertificateRemoved(
+			"dummyCertId",
+			ehevent.MetaSystemUser(t0.AddDate(0, 0, 70))))
+
+	assert.Assert(t, len(certs.History("notFound")) == 0)
+
+	// removal doesn't forget history
+	history := certs.History("dummyCertId")
+	assert.Assert(t, len(history) == 2)
+
+	assert.EqualString(t, history[0].Reason, "new")
+	assert.EqualString(t, history[0].ChallengeType, "dummyChallengeType")
+	assert.EqualString(t, history[0].Actor, "")
+	assert.EqualString(t, history[0].Timestamp.Format(time.RFC3339), "2020-01-31T16:54:00Z")
+	assert.EqualString(t, history[0].Serial, "2")
+	assert.EqualString(t, history[0].Issuer, "CN=CertBus test root CA")
+	assert.EqualString(t, history[0].NotBefore.Format(time.RFC3339), "2020-01-01T00:00:00Z")
+	assert.EqualString(t, history[0].NotAfter.Format(time.RFC3339), "2050-01-01T00:00:00Z")
+
+	// unparseable cert gets recorded with what the event tells
+	assert.EqualString(t, history[1].Reason, "renewal")
+	assert.EqualString(t, history[1].ChallengeType, "dns-01")
+	assert.EqualString(t, history[1].Actor, "joonas")
+	assert.EqualString(t, history[1].Serial, "")
+	assert.EqualString(t, history[1].NotAfter.Format(time.RFC3339), "2020-04-30T16:54:00Z")
+}
+
+func TestStagedCertificate(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	stagedObtained := func(activateAt time.Time) ehevent.Event {
+		return cbdomain.NewCertificateObtained(
+			"dummyCertId",
+			"renewal",
+			[]string{"*.prod4.fn61.net", "prod4.fn61.net"},
+			t0.AddDate(0, 0, 90),
+			"stagedPem",
+			"dummyFingerprint",
+			[]byte{},
+			"dns-01",
+			"",
+			"",
+			"",
+			true,
+			activateAt,
+			ehevent.MetaSystemUser(t0.AddDate(0, 0, 1)))
+	}
+
+	pumpEvents(t, certs, stagedObtained(t0.AddDate(0, 0, 2)))
+
+	// active cert is still being served
+	assert.EqualString(t, certs.ByHostname("prod4.fn61.net").Certificate.CertPemBundle, exampleCert)
+	assert.Assert(t, len(certs.All()) == 1)
+
+	// .. except for canaries
+	assert.EqualString(t, PreferStaged(certs).ByHostname("prod4.fn61.net").Certificate.CertPemBundle, "stagedPem")
+	assert.EqualString(t, PreferStaged(certs).ByHostname("*.prod4.fn61.net").Certificate.CertPemBundle, "stagedPem")
+	assert.Assert(t, PreferStaged(certs).ByHostname("notfound.net") == nil)
+
+	// renewed cert is waiting for activation, so no need to renew again
+	assert.Assert(t, len(CertsDueForRenewal(certs, t0)) == 0)
+
+	assert.Assert(t, len(StagedCertsDueForActivation(certs, t0.AddDate(0, 0, 1))) == 0)
+	assert.Assert(t, len(StagedCertsDueForActivation(certs, t0.AddDate(0, 0, 2))) == 1)
+
+	pumpEvents(t, certs, cbdomain.NewCertificateActivated(
+		"dummyCertId",
+		ehevent.MetaSystemUser(t0.AddDate(0, 0, 2))))
+
+	assert.EqualString(t, certs.ByHostname("prod4.fn61.net").Certificate.CertPemBundle, "stagedPem")
+	assert.Assert(t, len(certs.All()) == 1)
+	assert.Assert(t, len(certs.Staged()) == 0)
+	assert.Assert(t, certs.StagedByHostname("prod4.fn61.net") == nil)
+
+	// activating again is a no-op
+	pumpEvents(t, certs, cbdomain.NewCertificateActivated(
+		"dummyCertId",
+		ehevent.MetaSystemUser(t0.AddDate(0, 0, 3))))
+
+	assert.Assert(t, len(certs.All()) == 1)
+
+	// manual activation never becomes due. removal also removes staged
+	pumpEvents(t, certs, stagedObtained(time.Time{}))
+
+	assert.Assert(t, certs.StagedById("dummyCertId") != nil)
+	assert.Assert(t, len(StagedCertsDueForActivation(certs, t0.AddDate(1, 0, 0))) == 0)
+
+	pumpEvents(t, certs, cbdomain.NewCertificateRemoved(
+		"dummyCertId",
+		ehevent.MetaSystemUser(t0.AddDate(0, 0, 4))))
+
+	assert.Assert(t, len(certs.All()) == 0)
+	assert.Assert(t, len(certs.Staged()) == 0)
+	assert.Assert(t, PreferStaged(certs).ByHostname("prod4.fn61.net") == nil)
+}
+
+func TestRollback(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	assert.Assert(t, certs.PreviousVersion("dummyCertId") == nil)
+	assert.Assert(t, certs.PreviousVersion("notFound") == nil)
+
+	pumpEvents(t, certs, cbdomain.NewCertificateObtained(
+		"dummyCertId",
+		"renewal",
+		[]string{"*.prod4.fn61.net", "prod4.fn61.net"},
+		t0.AddDate(0, 0, 90),
+		"brokenChainPem",
+		"dummyFingerprint",
+		[]byte{0x01},
+		"dns-01",
+		"",
+		"ISRG Root X1",
+		"",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0.AddDate(0, 0, 1))))
+
+	previous := certs.PreviousVersion("dummyCertId")
+	assert.EqualString(t, previous.Certificate.CertPemBundle, exampleCert)
+
+	pumpEvents(t, certs, cbdomain.NewCertificateRolledBack(
+		previous.Id,
+		previous.Domains,
+		previous.Certificate.NotAfter,
+		previous.Certificate.CertPemBundle,
+		previous.Certificate.PrivateKeyEncrypted.KeyFingerprint,
+		previous.Certificate.PrivateKeyEncrypted.Ciphertext,
+		previous.ChallengeType,
+		previous.DNS01DelegatedTo,
+		ehevent.MetaSystemUser(t0.AddDate(0, 0, 2))))
+
+	assert.Assert(t, len(certs.All()) == 1)
+	assert.EqualString(t, certs.ByHostname("prod4.fn61.net").Certificate.CertPemBundle, exampleCert)
+	assert.EqualString(t, certs.ByHostname("prod4.fn61.net").Certificate.PrivateKeyEncrypted.KeyFingerprint, "SHA256:wupoCrsM0GYWNWLwcBEDZZSe4ToLaxcuCWAgOiTsFCA")
+
+	// preferred chain is a setting of the managed cert, so it survives rollback
+	assert.EqualString(t, certs.ByHostname("prod4.fn61.net").PreferredChain, "ISRG Root X1")
+
+	// rollback is not an issuance
+	assert.Assert(t, len(certs.History("dummyCertId")) == 2)
+
+	// the one we rolled back from is broken, so it's not a rollback target
+	assert.Assert(t, certs.PreviousVersion("dummyCertId") == nil)
+
+	// not immediately due for renewal (which would undo the rollback)
+	assert.Assert(t, len(CertsDueForRenewal(certs, t0.AddDate(0, 0, 2))) == 0)
+	assert.EqualString(t, certs.ById("dummyCertId").RenewAt.Format(time.RFC3339), "2020-02-09T16:54:00Z") // a week after rollback
+}
+
+func TestRemovalForgetsVersions(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	obtained := func(pem string, at time.Time) ehevent.Event {
+		return cbdomain.NewCertificateObtained(
+			"dummyCertId",
+			"import",
+			[]string{"*.prod4.fn61.net", "prod4.fn61.net"},
+			t0.AddDate(0, 0, 90),
+			pem,
+			"dummyFingerprint",
+			[]byte{0x01},
+			ChallengeTypeImported,
+			"",
+			"",
+			"",
+			false,
+			time.Time{},
+			ehevent.MetaSystemUser(at))
+	}
+
+	pumpEvents(t, certs, obtained("secondPem", t0.AddDate(0, 0, 1)))
+	assert.Assert(t, certs.PreviousVersion("dummyCertId") != nil)
+
+	pumpEvents(t, certs, cbdomain.NewCertificateRemoved("dummyCertId", ehevent.MetaSystemUser(t0.AddDate(0, 0, 2))))
+
+	// id re-used => versions from before removal are not rollback targets
+	pumpEvents(t, certs, obtained("reimportedPem", t0.AddDate(0, 0, 3)))
+	assert.Assert(t, certs.PreviousVersion("dummyCertId") == nil)
+}
+
 func TestWildcardCertificateObtainBeforeRemovingParallelNonWildcard(t *testing.T) {
 	certs, t0 := setupCommon(t)
 
@@ -68,6 +269,11 @@ func TestWildcardCertificateObtainBeforeRemovingParallelNonWildcard(t *testing.T
 			"dummyHash"+idx,
 			[]byte("dummyPrivKey"+idx),
 			"dummyChallengeType",
+			"",
+			"",
+			"",
+			false,
+			time.Time{},
 			ehevent.MetaSystemUser(t0)))
 	}
 
@@ -89,6 +295,129 @@ func TestWildcardCertificateObtainBeforeRemovingParallelNonWildcard(t *testing.T
 	assert.EqualString(t, certs.ByHostname("example.com").Id, "2")
 }
 
+func TestCertificateRequests(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	requested := func(hostname string) {
+		pumpEvents(t, certs, cbdomain.NewCertificateRequested(hostname, ehevent.MetaSystemUser(t0)))
+	}
+
+	pendingHostnames := func() string {
+		hostnames := []string{}
+		for _, req := range certs.PendingRequests() {
+			hostnames = append(hostnames, req.Hostname)
+		}
+		return strings.Join(hostnames, ", ")
+	}
+
+	requested("customer1.com")
+	requested("customer2.com")
+	requested("customer1.com")      // duplicate from another loadbalancer
+	requested("foo.prod4.fn61.net") // already covered by wildcard
+
+	assert.EqualString(t, pendingHostnames(), "customer1.com, customer2.com")
+
+	pumpEvents(t, certs, cbdomain.NewCertificateObtained(
+		"customer2cert",
+		"on-demand",
+		[]string{"customer2.com"},
+		t0,
+		exampleCert,
+		"dummyHash",
+		[]byte("dummyPrivKey"),
+		"http-01",
+		"",
+		"",
+		"",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0)))
+
+	assert.EqualString(t, pendingHostnames(), "customer1.com")
+
+	pumpEvents(t, certs, cbdomain.NewCertificateRequestFailed(
+		"customer1.com",
+		"DNS problem: NXDOMAIN",
+		ehevent.MetaSystemUser(t0)))
+
+	assert.EqualString(t, pendingHostnames(), "")
+}
+
+func TestRenewalLease(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	leaseHolder := func(at time.Time) string {
+		if lease := certs.ActiveRenewalLease("dummyCertId", at); lease != nil {
+			return lease.Holder
+		}
+		return "(none)"
+	}
+
+	pumpEvents(t, certs, cbdomain.NewRenewalLeaseAcquired(
+		"dummyCertId",
+		"lambda",
+		t0.Add(15*time.Minute),
+		ehevent.MetaSystemUser(t0)))
+
+	assert.EqualString(t, leaseHolder(t0), "lambda")
+	assert.EqualString(t, leaseHolder(t0.Add(15*time.Minute)), "(none)") // expired
+
+	// expired lease reclaimed
+	pumpEvents(t, certs, cbdomain.NewRenewalLeaseAcquired(
+		"dummyCertId",
+		"laptop",
+		t0.Add(30*time.Minute),
+		ehevent.MetaSystemUser(t0.Add(16*time.Minute))))
+
+	// release by previous (expired) holder doesn't affect the current one
+	pumpEvents(t, certs, cbdomain.NewRenewalLeaseReleased(
+		"dummyCertId",
+		"lambda",
+		"timeout",
+		ehevent.MetaSystemUser(t0)))
+
+	assert.EqualString(t, leaseHolder(t0.Add(16*time.Minute)), "laptop")
+
+	pumpEvents(t, certs, cbdomain.NewRenewalLeaseReleased(
+		"dummyCertId",
+		"laptop",
+		"CA is down",
+		ehevent.MetaSystemUser(t0.Add(17*time.Minute))))
+
+	assert.EqualString(t, leaseHolder(t0.Add(16*time.Minute)), "(none)")
+
+	// failures are remembered even if the release didn't end the current lease
+	assert.EqualString(t, certs.LastRenewalError("dummyCertId").Error, "CA is down")
+	assert.Assert(t, certs.LastRenewalError("dummyCertId").Timestamp.Equal(t0.Add(17*time.Minute)))
+	assert.Assert(t, certs.LastRenewalError("dummyCertId").Failures == 2)
+
+	// obtaining the cert ends the lease
+	pumpEvents(t, certs, cbdomain.NewRenewalLeaseAcquired(
+		"dummyCertId",
+		"lambda",
+		t0.Add(15*time.Minute),
+		ehevent.MetaSystemUser(t0)))
+
+	pumpEvents(t, certs, cbdomain.NewCertificateObtained(
+		"dummyCertId",
+		"renewal",
+		[]string{"prod4.fn61.net", "*.prod4.fn61.net"},
+		t0,
+		exampleCert,
+		"dummyHash",
+		[]byte("dummyPrivKey"),
+		"dns-01",
+		"",
+		"",
+		"",
+		false,
+		time.Time{},
+		ehevent.MetaSystemUser(t0)))
+
+	assert.EqualString(t, leaseHolder(t0), "(none)")
+	assert.Assert(t, certs.LastRenewalError("dummyCertId") == nil)
+}
+
 func TestGetLatestEncryptedConfig(t *testing.T) {
 	certs, _ := setupCommon(t)
 
@@ -109,7 +438,7 @@ func setupCommon(t *testing.T) (*Store, time.Time) {
 	assert.Ok(t, err)
 
 	// our dummy cert expires in 21 days, therefore its renewal day is ~9 days in the past
-	// NOTE: dummy cert actual hostnames and hostnames are not the same (I was lazy)
+	// NOTE: dummy cert's actual validity period is longer than what we claim here (I was lazy)
 	pumpEvents(t, certs,
 		cbdomain.NewCertificateObtained(
 			"dummyCertId",
@@ -120,6 +449,11 @@ func setupCommon(t *testing.T) (*Store, time.Time) {
 			"SHA256:wupoCrsM0GYWNWLwcBEDZZSe4ToLaxcuCWAgOiTsFCA", // of exampleCertsKek
 			exampleCertPrivateKeyEncryptedWithExampleKek,
 			"dummyChallengeType",
+			"",
+			"",
+			"",
+			false,
+			time.Time{},
 			ehevent.MetaSystemUser(t0)),
 		cbdomain.NewConfigUpdated(
 			"encryptionKeyFingerprint",
@@ -154,28 +488,31 @@ func pumpEvents(t *testing.T, processor ehreader.EventsProcessor, events ...ehev
 
 const (
 	exampleCert = `-----BEGIN CERTIFICATE-----
-MIIEHDCCAoSgAwIBAgIQbyK0y1bhFzShdP+Wh5gKsTANBgkqhkiG9w0BAQsFADBf
-MR4wHAYDVQQKExVta2NlcnQgZGV2ZWxvcG1lbnQgQ0ExGjAYBgNVBAsMEXJvb3RA
-MzU1YTY4YjM5MTI5MSEwHwYDVQQDDBhta2NlcnQgcm9vdEAzNTVhNjhiMzkxMjkw
-HhcNMTkwNjAxMDAwMDAwWhcNMzAwMjA4MTg0NDM2WjBFMScwJQYDVQQKEx5ta2Nl
-cnQgZGV2ZWxvcG1lbnQgY2VydGlmaWNhdGUxGjAYBgNVBAsMEXJvb3RAMzU1YTY4
-YjM5MTI5MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAvPcc75ddkjI8
-4VibjPczJ+lPtgxT5KY/v+uY9dzzc1ApkYj0Ny58RjIJb3VJl7Z53kJFBrATmesu
-p3uTWZzxCiP5zO+bekDEXmFWGKt3wvE5Qwu+t9RFeUPqWkjKeyhQmjo2mmCzZ3L/
-dhcVj+UwqtJcDl16B2u0YxNNbdvJGjoJ7teYAGH6pKmmld17z5+Bcqsi16IKk/3q
-4JNDkHcBMMhR2P6oRwqVDuDDyaCABGKw3P9izY4GPwJZCkNMnVGJKvOp+eBqTEe9
-0WjwdGg5TuB4/rWKOUGZHGhd9bGpOcgzcrmjDzOjbs3T/fjlwNWWSY/sLld6aMQg
-aggT2+0WVQIDAQABo24wbDAOBgNVHQ8BAf8EBAMCBaAwEwYDVR0lBAwwCgYIKwYB
-BQUHAwEwDAYDVR0TAQH/BAIwADAfBgNVHSMEGDAWgBTU5eodMALrQqetKOuVAR2l
-UxEImDAWBgNVHREEDzANggtleGFtcGxlLm9yZzANBgkqhkiG9w0BAQsFAAOCAYEA
-PBs1EUmGs8pwkHzWCik1GPC3NK6eSNb5zyuyPoeXTourjDgKeSgz9xnujUernum4
-MtWbr7Jg0VUN373UBT5c7Ty+8e0l5ODyWiXQUZ+YlHunPK8vlKe+pvBkltwCW7De
-zsmtu/96n1MVU/5EKpntpf5F4IlR4JC+x6egt5XVDXd1fFKtYGwzPa6PvaqYDqq5
-DZBsurnPjcIiH5ozc+7rVg9noVCWEMpZktQq/9kgqgbwmaAYk3CPOZOLEQw8tSHh
-nI90+hE7La1jEyqwjKFwE0zR0etmoJYSLLAAZCPNL0WphEpqoxLkLm6qNmiRG8pe
-OCeqDwSJgmgtbJ+66Rx3Q+OGZ4LvFcYE/Yu33sT39WenQDOKFKxlg1PTo2Ec0sBZ
-mZ/xgSajyEYzK9eazqo0z2zYsnxQkrQOVYvpCMuoQGW+biWrWc667yC3T4zyb480
-swNhxeADXfBfXzZdY1wYDD7Bmr4SP7F18ktS2/aNf6HweIA3+YYFfLsLnvFO/w+j
+MIICaTCCAg+gAwIBAgIBAjAKBggqhkjOPQQDAjAfMR0wGwYDVQQDExRDZXJ0QnVz
+IHRlc3Qgcm9vdCBDQTAgFw0yMDAxMDEwMDAwMDBaGA8yMDUwMDEwMTAwMDAwMFow
+GTEXMBUGA1UEAxMOcHJvZDQuZm42MS5uZXQwggEiMA0GCSqGSIb3DQEBAQUAA4IB
+DwAwggEKAoIBAQC89xzvl12SMjzhWJuM9zMn6U+2DFPkpj+/65j13PNzUCmRiPQ3
+LnxGMglvdUmXtnneQkUGsBOZ6y6ne5NZnPEKI/nM75t6QMReYVYYq3fC8TlDC763
+1EV5Q+paSMp7KFCaOjaaYLNncv92FxWP5TCq0lwOXXoHa7RjE01t28kaOgnu15gA
+YfqkqaaV3XvPn4FyqyLXogqT/ergk0OQdwEwyFHY/qhHCpUO4MPJoIAEYrDc/2LN
+jgY/AlkKQ0ydUYkq86n54GpMR73RaPB0aDlO4Hj+tYo5QZkcaF31sak5yDNyuaMP
+M6NuzdP9+OXA1ZZJj+wuV3poxCBqCBPb7RZVAgMBAAGjdTBzMA4GA1UdDwEB/wQE
+AwIFoDATBgNVHSUEDDAKBggrBgEFBQcDATAfBgNVHSMEGDAWgBSUh567ph5EQb+h
+LSa5n+2dyHC6LjArBgNVHREEJDAighAqLnByb2Q0LmZuNjEubmV0gg5wcm9kNC5m
+bjYxLm5ldDAKBggqhkjOPQQDAgNIADBFAiEAu4SZzqchma16fXNoqyEQViB4ueEl
+djrrAOYvLckYUPICIGEO5ojHhpDydgy8vfeKtc0hBnSOo3/eSmHwJkkMk8Hl
+-----END CERTIFICATE-----
+`
+	// issuer of exampleCert
+	exampleRootCa = `-----BEGIN CERTIFICATE-----
+MIIBcjCCARegAwIBAgIBATAKBggqhkjOPQQDAjAfMR0wGwYDVQQDExRDZXJ0QnVz
+IHRlc3Qgcm9vdCBDQTAgFw0yMDAxMDEwMDAwMDBaGA8yMDUwMDEwMTAwMDAwMFow
+HzEdMBsGA1UEAxMUQ2VydEJ1cyB0ZXN0IHJvb3QgQ0EwWTATBgcqhkjOPQIBBggq
+hkjOPQMBBwNCAAS2bE4721dlIw4qTJDnjcvs+Z+uSiGWTCqcQE1srOUMXP7bT6KH
+Ee8X0x5Z52ds4hjCoJup71txOxWr8B5NOsnEo0IwQDAOBgNVHQ8BAf8EBAMCAgQw
+DwYDVR0TAQH/BAUwAwEB/zAdBgNVHQ4EFgQUlIeeu6YeREG/oS0muZ/tnchwui4w
+CgYIKoZIzj0EAwIDSQAwRgIhAN3Bmou4T8c96Qw1VciBCFFPvJd6AjJbKOaMC0uj
+36OGAiEA+p90MSMbvri0ezNVcFtxuYkQU3xqOjXxJj/Bqsi2iKI=
 -----END CERTIFICATE-----
 `
 	exampleCertPrivateKeyEncryptedWithExampleKekBase64 = `
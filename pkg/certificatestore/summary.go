@@ -0,0 +1,83 @@
+package certificatestore
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// what one usually wants to know about a managed cert. stable schema for scripts to consume
+type CertSummary struct {
+	Id               string         `json:"id"`
+	Domains          []string       `json:"domains"`
+	ChallengeType    string         `json:"challenge_type"`
+	Serial           string         `json:"serial"` // hex, as shown in CT logs
+	Issuer           string         `json:"issuer"`
+	KeyType          string         `json:"key_type"` // "RSA-2048" | "ECDSA-P-256" | "Ed25519"
+	NotBefore        time.Time      `json:"not_before"`
+	NotAfter         time.Time      `json:"not_after"`
+	DaysLeft         int            `json:"days_left"` // negative if expired
+	RenewAt          time.Time      `json:"renew_at"`
+	LastRenewalError *RenewalError  `json:"last_renewal_error"` // null if latest renewal succeeded
+	Staged           *StagedSummary `json:"staged"`             // null if no renewal is waiting for activation
+}
+
+type StagedSummary struct {
+	Serial     string    `json:"serial"`
+	NotAfter   time.Time `json:"not_after"`
+	ActivateAt time.Time `json:"activate_at"` // zero = needs manual activation
+}
+
+// fields that come from the cert itself are left empty if it can't be parsed
+func Summarize(store *Store, cert ManagedCertificate, now time.Time) CertSummary {
+	summary := CertSummary{
+		Id:               cert.Id,
+		Domains:          cert.Domains,
+		ChallengeType:    cert.ChallengeType,
+		NotAfter:         cert.Certificate.NotAfter,
+		DaysLeft:         daysLeft(cert.Certificate.NotAfter, now),
+		RenewAt:          cert.RenewAt,
+		LastRenewalError: store.LastRenewalError(cert.Id),
+	}
+
+	if leaf, err := parseLeafFromPemBundle(cert.Certificate.CertPemBundle); err == nil {
+		summary.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+		summary.Issuer = leaf.Issuer.String()
+		summary.KeyType = keyType(leaf)
+		summary.NotBefore = leaf.NotBefore
+	}
+
+	if staged := store.StagedById(cert.Id); staged != nil {
+		summary.Staged = &StagedSummary{
+			NotAfter:   staged.Certificate.NotAfter,
+			ActivateAt: staged.ActivateAt,
+		}
+
+		if leaf, err := parseLeafFromPemBundle(staged.Certificate.CertPemBundle); err == nil {
+			summary.Staged.Serial = fmt.Sprintf("%x", leaf.SerialNumber)
+		}
+	}
+
+	return summary
+}
+
+// whole days. "0" = expires within a day
+func daysLeft(notAfter time.Time, now time.Time) int {
+	return int(notAfter.Sub(now).Hours() / 24)
+}
+
+func keyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
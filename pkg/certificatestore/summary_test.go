@@ -0,0 +1,35 @@
+package certificatestore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/function61/certbus/pkg/cbdomain"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/assert"
+)
+
+func TestSummarize(t *testing.T) {
+	certs, t0 := setupCommon(t)
+
+	summary := Summarize(certs, *certs.ById("dummyCertId"), t0)
+
+	assert.EqualString(t, summary.Serial, "2")
+	assert.EqualString(t, summary.Issuer, "CN=CertBus test root CA")
+	assert.EqualString(t, summary.KeyType, "RSA-2048")
+	assert.EqualString(t, summary.NotBefore.Format(time.RFC3339), "2020-01-01T00:00:00Z")
+	assert.Assert(t, summary.DaysLeft == 21)
+	assert.Assert(t, summary.LastRenewalError == nil)
+	assert.Assert(t, summary.Staged == nil)
+
+	pumpEvents(t, certs, cbdomain.NewRenewalLeaseReleased(
+		"dummyCertId",
+		"lambda",
+		"CA is down",
+		ehevent.MetaSystemUser(t0)))
+
+	summary = Summarize(certs, *certs.ById("dummyCertId"), t0.AddDate(0, 0, 22))
+
+	assert.EqualString(t, summary.LastRenewalError.Error, "CA is down")
+	assert.Assert(t, summary.DaysLeft == -1)
+}
@@ -8,12 +8,25 @@ import (
 	"github.com/function61/certbus/pkg/encryptedbox"
 )
 
+// ChallengeType of certs that were not obtained via ACME but imported (EV certs, internal PKI etc.).
+// these can't be renewed automatically
+const ChallengeTypeImported = "imported"
+
 type ManagedCertificate struct {
-	Id            string      `json:"id"`
-	Domains       []string    `json:"domains"` // when wildcard: ["*.domain", "domain"]
-	RenewAt       time.Time   `json:"renew_at"`
-	Certificate   CertDetails `json:"certificate"`
-	ChallengeType string      `json:"challenge_type"`
+	Id               string      `json:"id"`
+	Domains          []string    `json:"domains"` // when wildcard: ["*.domain", "domain"]
+	RenewAt          time.Time   `json:"renew_at"`
+	Certificate      CertDetails `json:"certificate"`
+	ChallengeType    string      `json:"challenge_type"`
+	DNS01DelegatedTo string      `json:"dns01_delegated_to,omitempty"` // zone that our _acme-challenge CNAMEs point to
+	PreferredChain   string      `json:"preferred_chain,omitempty"`    // overrides config's preferred chain (also for renewals)
+	CSR              string      `json:"csr,omitempty"`                // PEM. if set, private key lives with consumers (see KeyLocator)
+}
+
+// obtained, but served only by canaries until activated
+type StagedCertificate struct {
+	ManagedCertificate
+	ActivateAt time.Time `json:"activate_at"` // zero = needs manual activation
 }
 
 type CertDetails struct {
@@ -21,3 +34,45 @@ type CertDetails struct {
 	CertPemBundle       string            `json:"cert_pem_bundle"` // "bundle" = contains intermediate cert
 	PrivateKeyEncrypted *encryptedbox.Box `json:"private_key_encrypted"`
 }
+
+// on-demand request (from a loadbalancer) for the manager to issue a cert
+type CertificateRequest struct {
+	Hostname    string    `json:"hostname"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// a manager is renewing the cert. others must not, until the lease expires
+type RenewalLease struct {
+	CertId  string    `json:"cert_id"`
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// why the latest renewal attempt failed
+type RenewalError struct {
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+	Failures  int       `json:"failures"` // consecutive, i.e. since last successful renewal
+}
+
+// ACME challenge being answered via the bus
+type Challenge struct {
+	Type    string `json:"type"` // "http-01" | ...
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"key_auth"`
+}
+
+// a single CertificateObtained. kept even after the managed cert is removed (rate limits still apply)
+type Issuance struct {
+	CertId        string    `json:"cert_id"`
+	Domains       []string  `json:"domains"`
+	Timestamp     time.Time `json:"timestamp"`
+	Reason        string    `json:"reason"` // "new" | "renewal" | ...
+	ChallengeType string    `json:"challenge_type"`
+	Actor         string    `json:"actor"`  // "" = system
+	Serial        string    `json:"serial"` // hex, as shown in CT logs. "" if cert could not be parsed
+	Issuer        string    `json:"issuer"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+}
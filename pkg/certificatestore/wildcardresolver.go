@@ -21,7 +21,7 @@ func ByHostnameSupportingWildcard(hostname string, store ManagedCertificateByHos
 
 func DecryptedByHostnameSupportingWildcard(hostname string, store *DecryptedStore) (*tls.Certificate, error) {
 	cert, err := store.ByHostname(hostname)
-	if cert != nil {
+	if cert != nil || err != nil {
 		return cert, err
 	}
 
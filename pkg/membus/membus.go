@@ -0,0 +1,154 @@
+// In-memory stand-in for EventHorizon, so the manager can be tested end-to-end without AWS
+package membus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+)
+
+// unlike ehreadertest.EventLog, reading a never-written stream is not an error (same as with
+// real EventHorizon) and it's safe for concurrent use
+type Bus struct {
+	streams            map[string][]ehclient.LogEntry
+	conflictsRemaining int
+	mu                 sync.Mutex
+}
+
+// interface assertion
+var _ ehclient.ReaderWriter = (*Bus)(nil)
+
+func New() *Bus {
+	return &Bus{
+		streams: map[string][]ehclient.LogEntry{},
+	}
+}
+
+func (b *Bus) TenantCtx(tenant ehreader.Tenant) ehreader.TenantCtx {
+	return *ehreader.NewTenantCtx(tenant, b)
+}
+
+// next n AppendAfter() calls fail as if a concurrent writer got there first
+func (b *Bus) InjectConflicts(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.conflictsRemaining = n
+}
+
+func (b *Bus) Append(ctx context.Context, stream string, events []string) (*ehclient.AppendResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.appendInternal(stream, events), nil
+}
+
+func (b *Bus) AppendAfter(ctx context.Context, after ehclient.Cursor, events []string) (*ehclient.AppendResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stream := after.Stream()
+
+	if b.conflictsRemaining > 0 {
+		b.conflictsRemaining--
+
+		return nil, ehclient.NewErrOptimisticLockingFailed(fmt.Errorf(
+			"conflict (injected): after=%s",
+			after.Serialize()))
+	}
+
+	afterActual := b.lastCursor(stream)
+
+	if !after.Equal(afterActual) {
+		return nil, ehclient.NewErrOptimisticLockingFailed(fmt.Errorf(
+			"conflict: afterRequested=%s afterActual=%s",
+			after.Serialize(),
+			afterActual.Serialize()))
+	}
+
+	return b.appendInternal(stream, events), nil
+}
+
+func (b *Bus) Read(_ context.Context, lastKnown ehclient.Cursor) (*ehclient.ReadResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := []ehclient.LogEntry{}
+	lastEntryCur := lastKnown
+
+	all := b.streams[lastKnown.Stream()]
+	next := lastKnown.Next()
+	if next.Version() < int64(len(all)) {
+		entries = append(entries, all[next.Version():]...)
+
+		lastEntryCur = b.lastCursor(lastKnown.Stream())
+	}
+
+	return &ehclient.ReadResult{
+		Entries:   entries,
+		LastEntry: lastEntryCur,
+		More:      false,
+	}, nil
+}
+
+// testing helper
+func (b *Bus) AppendE(stream string, events ...ehevent.Event) {
+	eventsSerialized := []string{}
+
+	for _, event := range events {
+		eventsSerialized = append(eventsSerialized, ehevent.Serialize(event))
+	}
+
+	if _, err := b.Append(context.TODO(), stream, eventsSerialized); err != nil {
+		panic(err)
+	}
+}
+
+// all events ever appended to the stream, in order. for making assertions
+func (b *Bus) Events(stream string, types ehevent.Allocators) ([]ehevent.Event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := []ehevent.Event{}
+
+	for _, entry := range b.streams[stream] {
+		for _, eventSerialized := range entry.Events {
+			event, err := ehevent.Deserialize(eventSerialized, types)
+			if err != nil {
+				return nil, err
+			}
+
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+func (b *Bus) appendInternal(stream string, events []string) *ehclient.AppendResult {
+	last := b.lastCursor(stream)
+	next := last.Next()
+
+	b.streams[stream] = append(b.streams[stream], ehclient.LogEntry{
+		Stream:  stream,
+		Version: next.Version(),
+		Events:  events,
+	})
+
+	return &ehclient.AppendResult{
+		Cursor: next,
+	}
+}
+
+func (b *Bus) lastCursor(stream string) ehclient.Cursor {
+	entries := b.streams[stream]
+	if len(entries) == 0 {
+		return ehclient.Beginning(stream)
+	}
+
+	return ehclient.At(stream, entries[len(entries)-1].Version)
+}